@@ -0,0 +1,8 @@
+//go:build !xvid_cintcopy
+// +build !xvid_cintcopy
+
+package xvid
+
+// forceCIntCopy forces the C int arrays to be copied to and from Go slices, even on platforms where
+// the C int and Go int (or int32) sizes are equal; enabled with the xvid_cintcopy build tag.
+const forceCIntCopy = false
@@ -0,0 +1,69 @@
+package xvid
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// The decoding tests exercise the C int alias paths by default; run them with the xvid_cintcopy build tag
+// (go test -tags xvid_cintcopy) to exercise the copy paths, which must return the same values.
+
+func TestCopyCIntsPaths(t *testing.T) {
+	src := []int32{2, 31, 4, 0, -1, 17}
+	alias := make([]int32, len(src))
+	copied := make([]int32, len(src))
+	copyCInts(alias, unsafe.Pointer(&src[0]), true)
+	copyCInts(copied, unsafe.Pointer(&src[0]), false)
+	for i := range src {
+		if alias[i] != src[i] || copied[i] != src[i] {
+			t.Errorf("value %d: alias path %d, copy path %d, expected %d", i, alias[i], copied[i], src[i])
+		}
+	}
+}
+
+func TestDecodeQuantizers(t *testing.T) {
+	initXvid(t)
+	t.Logf("forceCIntCopy: %v, aliasCInts: %v", forceCIntCopy, aliasCInts())
+	init := testEncoderInit(64, 48)
+	// keep the frames in the same order in the encoder and the decoder
+	init.MaxBFrames = 0
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var data []byte
+	var quantizers []int
+	var output []byte
+	for i := 0; i < 5; i++ {
+		n, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, output[:n]...)
+		if stats != nil {
+			quantizers = append(quantizers, stats.Quantizer)
+		}
+	}
+
+	frames := decodeTestStream(t, data, ColorSpaceNoOutput)
+	if len(frames) != len(quantizers) {
+		t.Fatalf("decoded %d frames, expected %d", len(frames), len(quantizers))
+	}
+	mbs := ((init.Width + 15) / 16) * ((init.Height + 15) / 16)
+	for i, stats := range frames {
+		q := stats.StatsFrame.Quantizers
+		if len(q) != mbs {
+			t.Fatalf("frame %d: got %d quantizers, expected %d", i, len(q), mbs)
+		}
+		for j, v := range q {
+			// without adaptive quantization, all macroblocks use the frame quantizer
+			if int(v) != quantizers[i] {
+				t.Errorf("frame %d: macroblock %d quantizer %d, expected %d", i, j, v, quantizers[i])
+			}
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"image"
 	"image/png"
 	"io"
 	"os"
@@ -46,12 +45,13 @@ func main() {
 		} else if err != nil {
 			panic(err)
 		}
-		if stats.StatsFrame == nil { // some frames can be metadata (VOL) only, skip those for this example
+		if !stats.IsFrame() { // some frames can be metadata (VOL) only, skip those for this example
 			continue
 		}
-		output := image.NewRGBA(image.Rectangle{Max: image.Point{X: decoder.Width, Y: decoder.Height}})
-		output.Pix = img.Planes[0]
-		output.Stride = img.Strides[0]
+		output, err := img.ToGoImage(decoder.Width, decoder.Height)
+		if err != nil {
+			panic(err)
+		}
 
 		f, err := os.Create(fmt.Sprintf("examples/data/output-%d.png", i))
 		if err != nil {
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"image"
 	"image/jpeg"
 	"os"
 
@@ -39,21 +38,19 @@ func main() {
 	// disable B-frames (for this example's sake)
 	init.MaxBFrames = 0
 
-	encoder, err := xvid.NewEncoder(init)
+	of, err := os.Create("examples/data/stream.dat")
 	if err != nil {
 		panic(err)
 	}
-	defer encoder.Close()
+	defer of.Close()
+	// the encoded frames are written directly to the file by EncodeFrame
+	init.Output = of
 
-	of, err := os.Create("examples/data/stream.dat")
+	encoder, err := xvid.NewEncoder(init)
 	if err != nil {
 		panic(err)
 	}
-	defer of.Close()
-
-	// output buffer, re-alloc style, will be allocated & reused by the encoder
-	// reuse in all Encode calls for best performance
-	var output []byte
+	defer encoder.Close()
 
 	for i := 0; i < 10; i++ {
 		f, err := os.Open(fmt.Sprintf("examples/data/input-%d.jpg", i))
@@ -66,27 +63,20 @@ func main() {
 			panic(err)
 		}
 
-		// for this example's purpose all images are known to be YUV 420
-		// the xvid colorspace is chosen appropriately
+		// the xvid colorspace is chosen from the image type (YUV 420 for these images)
 		// the width & height is also known and hardcoded in the encoder Init
-		// but in a real use case could be obtained from the image bounds
-		input := inputJpeg.(*image.YCbCr)
-		img := xvid.Image{
-			Colorspace: xvid.ColorSpacePlanar,
-			Planes:     [][]byte{input.Y, input.Cb, input.Cr},
-			Strides:    []int{input.YStride, input.CStride},
-		}
-
-		n, _, err := encoder.Encode(xvid.EncoderFrame{
-			Input:  &img,
-			Output: &output,
-		})
+		// but in a real use case could be obtained from the returned dimensions
+		img, _, _, err := xvid.NewImageFromGo(inputJpeg)
 		if err != nil {
 			panic(err)
 		}
-		_, err = of.Write(output[:n])
-		if err != nil {
+
+		if _, err := encoder.EncodeFrame(&img); err != nil {
 			panic(err)
 		}
 	}
+	// flush the frames buffered by the encoder
+	if _, err := encoder.EncodeFrame(nil); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+
+	"github.com/delthas/go-xvid"
+)
+
+func main() {
+	if err := xvid.Init(); err != nil {
+		panic(err)
+	}
+
+	init := xvid.NewEncoderInit(320, 240, xvid.Fraction{25, 1}, []xvid.Plugin{
+		xvid.PluginRC1Pass(xvid.PluginRC1PassInit{
+			Bitrate: 250 * 1000, // 250 kbps
+		}),
+	})
+
+	encoder, err := xvid.NewEncoder(init)
+	if err != nil {
+		panic(err)
+	}
+	defer encoder.Close()
+
+	of, err := os.Create("examples/data/testpattern.dat")
+	if err != nil {
+		panic(err)
+	}
+	defer of.Close()
+
+	writer := xvid.NewEncoderWriter(encoder, of, nil)
+
+	// one second of each pattern
+	kinds := []xvid.PatternKind{xvid.PatternSolid, xvid.PatternBars, xvid.PatternGradient, xvid.PatternNoise}
+	for _, kind := range kinds {
+		for i := 0; i < 25; i++ {
+			// same solid color on every frame, but different noise on every frame
+			seed := int64(0)
+			if kind == xvid.PatternNoise {
+				seed = int64(i)
+			}
+			if _, err := writer.Encode(xvid.EncoderFrame{
+				Input: xvid.TestPattern(320, 240, kind, seed),
+			}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	// write the B-frames buffered by the encoder
+	if err := writer.Close(); err != nil {
+		panic(err)
+	}
+}
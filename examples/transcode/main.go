@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/delthas/go-xvid"
+)
+
+func main() {
+	if err := xvid.Init(); err != nil {
+		panic(err)
+	}
+
+	in, err := os.Open("examples/data/stream.dat") // raw xvid stream, e.g. created by the encoder example
+	if err != nil {
+		panic(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create("examples/data/transcoded.dat")
+	if err != nil {
+		panic(err)
+	}
+	defer out.Close()
+
+	// re-encode at a lower bitrate
+	// a width & height of 0 means the dimensions of the input stream are used
+	init := xvid.NewEncoderInit(0, 0, xvid.Fraction{25, 1}, []xvid.Plugin{
+		xvid.PluginRC1Pass(xvid.NewPluginRC1PassInit(100 * 1000)), // 100 kbps
+	})
+
+	if err := xvid.Transcode(in, out, init); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !xvid_pluginguard
+// +build !xvid_pluginguard
+
+package xvid
+
+// pluginGuard makes the plugin callbacks receive PluginData slices that are copies of the Xvid memory, poisoned after
+// the callback returns, to detect plugins that retain them; enabled with the xvid_pluginguard build tag. By default,
+// the slices alias the Xvid memory.
+const pluginGuard = false
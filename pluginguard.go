@@ -0,0 +1,7 @@
+//go:build xvid_pluginguard
+// +build xvid_pluginguard
+
+package xvid
+
+// pluginGuard is enabled by the xvid_pluginguard build tag, see pluginalias.go.
+const pluginGuard = true
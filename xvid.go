@@ -4,15 +4,52 @@ package xvid
 // #include "goxvid.h"
 import "C"
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
+	"image"
+	"image/draw"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 	"unsafe"
 )
 
+// aliasCInts reports whether C int arrays are used directly as Go int slices rather than copied
+func aliasCInts() bool {
+	return C.sizeof_int == unsafe.Sizeof(int(0)) && !forceCIntCopy
+}
+
+// copyCInts copies len(dst) C ints from the C array at p to dst, reading the array as int32 values directly if
+// alias is set (if C int and int32 have the same size), and converting each C int otherwise
+func copyCInts(dst []int32, p unsafe.Pointer, alias bool) {
+	sh := reflect.SliceHeader{
+		Data: uintptr(p),
+		Len:  len(dst),
+		Cap:  len(dst),
+	}
+	if alias {
+		copy(dst, *(*[]int32)(unsafe.Pointer(&sh)))
+		return
+	}
+	for i, v := range *(*[]C.int)(unsafe.Pointer(&sh)) {
+		dst[i] = int32(v)
+	}
+}
+
 func cbool(b bool) C.int {
 	if b {
 		return 1
@@ -43,6 +80,28 @@ func (e *Error) Error() string {
 	}
 }
 
+// Is reports whether target is an *Error with the same Xvid error code, so that errors.Is(err, ErrFormat) can be
+// used to check the category of an error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.code == e.code
+}
+
+// Sentinel values of the Xvid errors, to be compared with errors.Is (or Error.Is).
+var (
+	// general fault
+	ErrFail = &Error{C.XVID_ERR_FAIL}
+	// memory allocation error
+	ErrMemory = &Error{C.XVID_ERR_MEMORY}
+	// file format error
+	ErrFormat = &Error{C.XVID_ERR_FORMAT}
+	// version not supported
+	ErrVersion = &Error{C.XVID_ERR_VERSION}
+	// end of stream reached; the end of stream is reported with io.EOF instead by Decoder.Decode, Encoder.Flush
+	// and the other methods documented as such
+	ErrEnd = &Error{C.XVID_ERR_END}
+)
+
 func xvidErr(err C.int) *Error {
 	return &Error{int(err)}
 }
@@ -114,6 +173,12 @@ func (v Version) String() string {
 
 // ColorSpace is the color space of an Image.
 // See https://fourcc.org/yuv.php for details about each color space.
+//
+// Color spaces with subsampled chroma require aligned dimensions for encoding and converting: the 4:2:0 color spaces
+// (ColorSpacePlanar, ColorSpaceI420, ColorSpaceYV12, ColorSpaceNV12, ColorSpaceNV21) and ColorSpacePlanar422 require an even width and height, and the packed 4:2:2 color
+// spaces (ColorSpaceYUY2, ColorSpaceUYVY, ColorSpaceYVYU) require an even width; images with other dimensions must be
+// padded by the caller. The other color spaces have no alignment requirements. Xvid handles dimensions that are
+// not a multiple of the macroblock size (16 pixels) internally.
 type ColorSpace struct {
 	value int
 	// number of image planes for colorspace
@@ -135,6 +200,31 @@ var (
 		Strides:            2,
 		BitsPerPixel:       12,
 		BitsPerPixelPlanes: []int{8, 2, 2}}
+	// only for encoding: YUV 4:2:2 planar, like ColorSpacePlanar but with full height chroma planes;
+	// the chroma is downsampled vertically to 4:2:0 before encoding, with the EncoderFrame.ChromaFilter filter;
+	// planes[0] is Y, planes[1] is U, planes[2] is V;
+	// stride[0] is Y stride, stride[1] is U/V stride
+	ColorSpacePlanar422 ColorSpace = ColorSpace{value: colorSpacePlanar422,
+		Planes:             3,
+		Strides:            2,
+		BitsPerPixel:       16,
+		BitsPerPixelPlanes: []int{8, 4, 4}}
+	// only for conversion with Convert: YUV 4:2:0 semi-planar, FourCC NV12, as produced by many hardware decoders
+	// and cameras; the chroma is interleaved to or from ColorSpacePlanar in Go;
+	// planes[0] is Y, planes[1] is the interleaved U and V samples (UVUV...);
+	// stride[0] is Y stride, stride[1] is UV stride
+	ColorSpaceNV12 ColorSpace = ColorSpace{value: colorSpaceNV12,
+		Planes:             2,
+		Strides:            2,
+		BitsPerPixel:       12,
+		BitsPerPixelPlanes: []int{8, 4}}
+	// only for conversion with Convert: like ColorSpaceNV12, but with the V and U samples swapped (VUVU...),
+	// FourCC NV21
+	ColorSpaceNV21 ColorSpace = ColorSpace{value: colorSpaceNV21,
+		Planes:             2,
+		Strides:            2,
+		BitsPerPixel:       12,
+		BitsPerPixelPlanes: []int{8, 4}}
 	// YUV 4:2:0 planar, packed as YUV, FourCC I420
 	// stride[0] is Y stride, U and V stride are stride[0]/2
 	ColorSpaceI420 ColorSpace = ColorSpace{value: C.XVID_CSP_I420,
@@ -173,25 +263,25 @@ var (
 		Strides:            1,
 		BitsPerPixel:       24,
 		BitsPerPixelPlanes: []int{24}}
-	// 32-bit BGRA packed
+	// 32-bit BGRA packed; as output, the alpha channel (cleared to 0 by Xvid) is set to 255
 	ColorSpaceBGRA ColorSpace = ColorSpace{value: C.XVID_CSP_BGRA,
 		Planes:             1,
 		Strides:            1,
 		BitsPerPixel:       32,
 		BitsPerPixelPlanes: []int{32}}
-	// 32-bit ABGR packed
+	// 32-bit ABGR packed; as output, the alpha channel (cleared to 0 by Xvid) is set to 255
 	ColorSpaceABGR ColorSpace = ColorSpace{value: C.XVID_CSP_ABGR,
 		Planes:             1,
 		Strides:            1,
 		BitsPerPixel:       32,
 		BitsPerPixelPlanes: []int{32}}
-	// 32-bit RGBA packed
+	// 32-bit RGBA packed; as output, the alpha channel (cleared to 0 by Xvid) is set to 255
 	ColorSpaceRGBA ColorSpace = ColorSpace{value: C.XVID_CSP_RGBA,
 		Planes:             1,
 		Strides:            1,
 		BitsPerPixel:       32,
 		BitsPerPixelPlanes: []int{32}}
-	// 32-bit ARGB packed
+	// 32-bit ARGB packed; as output, the alpha channel (cleared to 0 by Xvid) is set to 255
 	ColorSpaceARGB ColorSpace = ColorSpace{value: C.XVID_CSP_ARGB,
 		Planes:             1,
 		Strides:            1,
@@ -215,6 +305,14 @@ var (
 		Strides:            1,
 		BitsPerPixel:       16,
 		BitsPerPixelPlanes: []int{16}}
+	// only for decoding and conversion output: 8-bit greyscale, the luma plane of the 4:2:0 image, copied from the
+	// internal decoder buffers (or the conversion input) without any chroma conversion;
+	// planes[0] is Y; stride[0] is Y stride
+	ColorSpaceGray ColorSpace = ColorSpace{value: colorSpaceGray,
+		Planes:             1,
+		Strides:            1,
+		BitsPerPixel:       8,
+		BitsPerPixelPlanes: []int{8}}
 	// only for decoding: YUV 4:2:0 planar, but uses internal decoder buffers and strides rather than copying to a buffer; invalid after any call to a Decoder method
 	ColorSpaceInternal ColorSpace = ColorSpace{value: C.XVID_CSP_INTERNAL,
 		Planes:             3,
@@ -228,11 +326,39 @@ var (
 	// ColorSpaceSLICE    = ColorSpace{C.XVID_CSP_SLICE, 3}
 )
 
+// colorSpacePlanar422 is the value of ColorSpacePlanar422, which is not an Xvid color space
+const colorSpacePlanar422 = -1
+
+// values of ColorSpaceNV12, ColorSpaceNV21 and ColorSpaceGray, which are not Xvid color spaces
+const (
+	colorSpaceNV12 = -2
+	colorSpaceNV21 = -3
+	colorSpaceGray = -4
+)
+
+// ChromaFilter is a filter used to downsample the chroma of a ColorSpacePlanar422 image vertically to 4:2:0.
+type ChromaFilter int
+
+const (
+	// average each pair of chroma rows, the chroma samples are sited between the two rows as expected by MPEG-4;
+	// a fast, mild low-pass filter, that gives good results in most cases; this is the default
+	ChromaFilterAverage ChromaFilter = iota
+	// keep the even chroma rows only, discarding the odd rows; the fastest filter, but causes aliasing
+	// (jagged colored edges) on sharp vertical chroma details, and shifts the chroma up by half a row
+	ChromaFilterDrop
+	// filter the chroma rows with a [1 3 3 1]/8 kernel centered between each pair of rows; the slowest filter,
+	// with the least aliasing but slightly blurrier chroma
+	ChromaFilterSmooth
+)
+
 // DecoderFlag is a flag (or a bitwise-or union of flags) for decoding a frame, set in each frame.
 type DecoderFlag uint
 
 const (
-	// lowdelay mode
+	// lowdelay mode: for streams without B-frames, each frame is returned as soon as it is decoded, instead of only
+	// once the next reference (I/P) frame is decoded. Frames are never returned in decoding order: xvidcore always
+	// reorders B-frames to display order, so the coding order of a stream with B-frames must be inferred from the
+	// frame types, each reference frame being coded before the B-frames displayed just before it
 	DecoderLowDelay DecoderFlag = C.XVID_LOWDELAY
 	// indicate break/discontinuity in streaming
 	DecoderDiscontinuity DecoderFlag = C.XVID_DISCONTINUITY
@@ -437,6 +563,22 @@ const (
 	frameTypeNothing FrameType = C.XVID_TYPE_NOTHING
 )
 
+// MBType is the coding mode of a macroblock of a decoded frame.
+type MBType int
+
+const (
+	// coding mode not available from xvidcore
+	MBTypeUnknown MBType = iota
+	// intra coded macroblock
+	MBTypeIntra
+	// inter (motion-compensated) coded macroblock
+	MBTypeInter
+	// not coded (skipped) macroblock
+	MBTypeNotCoded
+	// inter coded macroblock using global motion compensation
+	MBTypeGMC
+)
+
 // ZoneType is a kind of bitrate Zone, which is applied on a range of frames while encoding.
 type ZoneType uint
 
@@ -537,6 +679,50 @@ type Image struct {
 	Strides []int
 }
 
+// checkDimensions returns an error if the dimensions are not aligned as required by the color space chroma subsampling.
+func (c ColorSpace) checkDimensions(width int, height int) error {
+	switch c.value {
+	case ColorSpacePlanar.value, ColorSpaceInternal.value, ColorSpaceI420.value, ColorSpaceYV12.value, colorSpaceNV12, colorSpaceNV21:
+		if width%2 != 0 || height%2 != 0 {
+			return fmt.Errorf("xvid: dimensions %dx%d not supported by 4:2:0 color space, width and height must be even: pad the image to %dx%d", width, height, width+width%2, height+height%2)
+		}
+	case ColorSpacePlanar422.value:
+		if width%2 != 0 || height%2 != 0 {
+			return fmt.Errorf("xvid: dimensions %dx%d not supported by 4:2:2 planar color space (encoded as 4:2:0), width and height must be even: pad the image to %dx%d", width, height, width+width%2, height+height%2)
+		}
+	case ColorSpaceYUY2.value, ColorSpaceUYVY.value, ColorSpaceYVYU.value:
+		if width%2 != 0 {
+			return fmt.Errorf("xvid: dimensions %dx%d not supported by 4:2:2 color space, width must be even: pad the image to %dx%d", width, height, width+1, height)
+		}
+	}
+	return nil
+}
+
+// planeSize returns the minimum stride (bytes per row) and the number of rows of plane j for the image dimensions.
+// Subsampled chroma dimensions are rounded up.
+func (c ColorSpace) planeSize(j int, width int, height int) (int, int) {
+	switch {
+	case c.Planes == 3 && j == 0:
+		return width, height
+	case c.value == ColorSpacePlanar422.value:
+		return (width + 1) / 2, height
+	case c.Planes == 3:
+		return (width + 1) / 2, (height + 1) / 2
+	case c.semiPlanar() && j == 0:
+		return width, height
+	case c.semiPlanar():
+		// one U and one V sample for each 2x2 pixels, interleaved
+		return (width + 1) / 2 * 2, (height + 1) / 2
+	case c.value == ColorSpaceI420.value || c.value == ColorSpaceYV12.value:
+		// the stride is the Y stride, both chroma planes follow with half the Y stride
+		return width, height + (height+1)/2
+	default:
+		return width * c.BitsPerPixelPlanes[j] / 8, height
+	}
+}
+
+// fixAlpha sets the alpha channel of 32-bit packed images to 255; it is called on every output image of Decode and
+// Convert, so that no option is needed to fix the alpha channel
 func (i *Image) fixAlpha(width int, height int) {
 	// the alpha channel is set to 0 instead of 255 due to an xvid implementation bug, fix this here
 	if i.Colorspace.value == ColorSpaceRGBA.value || i.Colorspace.value == ColorSpaceBGRA.value {
@@ -557,77 +743,277 @@ func (i *Image) fixAlpha(width int, height int) {
 	}
 }
 
-func (i *Image) nativeInput(width int, height int) (*C.xvid_image_t, error) {
-	if len(i.Planes) != i.Colorspace.Planes {
+// semiPlanar reports whether the color space is ColorSpaceNV12 or ColorSpaceNV21
+func (c ColorSpace) semiPlanar() bool {
+	return c.value == colorSpaceNV12 || c.value == colorSpaceNV21
+}
+
+// semiPlanarStrides validates the planes and strides of a ColorSpaceNV12 or ColorSpaceNV21 image, and returns its
+// strides, with the 0 strides replaced with the minimum strides; if output is set, the strides of the image are
+// replaced likewise and its nil planes are allocated, as in nativeOutput
+func (i *Image) semiPlanarStrides(width int, height int, output bool) ([]int, error) {
+	if output && i.Planes == nil {
+		i.Planes = make([][]byte, i.Colorspace.Planes)
+	} else if len(i.Planes) != i.Colorspace.Planes {
 		return nil, fmt.Errorf("xvid: unexpected number of planes for image, expected %d, got %d", i.Colorspace.Planes, len(i.Planes))
 	}
-	if i.Strides == nil {
+	if output && i.Strides == nil {
 		i.Strides = make([]int, i.Colorspace.Strides)
 	} else if len(i.Strides) != i.Colorspace.Strides {
 		return nil, fmt.Errorf("xvid: unexpected number of strides for image, expected %d, got %d", i.Colorspace.Strides, len(i.Strides))
 	}
+	strides := make([]int, len(i.Strides))
+	for j := range i.Planes {
+		minStride, rows := i.Colorspace.planeSize(j, width, height)
+		stride := i.Strides[j]
+		if stride == 0 {
+			stride = minStride
+		} else if stride < minStride {
+			return nil, fmt.Errorf("xvid: insufficient stride in plane %d (strides is the total length of row, not just the offset), need at least %d, got %d", j, minStride, stride)
+		}
+		strides[j] = stride
+		if output {
+			i.Strides[j] = stride
+			if i.Planes[j] == nil {
+				i.Planes[j] = make([]byte, stride*rows)
+			}
+		}
+		// the last row does not need to be padded up to the stride
+		l := stride*(rows-1) + minStride
+		if len(i.Planes[j]) == 0 {
+			return nil, fmt.Errorf("xvid: plane %d is empty", j)
+		} else if len(i.Planes[j]) < l {
+			return nil, fmt.Errorf("xvid: not enough space in plane %d, need at least %d, got %d", j, l, len(i.Planes[j]))
+		}
+	}
+	return strides, nil
+}
+
+// splitChroma copies a ColorSpaceNV12 or ColorSpaceNV21 image with the given strides to a new compact
+// ColorSpacePlanar image, deinterleaving its chroma plane; the vertical flip of the image is kept
+func splitChroma(input *Image, strides []int, width int, height int) Image {
+	cw, ch := (width+1)/2, (height+1)/2
+	output := Image{
+		Colorspace:   ColorSpacePlanar,
+		Planes:       [][]byte{make([]byte, width*height), make([]byte, cw*ch), make([]byte, cw*ch)},
+		Strides:      []int{width, cw},
+		VerticalFlip: input.VerticalFlip,
+	}
+	for y := 0; y < height; y++ {
+		copy(output.Planes[0][y*width:(y+1)*width], input.Planes[0][y*strides[0]:])
+	}
+	u, v := output.Planes[1], output.Planes[2]
+	if input.Colorspace.value == colorSpaceNV21 {
+		u, v = v, u
+	}
+	for y := 0; y < ch; y++ {
+		row := input.Planes[1][y*strides[1]:]
+		for x := 0; x < cw; x++ {
+			u[y*cw+x] = row[2*x]
+			v[y*cw+x] = row[2*x+1]
+		}
+	}
+	return output
+}
+
+// mergeChroma copies a ColorSpacePlanar image to a validated ColorSpaceNV12 or ColorSpaceNV21 image, interleaving
+// its chroma planes
+func mergeChroma(input *Image, output *Image, width int, height int) {
+	cw, ch := (width+1)/2, (height+1)/2
+	for y := 0; y < height; y++ {
+		copy(output.Planes[0][y*output.Strides[0]:], input.Planes[0][y*input.Strides[0]:y*input.Strides[0]+width])
+	}
+	u, v := input.Planes[1], input.Planes[2]
+	if output.Colorspace.value == colorSpaceNV21 {
+		u, v = v, u
+	}
+	for y := 0; y < ch; y++ {
+		row := output.Planes[1][y*output.Strides[1]:]
+		for x := 0; x < cw; x++ {
+			row[2*x] = u[y*input.Strides[1]+x]
+			row[2*x+1] = v[y*input.Strides[1]+x]
+		}
+	}
+}
+
+// Validate checks that the image is valid for the dimensions width and height, as an input image (e.g. of
+// Encoder.Encode) if asOutput is false, or as an output image (e.g. of Decoder.Decode) if asOutput is true, and
+// returns the first problem found (e.g. a wrong number of planes, an insufficient stride, or a plane too small),
+// with the same checks and errors as when the image is passed to xvidcore, but without modifying the image.
+// As an output image, nil Planes and nil planes are valid, since they are then allocated. ColorSpaceNV12 and
+// ColorSpaceNV21 images are always invalid, as they are only supported by Convert.
+func (i *Image) Validate(width int, height int, asOutput bool) error {
+	_, err := i.checkPlanes(width, height, asOutput)
+	return err
+}
+
+// checkPlanes checks the planes and strides of the image for the dimensions width and height, as an input or an
+// output image, and returns the effective stride of each plane, without modifying the image; as an output image,
+// nil Planes and nil planes are valid (they are allocated), and the planes are only checked for positive dimensions
+// and not ColorSpaceInternal
+func (i *Image) checkPlanes(width int, height int, output bool) ([4]int, error) {
+	// the strides are returned in an array rather than a slice, so that validating an image does not allocate
+	var strides [4]int
+	if output && i.Colorspace.value == ColorSpacePlanar422.value {
+		return strides, errors.New("xvid: unexpected colorspace ColorSpacePlanar422, use only for encoding input")
+	}
+	if !output && (width <= 0 || height <= 0) {
+		return strides, fmt.Errorf("xvid: invalid image dimensions %dx%d", width, height)
+	}
+	if i.Colorspace.semiPlanar() {
+		return strides, errors.New("xvid: unexpected colorspace ColorSpaceNV12 or ColorSpaceNV21, use only for conversion with Convert")
+	}
+	if (!output || i.Planes != nil) && len(i.Planes) != i.Colorspace.Planes {
+		return strides, fmt.Errorf("xvid: unexpected number of planes for image, expected %d, got %d", i.Colorspace.Planes, len(i.Planes))
+	}
+	if i.Strides != nil && len(i.Strides) != i.Colorspace.Strides {
+		return strides, fmt.Errorf("xvid: unexpected number of strides for image, expected %d, got %d", i.Colorspace.Strides, len(i.Strides))
+	}
+	if output && (width <= 0 || height <= 0 || i.Colorspace.value == ColorSpaceInternal.value) {
+		return strides, nil
+	}
+	for j := 0; j < i.Colorspace.Planes; j++ {
+		s, rows := i.Colorspace.planeSize(j, width, height)
+		if j >= i.Colorspace.Strides {
+			// will only happen on the 3rd plane of a format with 2 planes
+			// use the 2nd plane stride
+			strides[j] = strides[j-1]
+		} else if i.Strides == nil || i.Strides[j] == 0 {
+			strides[j] = s
+		} else if i.Strides[j] < s {
+			return strides, fmt.Errorf("xvid: insufficient stride in plane %d (strides is the total length of row, not just the offset), need at least %d, got %d", j, s, i.Strides[j])
+		} else {
+			strides[j] = i.Strides[j]
+		}
+		// the last row of an input image does not need to be padded up to the stride
+		l := strides[j]*(rows-1) + s
+		if output {
+			l = strides[j] * rows
+		}
+		var plane []byte
+		if i.Planes != nil {
+			plane = i.Planes[j]
+		}
+		if output && plane == nil {
+			continue
+		}
+		if len(plane) == 0 {
+			return strides, fmt.Errorf("xvid: plane %d is empty", j)
+		} else if len(plane) < l {
+			return strides, fmt.Errorf("xvid: not enough space in plane %d, need at least %d, got %d", j, l, len(plane))
+		}
+	}
+	return strides, nil
+}
+
+func (i *Image) nativeInput(width int, height int) (C.xvid_image_t, error) {
+	strides, err := i.checkPlanes(width, height, false)
+	if err != nil {
+		return C.xvid_image_t{}, err
+	}
+	if i.Strides == nil {
+		i.Strides = make([]int, i.Colorspace.Strides)
+	}
 	var cPlanes [4]unsafe.Pointer
 	var cStrides [4]C.int
-	for j, v := range i.Planes {
-		l := width * height * i.Colorspace.BitsPerPixelPlanes[j] / 8
-		if len(v) < l {
-			return nil, fmt.Errorf("xvid: not enough space in plane %d, need at least %d, got %d", j, l, len(v))
-		}
-		cPlanes[j] = unsafe.Pointer(&i.Planes[j][0])
+	for j := range i.Planes {
 		if j < i.Colorspace.Strides {
-			s := width * i.Colorspace.BitsPerPixelPlanes[j] / 8
-			if i.Strides[j] == 0 {
-				cStrides[j] = C.int(s)
-			} else if i.Strides[j] < s {
-				return nil, fmt.Errorf("xvid: insufficient stride in plane %d (strides is the total length of row, not just the offset), need at least %d, got %d", j, s, i.Strides[j])
-			} else {
-				cStrides[j] = C.int(i.Strides[j])
-			}
+			cStrides[j] = C.int(strides[j])
 		}
+		cPlanes[j] = unsafe.Pointer(&i.Planes[j][0])
 	}
-	return &C.xvid_image_t{
+	return C.xvid_image_t{
 		csp:    C.int(i.Colorspace.value),
 		plane:  cPlanes,
 		stride: cStrides,
 	}, nil
 }
 
-func (i *Image) nativeOutput(width int, height int) (*C.xvid_image_t, error) {
+// FitsFor reports whether the image can be used as is as an output image of the color space cs for the
+// dimensions width and height, without reallocation: its color space is cs, and it has the required number
+// of planes and strides, with large enough strides and planes (see Image). This can be used to reuse output
+// images across decoded frames, and to reallocate them only when the dimensions change (e.g. on a new VOL).
+// A ColorSpaceInternal image always fits if its color space is cs, as its buffers are replaced when decoding.
+func (i *Image) FitsFor(cs ColorSpace, width int, height int) bool {
+	if i.Colorspace.value != cs.value {
+		return false
+	}
+	if cs.value == ColorSpaceInternal.value {
+		return true
+	}
+	if len(i.Planes) != cs.Planes || len(i.Strides) != cs.Strides {
+		return false
+	}
+	for j, v := range i.Planes {
+		minStride, rows := cs.planeSize(j, width, height)
+		var s int
+		if j >= cs.Strides {
+			s = i.Strides[j-1]
+			if s == 0 {
+				s, _ = cs.planeSize(j-1, width, height)
+			}
+		} else if i.Strides[j] == 0 {
+			s = minStride
+		} else if i.Strides[j] < minStride {
+			return false
+		} else {
+			s = i.Strides[j]
+		}
+		if len(v) < s*rows {
+			return false
+		}
+	}
+	return true
+}
+
+// InferSize returns the dimensions of the image in pixels inferred from its first plane and stride, assuming
+// that its rows are not padded (the stride is the data size per line), and false if they cannot be inferred
+// (e.g. if the stride is 0). The inferred height is rounded up if the last row is not complete.
+func (i *Image) InferSize() (int, int, bool) {
+	if len(i.Planes) == 0 || len(i.Strides) == 0 || i.Strides[0] <= 0 {
+		return 0, 0, false
+	}
+	stride := i.Strides[0]
+	packed420 := i.Colorspace.value == ColorSpaceI420.value || i.Colorspace.value == ColorSpaceYV12.value
+	bytesPerPixel := 1
+	if i.Colorspace.Planes == 1 && !packed420 {
+		bytesPerPixel = i.Colorspace.BitsPerPixelPlanes[0] / 8
+	}
+	if bytesPerPixel == 0 {
+		return 0, 0, false
+	}
+	rows := (len(i.Planes[0]) + stride - 1) / stride
+	if packed420 {
+		// the Y rows are followed by the U and V planes
+		rows = rows * 2 / 3
+	}
+	return stride / bytesPerPixel, rows, true
+}
+
+func (i *Image) nativeOutput(width int, height int) (C.xvid_image_t, error) {
+	strides, err := i.checkPlanes(width, height, true)
+	if err != nil {
+		return C.xvid_image_t{}, err
+	}
 	if i.Planes == nil {
 		i.Planes = make([][]byte, i.Colorspace.Planes)
-	} else if len(i.Planes) != i.Colorspace.Planes {
-		return nil, fmt.Errorf("xvid: unexpected number of planes for image, expected %d, got %d", i.Colorspace.Planes, len(i.Planes))
 	}
 	if i.Strides == nil {
 		i.Strides = make([]int, i.Colorspace.Strides)
-	} else if len(i.Strides) != i.Colorspace.Strides {
-		return nil, fmt.Errorf("xvid: unexpected number of strides for image, expected %d, got %d", i.Colorspace.Strides, len(i.Strides))
 	}
 	var cPlanes [4]unsafe.Pointer
 	var cStrides [4]C.int
 	if width > 0 && height > 0 && i.Colorspace.value != ColorSpaceInternal.value {
-		for j, v := range i.Planes {
-			var s int
-			if j >= i.Colorspace.Strides {
-				// will only happen on the 3rd plane of a format with 2 planes
-				// use the 2nd plane stride
-				s = i.Strides[j-1]
-			} else {
-				s = width * i.Colorspace.BitsPerPixelPlanes[j] / 8
+		for j := range i.Planes {
+			if j < i.Colorspace.Strides {
+				cStrides[j] = C.int(strides[j])
 				if i.Strides[j] == 0 {
-					cStrides[j] = C.int(s)
-					i.Strides[j] = s // TODO this replaces the auto-0 with a non-0 value, is it ok?
-				} else if i.Strides[j] < s {
-					return nil, fmt.Errorf("xvid: insufficient stride in plane %d (strides is the total length of row, not just the offset), need at least %d, got %d", j, s, i.Strides[j])
-				} else {
-					cStrides[j] = C.int(i.Strides[j])
+					i.Strides[j] = strides[j] // TODO this replaces the auto-0 with a non-0 value, is it ok?
 				}
 			}
-			l := s * height
-			if v == nil {
-				i.Planes[j] = make([]byte, l)
-			} else if len(v) < l {
-				return nil, fmt.Errorf("xvid: not enough space in plane %d, need at least %d, got %d", j, l, len(v))
+			if i.Planes[j] == nil {
+				_, rows := i.Colorspace.planeSize(j, width, height)
+				i.Planes[j] = make([]byte, strides[j]*rows)
 			}
 			cPlanes[j] = unsafe.Pointer(&i.Planes[j][0])
 		}
@@ -636,13 +1022,252 @@ func (i *Image) nativeOutput(width int, height int) (*C.xvid_image_t, error) {
 	if i.VerticalFlip {
 		csp |= int(C.CSP_VFLIP)
 	}
-	return &C.xvid_image_t{
+	return C.xvid_image_t{
 		csp:    C.int(csp),
 		plane:  cPlanes,
 		stride: cStrides,
 	}, nil
 }
 
+// SeparateFields splits an interlaced image of dimensions width and height into its two fields: top contains the
+// even rows (0, 2, ...) and bottom the odd rows (1, 3, ...) of each plane, including the subsampled chroma planes,
+// each with half the rows of the frame. The fields are new compact images (with the strides set to the data size
+// per line) of the color space of the image, with dimensions width and height/2.
+//
+// The color space must have separate planes (e.g. ColorSpacePlanar, or a packed color space such as
+// ColorSpaceRGBA), not ColorSpaceI420 or ColorSpaceYV12. The height must be even, and a multiple of 4 for
+// the 4:2:0 ColorSpacePlanar, so that each field has whole chroma rows. The image must not be vertically flipped.
+func (i *Image) SeparateFields(width int, height int) (top Image, bottom Image, err error) {
+	if err := checkFields(i, width, height); err != nil {
+		return Image{}, Image{}, err
+	}
+	strides, err := i.checkPlanes(width, height, false)
+	if err != nil {
+		return Image{}, Image{}, err
+	}
+	top = newCompactImage(i.Colorspace, width, height, true)
+	bottom = newCompactImage(i.Colorspace, width, height, true)
+	for j, plane := range i.Planes {
+		w, rows := i.Colorspace.planeSize(j, width, height)
+		for y := 0; y < rows; y++ {
+			field := &top
+			if y%2 == 1 {
+				field = &bottom
+			}
+			copy(field.Planes[j][y/2*w:y/2*w+w], plane[y*strides[j]:y*strides[j]+w])
+		}
+	}
+	return top, bottom, nil
+}
+
+// MergeFields interleaves the rows of two fields, as returned by SeparateFields, into a new compact image of
+// dimensions width and height (the dimensions of the frame, so that the fields have dimensions width and
+// height/2): the rows of top are the even rows of the image, and the rows of bottom its odd rows. The fields
+// must have the same color space, with the constraints of SeparateFields.
+func MergeFields(top Image, bottom Image, width int, height int) (Image, error) {
+	if top.Colorspace.value != bottom.Colorspace.value {
+		return Image{}, errors.New("xvid: cannot merge fields of different color spaces")
+	}
+	var strides [2][4]int
+	for k, field := range []*Image{&top, &bottom} {
+		if err := checkFields(field, width, height); err != nil {
+			return Image{}, err
+		}
+		s, err := field.checkPlanes(width, height/2, false)
+		if err != nil {
+			return Image{}, err
+		}
+		strides[k] = s
+	}
+	frame := newCompactImage(top.Colorspace, width, height, false)
+	for j, plane := range frame.Planes {
+		w, rows := top.Colorspace.planeSize(j, width, height)
+		for y := 0; y < rows; y++ {
+			field, s := top.Planes[j], strides[0][j]
+			if y%2 == 1 {
+				field, s = bottom.Planes[j], strides[1][j]
+			}
+			copy(plane[y*w:y*w+w], field[y/2*s:y/2*s+w])
+		}
+	}
+	return frame, nil
+}
+
+// checkFields returns an error if an image of dimensions width and height cannot be split into fields
+func checkFields(i *Image, width int, height int) error {
+	switch {
+	case i.Colorspace.value == ColorSpaceI420.value || i.Colorspace.value == ColorSpaceYV12.value,
+		i.Colorspace.value == ColorSpaceInternal.value || i.Colorspace.value == ColorSpaceNoOutput.value:
+		return errors.New("xvid: unsupported color space for fields, use an image with separate planes, e.g. ColorSpacePlanar")
+	case i.VerticalFlip:
+		return errors.New("xvid: unsupported vertically flipped image for fields")
+	}
+	if err := i.Colorspace.checkDimensions(width, height); err != nil {
+		return err
+	}
+	for j := 0; j < i.Colorspace.Planes; j++ {
+		if _, rows := i.Colorspace.planeSize(j, width, height); rows%2 != 0 {
+			return fmt.Errorf("xvid: invalid height %d for fields, each plane must have an even number of rows (the height must be a multiple of 4 for 4:2:0 color spaces)", height)
+		}
+	}
+	return nil
+}
+
+// newCompactImage allocates an image of the color space cs and dimensions width and height, with the strides set
+// to the data size per line, or an image of one of its fields if field is set
+func newCompactImage(cs ColorSpace, width int, height int, field bool) Image {
+	img := Image{
+		Colorspace: cs,
+		Planes:     make([][]byte, cs.Planes),
+		Strides:    make([]int, cs.Strides),
+	}
+	for j := range img.Planes {
+		w, rows := cs.planeSize(j, width, height)
+		if field {
+			rows /= 2
+		}
+		img.Planes[j] = make([]byte, w*rows)
+		if j < cs.Strides {
+			img.Strides[j] = w
+		}
+	}
+	return img
+}
+
+// ImageFromPacked422 returns an Image wrapping packed YUV 4:2:2 data (e.g. from a capture card) of the given
+// dimensions, in a packed 4:2:2 color space: ColorSpaceYUY2, ColorSpaceUYVY or ColorSpaceYVYU.
+// The stride is the length in bytes of a row, and can be 0 for compact data (2 bytes per pixel).
+// The data is not copied.
+// An error is returned if the color space is not a packed 4:2:2 color space, or if the dimensions, stride,
+// or data length are invalid.
+func ImageFromPacked422(data []byte, stride int, width int, height int, cs ColorSpace) (Image, error) {
+	switch cs.value {
+	case ColorSpaceYUY2.value, ColorSpaceUYVY.value, ColorSpaceYVYU.value:
+	default:
+		return Image{}, errors.New("xvid: invalid color space for packed 4:2:2 image, must be ColorSpaceYUY2, ColorSpaceUYVY, or ColorSpaceYVYU")
+	}
+	if width <= 0 || height <= 0 {
+		return Image{}, fmt.Errorf("xvid: invalid image dimensions %dx%d", width, height)
+	}
+	if err := cs.checkDimensions(width, height); err != nil {
+		return Image{}, err
+	}
+	if stride == 0 {
+		stride = width * 2
+	} else if stride < width*2 {
+		return Image{}, fmt.Errorf("xvid: insufficient stride for packed 4:2:2 image, need at least %d, got %d", width*2, stride)
+	}
+	if l := stride*(height-1) + width*2; len(data) < l {
+		return Image{}, fmt.Errorf("xvid: not enough data for packed 4:2:2 image, need at least %d, got %d", l, len(data))
+	}
+	return Image{
+		Colorspace: cs,
+		Planes:     [][]byte{data},
+		Strides:    []int{stride},
+	}, nil
+}
+
+// planeRegion is the visible pixel data of a single image component, stored in one of the image planes.
+type planeRegion struct {
+	plane  int
+	offset int
+	// length of a row in bytes
+	width int
+	// number of rows
+	height int
+	stride int
+}
+
+// regions returns the visible pixel data regions of each image component; the image strides must have been resolved
+// (e.g. by nativeOutput).
+func (i *Image) regions(width int, height int) []planeRegion {
+	switch {
+	case i.Colorspace.Planes == 3:
+		return []planeRegion{
+			{plane: 0, width: width, height: height, stride: i.Strides[0]},
+			{plane: 1, width: (width + 1) / 2, height: (height + 1) / 2, stride: i.Strides[1]},
+			{plane: 2, width: (width + 1) / 2, height: (height + 1) / 2, stride: i.Strides[1]},
+		}
+	case i.Colorspace.value == ColorSpaceI420.value || i.Colorspace.value == ColorSpaceYV12.value:
+		s := i.Strides[0]
+		return []planeRegion{
+			{plane: 0, width: width, height: height, stride: s},
+			{plane: 0, offset: s * height, width: (width + 1) / 2, height: (height + 1) / 2, stride: s / 2},
+			{plane: 0, offset: s*height + s/2*((height+1)/2), width: (width + 1) / 2, height: (height + 1) / 2, stride: s / 2},
+		}
+	case i.Colorspace.Planes == 1:
+		return []planeRegion{
+			{plane: 0, width: width * i.Colorspace.BitsPerPixel / 8, height: height, stride: i.Strides[0]},
+		}
+	}
+	return nil
+}
+
+// imagePSNR returns the PSNR of each image component of a compared to b; both images must be of the same color space.
+func imagePSNR(a *Image, b *Image, width int, height int) []float64 {
+	ra := a.regions(width, height)
+	rb := b.regions(width, height)
+	psnr := make([]float64, len(ra))
+	for j := range ra {
+		psnr[j] = psnrFromSSE(regionSSE(a, ra[j], b, rb[j]), ra[j].width*ra[j].height)
+	}
+	return psnr
+}
+
+// regionSSE returns the sum of squared errors between region ra of a and region rb of b, of the same dimensions
+func regionSSE(a *Image, ra planeRegion, b *Image, rb planeRegion) int64 {
+	var sse int64
+	pa := a.Planes[ra.plane][ra.offset:]
+	pb := b.Planes[rb.plane][rb.offset:]
+	for y := 0; y < ra.height; y++ {
+		rowA := pa[y*ra.stride : y*ra.stride+ra.width]
+		rowB := pb[y*rb.stride : y*rb.stride+rb.width]
+		for x := range rowA {
+			d := int64(rowA[x]) - int64(rowB[x])
+			sse += d * d
+		}
+	}
+	return sse
+}
+
+// PlaneSSE returns the sum of squared errors of the Y, U and V planes between two 4:2:0 images of the given
+// dimensions (ColorSpacePlanar, ColorSpaceI420, or ColorSpaceYV12, possibly different), e.g. decoded images,
+// taking their strides into account. It can be used to compare the outputs of two decoders or decoder
+// configurations, or to compute the PSNR of a decoded image against a reference.
+// An error is returned if an image is not a 4:2:0 image or does not contain enough data.
+func PlaneSSE(a *Image, b *Image, width int, height int) (int64, int64, int64, error) {
+	var regions [2][]planeRegion
+	for k, img := range []*Image{a, b} {
+		switch img.Colorspace.value {
+		case ColorSpacePlanar.value, ColorSpaceI420.value, ColorSpaceYV12.value:
+		default:
+			return 0, 0, 0, errors.New("xvid: invalid color space for PlaneSSE, must be ColorSpacePlanar, ColorSpaceI420, or ColorSpaceYV12")
+		}
+		if err := img.Colorspace.checkDimensions(width, height); err != nil {
+			return 0, 0, 0, err
+		}
+		// validates the planes and strides
+		if _, err := img.nativeInput(width, height); err != nil {
+			return 0, 0, 0, err
+		}
+		regions[k], _ = img.yuvRegions(width, height)
+	}
+	var sse [3]int64
+	for j := range sse {
+		sse[j] = regionSSE(a, regions[0][j], b, regions[1][j])
+	}
+	return sse[0], sse[1], sse[2], nil
+}
+
+// psnrFromSSE returns the PSNR in dB of n 8-bit samples with a sum of squared errors of sse; +Inf if sse is 0.
+func psnrFromSSE(sse int64, n int) float64 {
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	mse := float64(sse) / float64(n)
+	return 10 * math.Log10(255*255/mse)
+}
+
 // GlobalInfo stores global information about Xvid, obtained from GetGlobalInfo.
 type GlobalInfo struct {
 	// runtime version of xvidcore
@@ -701,1326 +1326,6233 @@ func InitWithFlags(cpuFlags CPUFlag, debugFlags DebugFlag) error {
 	if code := C.xvid_global(nil, C.XVID_GBL_INIT, unsafe.Pointer(&cGlobalInit), nil); code != 0 {
 		return xvidErr(code)
 	}
+	globalDebugFlags = debugFlags
 	return nil
 }
 
-// Converts converts an Image from a color space (has to be ColorSpacePlanar or ColorSpaceYV12) to any other but ColorSpaceInternal.
-// Init (or InitWithFlags) must be called once before calling this function.
-// An error can be returned because of invalid input or output images, or due to an internal Xvid error.
-func Convert(input Image, output *Image, width int, height int, interlacing bool) error {
-	if input.Colorspace.value == ColorSpacePlanar.value {
-		input.Colorspace = ColorSpaceInternal
-	} else if input.Colorspace.value != ColorSpaceYV12.value {
-		return fmt.Errorf("xvid: invalid color space for conversion input, must be ColorSpacePlanar, ColorSpaceI420, or ColorSpaceYV12")
+// globalDebugFlags are the debug flags passed to InitWithFlags; with DebugError, a warning is printed to standard
+// error when an Encoder or Decoder that was not closed is garbage collected, or when a conflicting frame type
+// forced on the first frame of a stream is overridden
+var globalDebugFlags DebugFlag
+
+// warnNotClosed prints a warning for a garbage collected Encoder or Decoder that was not closed, if enabled
+func warnNotClosed(name string) {
+	if globalDebugFlags&DebugError != 0 {
+		fmt.Fprintf(os.Stderr, "xvid: %s garbage collected without being closed, call %s.Close after use\n", name, name)
+	}
+}
+
+// warnFirstFrameType prints a warning for a conflicting frame type forced on the first frame of a stream, which is
+// encoded as an I frame instead, if enabled
+func warnFirstFrameType(frameType FrameType) {
+	if globalDebugFlags&DebugError == 0 {
+		return
 	}
-	if output.Colorspace.value == ColorSpaceInternal.value {
-		return fmt.Errorf("xvid: invalid color space for conversion output, must not be ColorSpaceInternal")
+	name := fmt.Sprintf("type %d", int(frameType))
+	switch frameType {
+	case FrameTypeP:
+		name = "P"
+	case FrameTypeB:
+		name = "B"
+	case FrameTypeS:
+		name = "S"
 	}
-	cInput, err := input.nativeInput(width, height)
+	fmt.Fprintf(os.Stderr, "xvid: %s frame forced on the first frame of the stream, encoding it as an I frame\n", name)
+}
+
+// threadLimit bounds the total number of threads of the live encoders and decoders, see SetMaxConcurrentThreads
+var threadLimit struct {
+	sync.Mutex
+	max  int
+	used int
+}
+
+// threadLimitCond is signaled when threads are released or the limit changes, to wake up blocked acquireThreads calls
+var threadLimitCond = sync.NewCond(&threadLimit.Mutex)
+
+// SetMaxConcurrentThreads limits the total number of threads used by all the Encoders and Decoders of the
+// process, e.g. to avoid oversubscribing the CPUs when running many encoding jobs concurrently; n <= 0 means no
+// limit, which is the default.
+//
+// The threads are acquired from a semaphore shared by all the instances when an Encoder or Decoder is created (or
+// an Encoder is reset), and released when it is closed. EncoderInit.NumThreads and DecoderInit.NumThreads are
+// the number of threads requested by an instance, capped to n. If fewer threads are available, the creation blocks
+// until enough threads are released by other instances, so a goroutine must not create an instance while holding
+// other instances whose threads are needed for it, or it deadlocks. Single-threaded instances (NumThreads 0) never
+// block. Changing the limit does not change the threads of the live instances, but wakes up the blocked creations.
+func SetMaxConcurrentThreads(n int) {
+	threadLimit.Lock()
+	defer threadLimit.Unlock()
+	threadLimit.max = n
+	threadLimitCond.Broadcast()
+}
+
+// acquireThreads returns the number of threads granted to an encoder or decoder requesting n threads, at most n,
+// blocking until they are available
+func acquireThreads(n int) int {
+	if n <= 0 {
+		return n
+	}
+	threadLimit.Lock()
+	defer threadLimit.Unlock()
+	for threadLimit.max > 0 {
+		if n > threadLimit.max {
+			n = threadLimit.max
+		}
+		if threadLimit.used+n <= threadLimit.max {
+			break
+		}
+		threadLimitCond.Wait()
+	}
+	threadLimit.used += n
+	return n
+}
+
+// releaseThreads returns the threads granted by acquireThreads
+func releaseThreads(n int) {
+	if n <= 0 {
+		return
+	}
+	threadLimit.Lock()
+	defer threadLimit.Unlock()
+	threadLimit.used -= n
+	threadLimitCond.Broadcast()
+}
+
+// SelfTest checks that the runtime xvidcore works as expected, by encoding a small synthetic frame and decoding
+// it back. It can optionally be called after Init (or InitWithFlags) to fail early on a broken or incompatible
+// xvidcore build. It typically runs in a few milliseconds.
+// An error is returned if the encoding or the decoding fails, or if the decoded stream is not as expected.
+func SelfTest() error {
+	const width = 32
+	const height = 32
+	init := NewEncoderInit(width, height, Fraction{25, 1}, nil)
+	init.MaxBFrames = 0
+	init.NumThreads = 0
+	encoder, err := NewEncoder(init)
 	if err != nil {
-		return err
+		return fmt.Errorf("xvid: self-test: creating encoder: %v", err)
 	}
-	cOutput, err := output.nativeOutput(width, height)
+	defer encoder.Close()
+	planes := [][]byte{make([]byte, width*height), make([]byte, width*height/4), make([]byte, width*height/4)}
+	for i := range planes[0] {
+		planes[0][i] = byte(i % width * 8)
+	}
+	for _, plane := range planes[1:] {
+		for i := range plane {
+			plane[i] = 128
+		}
+	}
+	var output []byte
+	n, _, err := encoder.Encode(EncoderFrame{
+		Input: &Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     planes,
+		},
+		Output: &output,
+		Type:   FrameTypeI,
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("xvid: self-test: encoding frame: %v", err)
 	}
-	cConvertInfo := C.xvid_gbl_convert_t{
-		version:     C.XVID_VERSION,
-		input:       *cInput,
-		output:      *cOutput,
-		width:       C.int(width),
-		height:      C.int(height),
-		interlacing: cbool(interlacing),
+	if n <= 0 {
+		return errors.New("xvid: self-test: encoded stream is empty")
 	}
-	if code := C.xvid_global(nil, C.XVID_GBL_CONVERT, unsafe.Pointer(&cConvertInfo), nil); code != 0 {
-		return xvidErr(code)
+
+	decoder, err := NewDecoder(DecoderInit{Input: bytes.NewReader(output[:n])})
+	if err != nil {
+		return fmt.Errorf("xvid: self-test: creating decoder: %v", err)
+	}
+	defer decoder.Close()
+	img := Image{Colorspace: ColorSpacePlanar}
+	frames := 0
+	for {
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &img})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("xvid: self-test: decoding frame: %v", err)
+		}
+		if stats.StatsVOL != nil && (stats.StatsVOL.Width != width || stats.StatsVOL.Height != height) {
+			return fmt.Errorf("xvid: self-test: decoded dimensions %dx%d, expected %dx%d", stats.StatsVOL.Width, stats.StatsVOL.Height, width, height)
+		}
+		if stats.StatsFrame != nil {
+			frames++
+		}
+	}
+	if frames != 1 {
+		return fmt.Errorf("xvid: self-test: decoded %d frames, expected 1", frames)
 	}
-	output.fixAlpha(width, height)
 	return nil
 }
 
-// Decoder is an initialized Xvid decoder.
-// To create a Decoder, use NewDecoder.
-// A Decoder must be closed after use, by calling its Close method.
-// To decode a frame, use the Decode method.
-type Decoder struct {
-	// current frame width in pixels
-	Width int
-	// current frame height in pixels
-	Height int
-	handle unsafe.Pointer
-	r      io.Reader
-	buf    []byte
-	i      int
-	n      int
-	eof    bool
-	err    error // permanent error
+// Capabilities is the set of optional features supported by the runtime xvidcore build, returned by GetCapabilities.
+type Capabilities struct {
+	// runtime version of xvidcore
+	Version Version
+	// whether the SSIM plugin (PluginSSIM) is available (xvidcore 1.3+)
+	SSIM bool
+	// whether the PSNR-HVS-M plugin (PluginPSNRHVSM) is available (xvidcore 1.3+)
+	PSNRHVSM bool
+	// whether GMC (global motion compensation, VOLGMC) encoding is supported
+	GMC bool
+	// whether quarter pixel motion estimation (VOLQuarterPixel) encoding is supported
+	QuarterPixel bool
+	// whether interlaced (VOLInterlacing) encoding is supported
+	Interlacing bool
 }
 
-// DecoderInit is information used to create a Decoder in NewDecoder.
-// Its Input field must be set to the Reader from which to read an encoded raw Xvid stream data from.
-type DecoderInit struct {
-	// Reader from which to read encoded frame data.
-	// the Reader will not be closed automatically, it has to be caller-closed after the Decoder is finished.
-	Input io.Reader
-	// optional initial frame width in pixels (can be automatically detected by the Decoder)
-	Width int
-	// optional initial frame height in pixels (can be automatically detected by the Decoder)
-	Height int
-	// optional FourCC code of the raw Xvid stream
-	FourCC int
-	// optional number of threads to use for decoding, 0 meaning single-threaded
-	NumThreads int
-}
+// capabilitiesMutex guards capabilities, which is only set once probed successfully, so that a failed probe (e.g.
+// before Init) is retried on the next call
+var capabilitiesMutex sync.Mutex
+var capabilitiesDone bool
+var capabilities Capabilities
 
-// DecoderFrame is information used when decoding a frame in Decoder.Decode.
-type DecoderFrame struct {
-	// output image to store the decoded data to
-	Output *Image
-	// optional decoder flags to use for decoding the frame
-	DecodeFlags DecoderFlag
-	// optional brightness offset, 0 meaning no offset
-	Brightness int
+// GetCapabilities returns the optional features supported by the runtime xvidcore build.
+// The features are probed on the first successful call (by encoding a few small synthetic frames), and cached; a
+// feature is unsupported if the probe frame was encoded without it, and an error is returned if a probe fails, in
+// which case the features are probed again on the next call.
+// Init (or InitWithFlags) must be called once before calling this function.
+//
+// Requesting an unsupported feature, by creating an Encoder with PluginSSIM or PluginPSNRHVSM, or by encoding
+// a frame with VOLGMC, VOLQuarterPixel or VOLInterlacing, returns an error naming the missing feature.
+func GetCapabilities() (Capabilities, error) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	if capabilitiesDone {
+		return capabilities, nil
+	}
+	info, err := GetGlobalInfo()
+	if err != nil {
+		return Capabilities{}, err
+	}
+	v13 := info.Version.Major() > 1 || info.Version.Major() == 1 && info.Version.Minor() >= 3
+	c := Capabilities{
+		Version:  info.Version,
+		SSIM:     v13,
+		PSNRHVSM: v13,
+	}
+	for _, probe := range []struct {
+		flag      VOLFlag
+		supported *bool
+	}{
+		{VOLGMC, &c.GMC},
+		{VOLQuarterPixel, &c.QuarterPixel},
+		{VOLInterlacing, &c.Interlacing},
+	} {
+		if *probe.supported, err = probeVOLFlag(probe.flag); err != nil {
+			return Capabilities{}, err
+		}
+	}
+	capabilities = c
+	capabilitiesDone = true
+	return c, nil
 }
 
-// DecoderStats is information about a decoded frame, returned by Decoder.Decode.
-// If the frame is a metadata pseudo-frame (VOL), StatsVOL is not nil, otherwise
-// StatsFrame is not nil.
-type DecoderStats struct {
-	// type of the decoded frame
-	FrameType FrameType
-	// non-nil if the frame type is FrameTypeVOL
-	StatsVOL *DecoderStatsVOL
-	// non-nil if the frame type is not FrameTypeVOL
-	StatsFrame *DecoderStatsFrame
+// probeVOLFlag returns whether encoding a small synthetic frame with a VOL flag uses the flag
+func probeVOLFlag(flag VOLFlag) (bool, error) {
+	const width = 32
+	const height = 32
+	init := NewEncoderInit(width, height, Fraction{25, 1}, nil)
+	init.MaxBFrames = 0
+	init.NumThreads = 0
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		return false, fmt.Errorf("xvid: probing capabilities: creating encoder: %v", err)
+	}
+	defer encoder.Close()
+	var output []byte
+	_, stats, err := encoder.Encode(EncoderFrame{
+		Input: &Image{
+			Colorspace: ColorSpaceI420,
+			Planes:     [][]byte{make([]byte, width*height*3/2)},
+		},
+		Output: &output,
+		Type:   FrameTypeI,
+		// raw flags are not checked against the capabilities
+		RawVOLFlags: uint(flag),
+	})
+	if err != nil {
+		return false, fmt.Errorf("xvid: probing capabilities: encoding frame with VOL flag %#x: %v", uint(flag), err)
+	}
+	// xvidcore clears the unsupported VOL flags of the frames it encodes
+	return stats != nil && stats.VOLFlags&flag != 0, nil
 }
 
-var decoderStatsNothing = DecoderStats{FrameType: frameTypeNothing}
+// requireFeature returns an error if a feature is not supported by the runtime xvidcore build
+func requireFeature(feature string, supported func(c *Capabilities) bool) error {
+	c, err := GetCapabilities()
+	if err != nil {
+		return err
+	}
+	if !supported(&c) {
+		return fmt.Errorf("xvid: %s is not supported by the runtime xvidcore build (version %v)", feature, c.Version)
+	}
+	return nil
+}
 
-// DecoderStatsVOL is information specific to a metadata pseudo-frame, returned by Decoder.Decode in DecoderStats.
-type DecoderStatsVOL struct {
-	// whether the frame is interlaced
-	Interlacing bool
-	// frame width in pixels
-	Width int
-	// frame height in pixels
-	Height int
-	// frame pixel aspect ratio
-	PixelAspectRatio PixelAspectRatio
+// requireVOLFlags returns an error if optional VOL flags are not supported by the runtime xvidcore build
+func requireVOLFlags(flags VOLFlag) error {
+	if flags&VOLGMC != 0 {
+		if err := requireFeature("GMC (VOLGMC)", func(c *Capabilities) bool { return c.GMC }); err != nil {
+			return err
+		}
+	}
+	if flags&VOLQuarterPixel != 0 {
+		if err := requireFeature("quarter pixel (VOLQuarterPixel)", func(c *Capabilities) bool { return c.QuarterPixel }); err != nil {
+			return err
+		}
+	}
+	if flags&VOLInterlacing != 0 {
+		if err := requireFeature("interlacing (VOLInterlacing)", func(c *Capabilities) bool { return c.Interlacing }); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// DecoderStatsFrame is information specific to an actual non-metadata non-empty frame, returned by Decoder.Decode in DecoderStats.
-type DecoderStatsFrame struct {
-	// valid only for interlaced frames (see DecoderStatsVOL.Interlacing), whether the interlacing is upper field first
-	UpperFieldFirst bool
-	// macroblock quantizers table (one quantizer per macroblock), can be nil
-	Quantizers []int32
-	// quantizers table stride (equal to the count of macroblocks in a line)
-	QuantizersStride int
+// Converts converts an Image from a color space (has to be ColorSpacePlanar, ColorSpaceYV12, ColorSpaceNV12 or
+// ColorSpaceNV21) to any other but ColorSpaceInternal. The semi-planar ColorSpaceNV12 and ColorSpaceNV21 images are
+// deinterleaved to (or interleaved from) a temporary ColorSpacePlanar image in Go.
+// The conversion uses the fixed BT.601 color matrix and centered chroma siting of Xvid, see ConvertWithMatrix
+// for other color matrices.
+// Init (or InitWithFlags) must be called once before calling this function.
+// An error can be returned because of invalid input or output images, or due to an internal Xvid error.
+func Convert(input Image, output *Image, width int, height int, interlacing bool) error {
+	return ConvertMulti(input, []*Image{output}, width, height, interlacing)
+}
 
-	// TimeBase and TimeImplement are currently unimplemented in libxvidcore
-	// TimeIncrement is useless without access to vop_time_increment_resolution
-	// TimeBase int
-	// TimeIncrement int
+// ConvertMulti converts an Image like Convert, to several output images at once, e.g. to produce several color
+// space variants of the same frame. The outputs can have different color spaces, but all have the dimensions
+// of the input. The input is validated once, then each output is converted directly from the input, in order.
+// If an output cannot be converted, the error is returned and the following outputs are not converted.
+func ConvertMulti(input Image, outputs []*Image, width int, height int, interlacing bool) error {
+	return convertMulti(input, outputs, width, height, interlacing, &C.xvid_gbl_convert_t{})
 }
 
-// NewDecoder creates a new Decoder based on a DecoderInit configuration. Init (or InitWithFlags) must be called once before calling this function.
-// Once created and finished using, a Decoder must be freed by calling Decoder.Close().
-// The Decoder is non-nil if and only if the returned error is nil.
-// An internal error can be returned by Xvid, in which case the Decoder won't be created.
-func NewDecoder(init DecoderInit) (*Decoder, error) {
-	cDecoreCreate := C.xvid_dec_create_t{
-		version:     C.XVID_VERSION,
-		width:       C.int(init.Width),
-		height:      C.int(init.Height),
-		fourcc:      C.int(init.FourCC),
-		num_threads: C.int(init.NumThreads),
+// convertMulti implements ConvertMulti, passing the conversion parameters to Xvid in cConvertInfo
+func convertMulti(input Image, outputs []*Image, width int, height int, interlacing bool, cConvertInfo *C.xvid_gbl_convert_t) error {
+	if input.Colorspace.semiPlanar() {
+		if err := input.Colorspace.checkDimensions(width, height); err != nil {
+			return err
+		}
+		strides, err := input.semiPlanarStrides(width, height, false)
+		if err != nil {
+			return err
+		}
+		input = splitChroma(&input, strides, width, height)
 	}
-	if code := C.xvid_decore(nil, C.XVID_DEC_CREATE, unsafe.Pointer(&cDecoreCreate), nil); code != 0 {
-		return nil, xvidErr(code)
+	if input.Colorspace.value == ColorSpacePlanar.value {
+		input.Colorspace = ColorSpaceInternal
+	} else if input.Colorspace.value != ColorSpaceYV12.value {
+		return fmt.Errorf("xvid: invalid color space for conversion input, must be ColorSpacePlanar, ColorSpaceYV12, ColorSpaceNV12, or ColorSpaceNV21")
 	}
-	var buf []byte
-	if init.Input != nil {
-		buf = make([]byte, 4*1024*1024) // highly unlikely that any frame will be larger than 2MB
+	if err := input.Colorspace.checkDimensions(width, height); err != nil {
+		return err
 	}
-	return &Decoder{
-		handle: cDecoreCreate.handle,
-		Width:  init.Width,
-		Height: init.Height,
-		r:      init.Input,
-		buf:    buf,
-		i:      -1,
-	}, nil
+	cInput, err := input.nativeInput(width, height)
+	if err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		if output.Colorspace.value == ColorSpaceInternal.value {
+			return fmt.Errorf("xvid: invalid color space for conversion output, must not be ColorSpaceInternal")
+		}
+		if err := output.Colorspace.checkDimensions(width, height); err != nil {
+			return err
+		}
+		if output.Colorspace.value == colorSpaceGray {
+			if err := copyLuma(&input, output, width, height); err != nil {
+				return err
+			}
+			continue
+		}
+		if output.Colorspace.semiPlanar() {
+			if _, err := output.semiPlanarStrides(width, height, true); err != nil {
+				return err
+			}
+			planar := Image{
+				Colorspace:   ColorSpacePlanar,
+				VerticalFlip: output.VerticalFlip,
+			}
+			if err := convertNative(&cInput, &planar, width, height, interlacing, cConvertInfo); err != nil {
+				return err
+			}
+			mergeChroma(&planar, output, width, height)
+			continue
+		}
+		if err := convertNative(&cInput, output, width, height, interlacing, cConvertInfo); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Decode decodes a single non-empty frame (either metadata (VOL) or an actual frame) from the encoded Xvid stream.
-//
-// Decode returns an int, which is the length in bytes of the frame that was read. Decode might buffer up data from
-// its Reader so the returned value might be less than the actual data read.
-//
-// Decode returns a DecoderStats, which stores information about the decoded frame,
-// which can be either a VOL (metadata), or an actual frame. If Decoder returns a non-nil error,
-// DecoderStats in invalid.
-//
-// Decode returns an error, which if it is not nil can be either io.EOF or another error.
-// If it is io.EOF, this is an expected value which means that the entire stream has been decoded.
-// Otherwise, it is an unexpected value, which can be due to invalid images, reader i/o errors, or internal
-// Xvid errors.
-//
-// In any case, the Decoder should not be used after any error and Decode will always return
-// the same error after an error occurs. The Decoder must still be closed with Close.
-func (d *Decoder) Decode(frame DecoderFrame) (int, DecoderStats, error) {
-	if d.r == nil {
-		return 0, decoderStatsNothing, errors.New("xvid: Input Reader is nil, must be passed in Init")
+// Converter converts images of fixed dimensions to a fixed color space like Convert, reusing its output planes
+// across conversions, to avoid allocating new planes for each converted image (e.g. when converting every decoded
+// frame to RGBA). It must be created with NewConverter, and must not be used concurrently.
+type Converter struct {
+	width       int
+	height      int
+	interlacing bool
+	output      Image
+	// outputs of convertMulti, the output of the Converter
+	outputs [1]*Image
+	// conversion parameters passed to Xvid, kept to avoid allocating them on each conversion
+	cConvertInfo C.xvid_gbl_convert_t
+}
+
+// NewConverter returns a Converter of images of dimensions width and height to the color space dstColorspace
+// (any color space but ColorSpaceInternal, see Convert), for interlaced images if interlacing is set (see Convert).
+// The output planes are allocated on the first conversion.
+func NewConverter(dstColorspace ColorSpace, width int, height int, interlacing bool) *Converter {
+	c := &Converter{
+		width:       width,
+		height:      height,
+		interlacing: interlacing,
+		output:      Image{Colorspace: dstColorspace},
 	}
+	c.outputs[0] = &c.output
+	return c
+}
 
-	if d.err != nil {
-		return 0, decoderStatsNothing, d.err
+// Convert converts the input image like Convert, and returns the converted image, whose planes are owned by the
+// Converter: they are only valid until the next Convert call, and must be copied to be retained.
+// After the first conversion, Convert does not allocate if the input Strides are set, except for the semi-planar
+// ColorSpaceNV12 and ColorSpaceNV21 inputs and outputs, which are converted through a temporary image.
+func (c *Converter) Convert(input Image) (Image, error) {
+	if err := convertMulti(input, c.outputs[:], c.width, c.height, c.interlacing, &c.cConvertInfo); err != nil {
+		return Image{}, err
 	}
+	return c.output, nil
+}
 
-	if d.i == -1 { // initial read burst
-		d.i = 0
-		r, err := io.ReadFull(d.r, d.buf[d.n:])
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				d.eof = true
-			} else {
-				d.err = io.EOF
-				return 0, decoderStatsNothing, d.err
-			}
+// copyLuma copies the luma plane of a 4:2:0 image (whose luma is its first plane) to a ColorSpaceGray image,
+// allocating its plane if needed as in nativeOutput
+func copyLuma(input *Image, output *Image, width int, height int) error {
+	if _, err := output.nativeOutput(width, height); err != nil {
+		return err
+	}
+	stride := input.Strides[0]
+	if stride == 0 {
+		stride = width
+	}
+	for y := 0; y < height; y++ {
+		dy := y
+		if output.VerticalFlip {
+			dy = height - 1 - y
 		}
-		d.n += r
+		copy(output.Planes[0][dy*output.Strides[0]:dy*output.Strides[0]+width], input.Planes[0][y*stride:y*stride+width])
 	}
+	return nil
+}
 
-	total := 0
-	for { // read at least one non-nothing frame
-		if d.eof && d.n-d.i <= 1 { // no bytes remaining: flush decoder
-			r, stats, err := d.decodeBuffer(frame, nil)
-			d.i += r
-			total += r
-			if err != nil {
-				if e, ok := err.(*Error); ok && e.code == C.XVID_ERR_END {
-					d.err = io.EOF
-				} else {
-					d.err = err
-				}
-				return 0, decoderStatsNothing, d.err
-			}
-			if stats.FrameType == frameTypeNothing {
-				continue
-			}
-			return total, stats, nil
-		}
+// convertNative converts a native input image to an output image with Xvid, passing the conversion parameters in
+// cConvertInfo, which is overwritten
+func convertNative(cInput *C.xvid_image_t, output *Image, width int, height int, interlacing bool, cConvertInfo *C.xvid_gbl_convert_t) error {
+	cOutput, err := output.nativeOutput(width, height)
+	if err != nil {
+		return err
+	}
+	*cConvertInfo = C.xvid_gbl_convert_t{
+		version:     C.XVID_VERSION,
+		input:       *cInput,
+		output:      cOutput,
+		width:       C.int(width),
+		height:      C.int(height),
+		interlacing: cbool(interlacing),
+	}
+	if code := C.xvid_global(nil, C.XVID_GBL_CONVERT, unsafe.Pointer(cConvertInfo), nil); code != 0 {
+		return xvidErr(code)
+	}
+	output.fixAlpha(width, height)
+	return nil
+}
 
-		if !d.eof && d.i > len(d.buf)/2 {
-			copy(d.buf[:d.n-d.i], d.buf[d.i:d.n])
-			d.n = d.n - d.i
-			d.i = 0
-			r, err := io.ReadFull(d.r, d.buf[d.n:])
-			if err != nil {
-				if err == io.EOF || err == io.ErrUnexpectedEOF {
-					d.eof = true
-				} else {
-					d.err = err
-					return 0, decoderStatsNothing, d.err
-				}
+// ConvertRegion converts the region srcRect of an Image like Convert, e.g. to extract a region of interest of a
+// decoded frame. The input color space must be a 4:2:0 color space (ColorSpacePlanar, ColorSpaceI420,
+// ColorSpaceYV12, ColorSpaceNV12 or ColorSpaceNV21), with its strides set (not 0); the input dimensions of the
+// packed ColorSpaceI420 and ColorSpaceYV12 images are inferred with Image.InferSize, so their rows must not be
+// padded. The region must be inside the input image, at even coordinates with even dimensions, because of the
+// chroma subsampling. The output has the dimensions of the region, with compact strides by default (see Image).
+//
+// The input data is not copied: the planes of the input are sliced at the offset of the region in each plane.
+// Init (or InitWithFlags) must be called once before calling this function.
+func ConvertRegion(input Image, output *Image, srcRect image.Rectangle, interlacing bool) error {
+	if srcRect.Empty() || srcRect.Min.X < 0 || srcRect.Min.Y < 0 {
+		return fmt.Errorf("xvid: invalid conversion region %v", srcRect)
+	}
+	if srcRect.Min.X%2 != 0 || srcRect.Min.Y%2 != 0 {
+		return fmt.Errorf("xvid: invalid conversion region %v, must start at even coordinates for 4:2:0 chroma", srcRect)
+	}
+	x, y := srcRect.Min.X, srcRect.Min.Y
+	switch input.Colorspace.value {
+	case ColorSpaceI420.value, ColorSpaceYV12.value:
+		// view the packed planes as separate planes
+		width, height, ok := input.InferSize()
+		if !ok {
+			return errors.New("xvid: cannot infer the dimensions of the conversion input, its stride must be set")
+		}
+		if srcRect.Max.X > width || srcRect.Max.Y > height {
+			return fmt.Errorf("xvid: conversion region %v out of the input bounds %dx%d", srcRect, width, height)
+		}
+		yuv, _ := input.yuvRegions(width, height)
+		planar := Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     make([][]byte, len(yuv)),
+			Strides:    []int{yuv[0].stride, yuv[1].stride},
+		}
+		for j, r := range yuv {
+			if r.offset > len(input.Planes[0]) {
+				return fmt.Errorf("xvid: not enough space in plane 0 for the chroma of a %dx%d image", width, height)
 			}
-			d.n += r
+			planar.Planes[j] = input.Planes[0][r.offset:]
 		}
-		r, stats, err := d.decodeBuffer(frame, d.buf[d.i:d.n])
-		if err != nil {
-			d.err = err
-			return 0, decoderStatsNothing, d.err
+		input = planar
+	case ColorSpacePlanar.value, colorSpaceNV12, colorSpaceNV21:
+	default:
+		return errors.New("xvid: invalid color space for region conversion input, must be ColorSpacePlanar, ColorSpaceI420, ColorSpaceYV12, ColorSpaceNV12, or ColorSpaceNV21")
+	}
+	if len(input.Planes) != input.Colorspace.Planes {
+		return fmt.Errorf("xvid: unexpected number of planes for image, expected %d, got %d", input.Colorspace.Planes, len(input.Planes))
+	}
+	if len(input.Strides) != input.Colorspace.Strides {
+		return fmt.Errorf("xvid: unexpected number of strides for image, expected %d, got %d", input.Colorspace.Strides, len(input.Strides))
+	}
+	region := Image{
+		Colorspace: input.Colorspace,
+		Planes:     make([][]byte, len(input.Planes)),
+		Strides:    input.Strides,
+	}
+	for j, plane := range input.Planes {
+		stride := input.Strides[0]
+		if j > 0 {
+			// the 3rd plane of ColorSpacePlanar uses the 2nd plane stride
+			stride = input.Strides[1]
 		}
-		if d.i+r > d.n { // read past buffer limit... abort decoding
-			d.err = errors.New("xvid: read past buffer limit, should not happen")
-			return 0, decoderStatsNothing, d.err
+		if stride <= 0 {
+			return fmt.Errorf("xvid: invalid stride %d in plane %d, the strides of the conversion input must be set", stride, j)
 		}
-		d.i += r
-		total += r
-		if stats.FrameType != frameTypeNothing {
-			return total, stats, nil
+		var offset int
+		switch {
+		case j == 0:
+			if srcRect.Max.X > stride {
+				return fmt.Errorf("xvid: conversion region %v out of the input bounds, larger than the stride %d", srcRect, stride)
+			}
+			offset = y*stride + x
+		case input.Colorspace.semiPlanar():
+			// interleaved chroma: one U and one V byte for each 2 pixels
+			offset = y/2*stride + x
+		default:
+			offset = y/2*stride + x/2
 		}
+		if offset >= len(plane) {
+			return fmt.Errorf("xvid: conversion region %v out of the input bounds, past the end of plane %d", srcRect, j)
+		}
+		region.Planes[j] = plane[offset:]
 	}
+	return Convert(region, output, srcRect.Dx(), srcRect.Dy(), interlacing)
 }
 
-// TODO make this public if someone needs this (with better documentation)
-// decodes one (possibly empty) frame from the input buffer
-// this low-level method should not be used directly, use Decode instead to automatically handle data buffering
-// if you need to use this method check the Decode method source code to see how to use it
-// no error and int=0 means the decoder needs more data
-// at the end of the stream call with input=nil to flush decoder
-// due to implementation quirks the buffer length will be reduced to the nearest length multiple of 8 below the buffer length
-// due to implementation quirks the decoder might read more data past the buffer end if the buffer is small and only contains part of a frame
-func (d *Decoder) decodeBuffer(frame DecoderFrame, input []byte) (int, DecoderStats, error) {
-	l := -1
-	var bitstream unsafe.Pointer = nil
-	if input != nil {
-		l = len(input)
-		l = l - l%8
-		if l == 0 {
-			return 0, DecoderStats{FrameType: frameTypeNothing}, nil
+// ChromaSiting is the position of the chroma samples of a 4:2:0 image relative to the luma samples.
+type ChromaSiting int
+
+const (
+	// chroma samples are centered between 2x2 luma samples, as in MPEG-1 and MPEG-4 Part 2 (and Xvid)
+	ChromaSitingCenter ChromaSiting = iota
+	// chroma samples are horizontally co-sited with the left luma sample and vertically centered between
+	// 2 luma samples, as in MPEG-2 and H.264
+	ChromaSitingLeft
+)
+
+// ColorMatrix is a YUV (Y'CbCr) color matrix, with the chroma siting used for subsampling the chroma,
+// used for converting images with ConvertWithMatrix.
+// The YUV values are in the limited ("TV") range: 16-235 for Y, 16-240 for U and V.
+type ColorMatrix struct {
+	// red coefficient of the luma
+	Kr float64
+	// blue coefficient of the luma
+	Kb float64
+	// chroma siting used for subsampling and upsampling the chroma
+	Siting ChromaSiting
+}
+
+var (
+	// ITU-R BT.601 color matrix, for standard definition content; the matrix used by Xvid
+	ColorMatrixBT601 = ColorMatrix{Kr: 0.299, Kb: 0.114, Siting: ChromaSitingCenter}
+	// ITU-R BT.709 color matrix, for high definition content
+	ColorMatrixBT709 = ColorMatrix{Kr: 0.2126, Kb: 0.0722, Siting: ChromaSitingCenter}
+)
+
+// rgbLayout returns the byte offsets of the red, green, blue and alpha (-1 if none) components and the size
+// of a pixel in bytes of an 8-bit RGB packed color space, and false if the color space is not supported
+func rgbLayout(c ColorSpace) (r int, g int, b int, a int, size int, ok bool) {
+	switch c.value {
+	case ColorSpaceRGB.value:
+		return 0, 1, 2, -1, 3, true
+	case ColorSpaceBGR.value:
+		return 2, 1, 0, -1, 3, true
+	case ColorSpaceRGBA.value:
+		return 0, 1, 2, 3, 4, true
+	case ColorSpaceBGRA.value:
+		return 2, 1, 0, 3, 4, true
+	case ColorSpaceARGB.value:
+		return 1, 2, 3, 0, 4, true
+	case ColorSpaceABGR.value:
+		return 3, 2, 1, 0, 4, true
+	}
+	return 0, 0, 0, 0, 0, false
+}
+
+// yuvRegions returns the Y, U and V regions of a 4:2:0 image, and false if the color space is not a 4:2:0 color space
+func (i *Image) yuvRegions(width int, height int) ([]planeRegion, bool) {
+	switch i.Colorspace.value {
+	case ColorSpacePlanar.value, ColorSpaceI420.value, ColorSpaceYV12.value:
+	default:
+		return nil, false
+	}
+	// replace the 0 strides with the actual data size per line, without changing the image
+	img := *i
+	img.Strides = make([]int, len(i.Strides))
+	for j, stride := range i.Strides {
+		if stride == 0 {
+			stride, _ = i.Colorspace.planeSize(j, width, height)
 		}
-		bitstream = unsafe.Pointer(&input[0])
+		img.Strides[j] = stride
 	}
-	cOutput, err := frame.Output.nativeOutput(d.Width, d.Height)
-	if err != nil {
-		return 0, DecoderStats{FrameType: frameTypeNothing}, err
+	r := img.regions(width, height)
+	if i.Colorspace.value == ColorSpaceYV12.value {
+		r[1], r[2] = r[2], r[1]
 	}
-	cDecoreFrame := C.xvid_dec_frame_t{
-		version:    C.XVID_VERSION,
-		general:    C.int(frame.DecodeFlags),
-		bitstream:  bitstream,
-		length:     C.int(l),
-		output:     *cOutput,
-		brightness: C.int(frame.Brightness),
+	return r, true
+}
+
+func clampByte(v float64) byte {
+	if v <= 0 {
+		return 0
 	}
-	cDecodeStats := C.xvid_dec_stats_t{
-		version: C.XVID_VERSION,
+	if v >= 255 {
+		return 255
 	}
-	code := C.xvid_decore(d.handle, C.XVID_DEC_DECODE, unsafe.Pointer(&cDecoreFrame), unsafe.Pointer(&cDecodeStats))
-	if code < 0 {
-		return 0, DecoderStats{FrameType: frameTypeNothing}, xvidErr(code)
+	return byte(v + 0.5)
+}
+
+// ConvertWithMatrix converts an Image between a 4:2:0 YUV color space (ColorSpacePlanar, ColorSpaceI420,
+// ColorSpaceYV12) and an 8-bit RGB packed color space (ColorSpaceRGB, ColorSpaceBGR, ColorSpaceRGBA, ColorSpaceBGRA,
+// ColorSpaceARGB, ColorSpaceABGR), in either direction, using a specific color matrix and chroma siting.
+//
+// Unlike Convert, which uses the fixed BT.601 matrix and the centered chroma siting of Xvid (and is faster),
+// the conversion is done in Go; use ColorMatrixBT709 for high definition content. The chroma is subsampled by
+// averaging (and upsampled by replicating or interpolating) the samples around the chroma siting position.
+// The alpha channel of RGBA output images is set to 255. VerticalFlip is supported on the output image.
+// An error can be returned because of invalid input or output images.
+func ConvertWithMatrix(input Image, output *Image, width int, height int, matrix ColorMatrix) error {
+	if matrix.Kr <= 0 || matrix.Kb <= 0 || matrix.Kr+matrix.Kb >= 1 {
+		return fmt.Errorf("xvid: invalid color matrix coefficients Kr=%v Kb=%v", matrix.Kr, matrix.Kb)
 	}
-	stats := DecoderStats{
-		FrameType: FrameType(cDecodeStats._type),
+	if matrix.Siting != ChromaSitingCenter && matrix.Siting != ChromaSitingLeft {
+		return fmt.Errorf("xvid: invalid chroma siting %d", matrix.Siting)
 	}
-	if stats.FrameType > 0 {
-		if frame.Output.Colorspace.value == ColorSpaceInternal.value {
-			j := 0
-			for j < ColorSpaceInternal.Planes {
-				l := d.Width * d.Height * frame.Output.Colorspace.BitsPerPixelPlanes[j] / 8
-				sh := reflect.SliceHeader{
-					Data: uintptr(cDecoreFrame.output.plane[j]),
-					Len:  l,
-					Cap:  l,
-				}
-				frame.Output.Planes[j] = *(*[]byte)(unsafe.Pointer(&sh))
-				frame.Output.Strides[j] = int(cDecoreFrame.output.stride[j])
-			}
+	if err := input.Colorspace.checkDimensions(width, height); err != nil {
+		return err
+	}
+	if err := output.Colorspace.checkDimensions(width, height); err != nil {
+		return err
+	}
+	if _, err := input.nativeInput(width, height); err != nil {
+		return err
+	}
+	if _, err := output.nativeOutput(width, height); err != nil {
+		return err
+	}
+	if yuv, ok := input.yuvRegions(width, height); ok {
+		r, g, b, a, size, ok := rgbLayout(output.Colorspace)
+		if !ok {
+			return errors.New("xvid: invalid color space for conversion output, must be an 8-bit RGB packed color space")
 		}
-		frame.Output.fixAlpha(d.Width, d.Height)
+		yuvToRGB(&input, yuv, output, r, g, b, a, size, width, height, matrix)
+		return nil
+	}
+	if r, g, b, _, size, ok := rgbLayout(input.Colorspace); ok {
+		yuv, ok := output.yuvRegions(width, height)
+		if !ok {
+			return errors.New("xvid: invalid color space for conversion output, must be ColorSpacePlanar, ColorSpaceI420, or ColorSpaceYV12")
+		}
+		rgbToYUV(&input, r, g, b, size, output, yuv, width, height, matrix)
+		return nil
+	}
+	return errors.New("xvid: invalid color space for conversion input, must be a 4:2:0 YUV color space or an 8-bit RGB packed color space")
+}
 
-		cVopData := C.vop_data(&cDecodeStats)
-		var quantizers []int32
-		if cVopData.qscale != nil {
-			mbWidth := (d.Width + 15) / 16
-			mbHeight := (d.Height + 15) / 16
-			if mbWidth != int(cVopData.qscale_stride) {
-				// macroblock size computation mismatch, should not happen
-				// dont return any quantizers
-				// TODO: print to stderr?
+func yuvToRGB(input *Image, yuv []planeRegion, output *Image, r int, g int, b int, a int, size int, width int, height int, m ColorMatrix) {
+	kg := 1 - m.Kr - m.Kb
+	stride := output.Strides[0]
+	sample := func(p planeRegion, x int, y int) float64 {
+		return float64(input.Planes[p.plane][p.offset+y*p.stride+x])
+	}
+	for y := 0; y < height; y++ {
+		dy := y
+		if output.VerticalFlip {
+			dy = height - 1 - y
+		}
+		row := output.Planes[0][dy*stride:]
+		for x := 0; x < width; x++ {
+			var u, v float64
+			cx, cy := x/2, y/2
+			if m.Siting == ChromaSitingLeft && x%2 == 1 && cx+1 < yuv[1].width {
+				u = (sample(yuv[1], cx, cy) + sample(yuv[1], cx+1, cy)) / 2
+				v = (sample(yuv[2], cx, cy) + sample(yuv[2], cx+1, cy)) / 2
 			} else {
-				n := mbWidth * mbHeight
-				quantizers = make([]int32, n)
-				sh := reflect.SliceHeader{
-					Data: uintptr(unsafe.Pointer(cVopData.qscale)),
-					Len:  n,
-					Cap:  n,
-				}
-				if C.sizeof_int == unsafe.Sizeof(int32(0)) {
-					copy(quantizers, *(*[]int32)(unsafe.Pointer(&sh)))
-				} else {
-					for i := range quantizers {
-						quantizers[i] = int32((*(*[]C.int)(unsafe.Pointer(&sh)))[i])
+				u = sample(yuv[1], cx, cy)
+				v = sample(yuv[2], cx, cy)
+			}
+			yy := (sample(yuv[0], x, y) - 16) * 255 / 219
+			pb := (u - 128) * 255 / 224
+			pr := (v - 128) * 255 / 224
+			red := yy + 2*(1-m.Kr)*pr
+			blue := yy + 2*(1-m.Kb)*pb
+			green := (yy - m.Kr*red - m.Kb*blue) / kg
+			p := row[x*size:]
+			p[r] = clampByte(red)
+			p[g] = clampByte(green)
+			p[b] = clampByte(blue)
+			if a >= 0 {
+				p[a] = 255
+			}
+		}
+	}
+}
+
+func rgbToYUV(input *Image, r int, g int, b int, size int, output *Image, yuv []planeRegion, width int, height int, m ColorMatrix) {
+	kg := 1 - m.Kr - m.Kb
+	stride := input.Strides[0]
+	if stride == 0 {
+		stride = width * size
+	}
+	// output row of a plane, flipped if needed
+	outRow := func(p planeRegion, y int) []byte {
+		if output.VerticalFlip {
+			y = p.height - 1 - y
+		}
+		return output.Planes[p.plane][p.offset+y*p.stride:]
+	}
+	rgb := func(x int, y int) (float64, float64, float64) {
+		if x < 0 {
+			x = 0
+		} else if x >= width {
+			x = width - 1
+		}
+		if y >= height {
+			y = height - 1
+		}
+		p := input.Planes[0][y*stride+x*size:]
+		return float64(p[r]), float64(p[g]), float64(p[b])
+	}
+	for y := 0; y < height; y++ {
+		row := outRow(yuv[0], y)
+		for x := 0; x < width; x++ {
+			red, green, blue := rgb(x, y)
+			row[x] = clampByte(16 + 219*(m.Kr*red+kg*green+m.Kb*blue)/255)
+		}
+	}
+	// weights of the columns around 2*cx: columns -1, 0, 1, 2
+	weights := [4]float64{0, 0.5, 0.5, 0}
+	if m.Siting == ChromaSitingLeft {
+		weights = [4]float64{0.25, 0.5, 0.25, 0}
+	}
+	for cy := 0; cy < yuv[1].height; cy++ {
+		rowU := outRow(yuv[1], cy)
+		rowV := outRow(yuv[2], cy)
+		for cx := 0; cx < yuv[1].width; cx++ {
+			var red, green, blue float64
+			for dy := 0; dy < 2; dy++ {
+				for dx, w := range weights {
+					if w == 0 {
+						continue
 					}
+					pr, pg, pb := rgb(2*cx+dx-1, 2*cy+dy)
+					red += pr * w / 2
+					green += pg * w / 2
+					blue += pb * w / 2
 				}
 			}
+			yy := m.Kr*red + kg*green + m.Kb*blue
+			rowU[cx] = clampByte(128 + 224*(blue-yy)/(2*(1-m.Kb))/255)
+			rowV[cx] = clampByte(128 + 224*(red-yy)/(2*(1-m.Kr))/255)
 		}
-		stats.StatsFrame = &DecoderStatsFrame{
-			UpperFieldFirst:  cVopData.general&C.XVID_VOP_TOPFIELDFIRST != 0,
-			Quantizers:       quantizers,
-			QuantizersStride: int(cVopData.qscale_stride),
-		}
-	} else if stats.FrameType == FrameTypeVOL {
-		cVolData := C.vol_data(&cDecodeStats)
-		var par PixelAspectRatio
-		switch cVolData.par {
-		case C.XVID_PAR_11_VGA:
-			par = PixelAspectRatio11VGA
-		case C.XVID_PAR_43_PAL:
-			par = PixelAspectRatio43PAL
-		case C.XVID_PAR_43_NTSC:
-			par = PixelAspectRatio43NTSC
-		case C.XVID_PAR_169_PAL:
-			par = PixelAspectRatio169PAL
-		case C.XVID_PAR_169_NTSC:
-			par = PixelAspectRatio169NTSC
-		case C.XVID_PAR_EXT:
-			par = newPixelAspectRatio(int(cVolData.par_width), int(cVolData.par_height))
+	}
+}
+
+// NewImageFromGo returns an Image using the pixel data of a standard library image, without copying it, and its
+// width and height, e.g. to encode it:
+//   - *image.YCbCr with a 4:2:0 subsample ratio as ColorSpacePlanar, with a 4:2:2 subsample ratio as
+//     ColorSpacePlanar422 (only for encoding); other subsample ratios are not supported
+//   - *image.RGBA and *image.NRGBA as ColorSpaceRGBA (Xvid ignores the alpha channel)
+//   - *image.Gray as ColorSpacePlanar, with newly allocated neutral chroma planes
+//
+// An error is returned for other image types.
+func NewImageFromGo(img image.Image) (Image, int, int, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch img := img.(type) {
+	case *image.YCbCr:
+		var colorspace ColorSpace
+		switch img.SubsampleRatio {
+		case image.YCbCrSubsampleRatio420:
+			colorspace = ColorSpacePlanar
+		case image.YCbCrSubsampleRatio422:
+			colorspace = ColorSpacePlanar422
 		default:
-			par = PixelAspectRatio11VGA
+			return Image{}, 0, 0, fmt.Errorf("xvid: unsupported image.YCbCr subsample ratio %v, must be 4:2:0 or 4:2:2", img.SubsampleRatio)
 		}
-		stats.StatsVOL = &DecoderStatsVOL{
-			Interlacing:      cVolData.general&C.XVID_VOL_INTERLACING != 0,
-			Width:            int(cVolData.width),
-			Height:           int(cVolData.height),
-			PixelAspectRatio: par,
+		return Image{
+			Colorspace: colorspace,
+			Planes: [][]byte{
+				img.Y[img.YOffset(bounds.Min.X, bounds.Min.Y):],
+				img.Cb[img.COffset(bounds.Min.X, bounds.Min.Y):],
+				img.Cr[img.COffset(bounds.Min.X, bounds.Min.Y):],
+			},
+			Strides: []int{img.YStride, img.CStride},
+		}, width, height, nil
+	case *image.RGBA:
+		return Image{
+			Colorspace: ColorSpaceRGBA,
+			Planes:     [][]byte{img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):]},
+			Strides:    []int{img.Stride},
+		}, width, height, nil
+	case *image.NRGBA:
+		return Image{
+			Colorspace: ColorSpaceRGBA,
+			Planes:     [][]byte{img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):]},
+			Strides:    []int{img.Stride},
+		}, width, height, nil
+	case *image.Gray:
+		cw, ch := ColorSpacePlanar.planeSize(1, width, height)
+		chroma := make([]byte, cw*ch)
+		for i := range chroma {
+			chroma[i] = 128
 		}
-		d.Width = stats.StatsVOL.Width
-		d.Height = stats.StatsVOL.Height
+		return Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     [][]byte{img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y):], chroma, chroma},
+			Strides:    []int{img.Stride, cw},
+		}, width, height, nil
 	}
-	return int(code), stats, nil
+	return Image{}, 0, 0, fmt.Errorf("xvid: unsupported image type %T", img)
 }
 
-// Close closes any internal resources specific to the Decoder.
-// It must be called exactly once per Decoder and no other methods of the Decoder
-// must be called after Close.
-func (d *Decoder) Close() {
-	C.xvid_decore(d.handle, C.XVID_DEC_DESTROY, nil, nil)
+// ToGoImage returns the image of the given dimensions as a standard library image:
+//   - an *image.YCbCr (4:2:0) for ColorSpacePlanar, ColorSpaceInternal, ColorSpaceI420 and ColorSpaceYV12, wrapping
+//     the planes without copy
+//   - an *image.RGBA for ColorSpaceRGBA, wrapping the plane without copy
+//   - an *image.Gray for ColorSpaceGray, wrapping the plane without copy
+//   - a newly allocated *image.RGBA for the other RGB packed color spaces
+//   - a newly allocated *image.YCbCr (4:2:2) for the YUV 4:2:2 packed color spaces
+//
+// For greyscale frames, decode to ColorSpaceGray, or use Decoder.DecodeGray to get an *image.Gray.
+// An error is returned if the image does not contain enough data, or for other color spaces.
+func (i *Image) ToGoImage(width int, height int) (image.Image, error) {
+	img := *i
+	if img.Colorspace.value == ColorSpaceInternal.value {
+		img.Colorspace = ColorSpacePlanar
+	}
+	if err := img.Colorspace.checkDimensions(width, height); err != nil {
+		return nil, err
+	}
+	if _, err := img.nativeInput(width, height); err != nil {
+		return nil, err
+	}
+	rect := image.Rect(0, 0, width, height)
+	if yuv, ok := img.yuvRegions(width, height); ok {
+		return &image.YCbCr{
+			Y:              img.Planes[yuv[0].plane][yuv[0].offset:],
+			Cb:             img.Planes[yuv[1].plane][yuv[1].offset:],
+			Cr:             img.Planes[yuv[2].plane][yuv[2].offset:],
+			YStride:        yuv[0].stride,
+			CStride:        yuv[1].stride,
+			SubsampleRatio: image.YCbCrSubsampleRatio420,
+			Rect:           rect,
+		}, nil
+	}
+	stride := img.Strides[0]
+	if stride == 0 {
+		stride, _ = img.Colorspace.planeSize(0, width, height)
+	}
+	if img.Colorspace.value == colorSpaceGray {
+		return &image.Gray{
+			Pix:    img.Planes[0],
+			Stride: stride,
+			Rect:   rect,
+		}, nil
+	}
+	if r, g, b, a, size, ok := rgbLayout(img.Colorspace); ok {
+		if img.Colorspace.value == ColorSpaceRGBA.value {
+			return &image.RGBA{
+				Pix:    img.Planes[0],
+				Stride: stride,
+				Rect:   rect,
+			}, nil
+		}
+		rgba := image.NewRGBA(rect)
+		for y := 0; y < height; y++ {
+			src := img.Planes[0][y*stride:]
+			dst := rgba.Pix[y*rgba.Stride:]
+			for x := 0; x < width; x++ {
+				pixel := src[x*size : (x+1)*size]
+				dst[x*4] = pixel[r]
+				dst[x*4+1] = pixel[g]
+				dst[x*4+2] = pixel[b]
+				dst[x*4+3] = 255
+				if a >= 0 {
+					dst[x*4+3] = pixel[a]
+				}
+			}
+		}
+		return rgba, nil
+	}
+	// byte offsets of Y0, U, Y1, V in each 2-pixel group
+	var y0, u, y1, v int
+	switch img.Colorspace.value {
+	case ColorSpaceYUY2.value:
+		y0, u, y1, v = 0, 1, 2, 3
+	case ColorSpaceUYVY.value:
+		u, y0, v, y1 = 0, 1, 2, 3
+	case ColorSpaceYVYU.value:
+		y0, v, y1, u = 0, 1, 2, 3
+	default:
+		return nil, errors.New("xvid: unsupported color space for conversion to a standard library image")
+	}
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio422)
+	for y := 0; y < height; y++ {
+		src := img.Planes[0][y*stride:]
+		for x := 0; x < width; x += 2 {
+			group := src[x*2 : x*2+4]
+			ycbcr.Y[y*ycbcr.YStride+x] = group[y0]
+			ycbcr.Y[y*ycbcr.YStride+x+1] = group[y1]
+			ycbcr.Cb[y*ycbcr.CStride+x/2] = group[u]
+			ycbcr.Cr[y*ycbcr.CStride+x/2] = group[v]
+		}
+	}
+	return ycbcr, nil
 }
 
-// Plugin is an Xvid plugin that is used during the encoding process as a callback
-// for both read and write operations to some internal frame encoding data.
-// Plugins are used in the Encoder methods.
-//
-// Some default plugins are provided, which include 1-pass and 2-pass rate control.
+// BatchConvert converts a batch of images to Images of the color space outCS, in parallel on up to GOMAXPROCS
+// goroutines; the returned Images are in the order of inputs, with compact strides.
 //
-// Custom plugins can also be created by implementing the Plugin interface.
-type Plugin interface {
-	// called during Encoder.Init
-	// return the information the plugins needs
-	Info() PluginFlag
-	// called during Encoder.Init to init the plugin (any startup setup should be done here)
-	// return false to disable the plugin for an Encoder
-	Init(create PluginInit) bool
-	// called during Encoder.Close to close any open plugin resources
-	Close(close PluginClose)
-
-	// frame-related callbacks
-	// check FrameData for what fields are readable/writable depending on the call
-
-	// called during Encoder.Encode, before starting to encode a frame
-	Before(data *PluginData)
-	// called during Encoder.Encode, while encoding a frame
-	Frame(data *PluginData)
-	// called during Encoder.Encode, after encoding a frame
-	After(data *PluginData)
+// 4:2:0 *image.YCbCr images with even dimensions are converted with Convert. Other images are converted to RGBA
+// first, then to the output color space with the BT.601 matrix of Xvid (see ConvertWithMatrix), so that all the
+// images of the batch are converted consistently.
+// If an image cannot be converted (e.g. because of odd dimensions with a 4:2:0 output color space), the error of
+// the first such image in the order of inputs is returned.
+// Each goroutine reuses its intermediate RGBA and planar buffers across the images it converts, so that only
+// the returned Images are allocated for each image.
+func BatchConvert(inputs []image.Image, outCS ColorSpace) ([]Image, error) {
+	if outCS.value == ColorSpaceInternal.value || outCS.value == ColorSpaceNoOutput.value {
+		return nil, errors.New("xvid: invalid color space for conversion output, must not be ColorSpaceInternal or ColorSpaceNoOutput")
+	}
+	outputs := make([]Image, len(inputs))
+	errs := make([]error, len(inputs))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			var scratch convertScratch
+			for i := range indices {
+				outputs[i], errs[i] = convertImage(inputs[i], outCS, &scratch)
+			}
+		}()
+	}
+	for i := range inputs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return outputs, nil
 }
 
-type pluginInternal struct {
-	cPlugin     C.xvid_enc_plugin_t
-	free        func()
-	destroyFree func()
+// ConvertImage converts a standard library image to the color space dstColorspace, flipping it vertically if
+// verticalFlip is set, and returns the result as a standard library image (see Image.ToGoImage for the returned
+// image types, and the supported color spaces). The dimensions are those of the bounds of src.
+//
+// The images are converted as in BatchConvert: 4:2:0 *image.YCbCr images of even dimensions are converted directly
+// by Xvid, and other images are first converted to RGBA. Packed RGB destination color spaces (e.g. ColorSpaceRGBA)
+// are converted the same way for all dimensions; the other color spaces are converted from a 4:2:0 image, and
+// require even dimensions (see ColorSpace).
+// Init (or InitWithFlags) must be called once before calling this function.
+func ConvertImage(src image.Image, dstColorspace ColorSpace, verticalFlip bool) (image.Image, error) {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("xvid: invalid image dimensions %dx%d", width, height)
+	}
+	if dstColorspace.value == ColorSpaceInternal.value || dstColorspace.value == ColorSpaceNoOutput.value {
+		return nil, errors.New("xvid: invalid color space for conversion output, must not be ColorSpaceInternal or ColorSpaceNoOutput")
+	}
+	if _, _, _, _, _, ok := rgbLayout(dstColorspace); !ok {
+		// subsampled or 16-bit color spaces: convert from a 4:2:0 image, which requires even dimensions
+		output := Image{
+			Colorspace:   dstColorspace,
+			VerticalFlip: verticalFlip,
+		}
+		input, _, _, err := NewImageFromGo(src)
+		if err != nil || input.Colorspace.value != ColorSpacePlanar.value {
+			input, err = convertImage(src, ColorSpacePlanar, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := Convert(input, &output, width, height, false); err != nil {
+			return nil, err
+		}
+		return output.ToGoImage(width, height)
+	}
+	// packed RGB color spaces: convert directly, for any dimensions
+	output, err := convertImage(src, dstColorspace, nil)
+	if err != nil {
+		return nil, err
+	}
+	if verticalFlip {
+		row := make([]byte, output.Strides[0])
+		for y := 0; y < height/2; y++ {
+			top := output.Planes[0][y*output.Strides[0] : (y+1)*output.Strides[0]]
+			bottom := output.Planes[0][(height-1-y)*output.Strides[0] : (height-y)*output.Strides[0]]
+			copy(row, top)
+			copy(top, bottom)
+			copy(bottom, row)
+		}
+	}
+	return output.ToGoImage(width, height)
 }
 
-func (p pluginInternal) Info() PluginFlag            { return 0 }
-func (p pluginInternal) Init(create PluginInit) bool { return true }
-func (p pluginInternal) Close(close PluginClose)     {}
-func (p pluginInternal) Before(data *PluginData)     {}
-func (p pluginInternal) Frame(data *PluginData)      {}
-func (p pluginInternal) After(data *PluginData)      {}
-
-// PluginRC1PassInit is a configuration for the PluginRC1Pass plugin (1-pass rate-control).
-// To return a configuration initialized to default values, use NewPluginRC1PassInit.
-type PluginRC1PassInit struct {
-	// target bitrate in bits per second
-	Bitrate int
-	// reaction delay factor; defaults to 16
-	ReactionDelayFactor int
-	// averaging period; defaults to 100
-	AveragingPeriod int
-	// smoothing buffer; defaults to 100
-	SmoothingBuffer int
+// convertScratch holds the intermediate buffers of convertImage, to reuse them across conversions
+type convertScratch struct {
+	rgba   []byte
+	planar [3][]byte
 }
 
-// NewPluginRC1PassInit returns a PluginRC1PassInit initialized to default values.
-func NewPluginRC1PassInit(bitrate int) PluginRC1PassInit {
-	return PluginRC1PassInit{
-		Bitrate:             bitrate,
-		ReactionDelayFactor: 16,
-		AveragingPeriod:     100,
-		SmoothingBuffer:     100,
+// rgbaImage returns an RGBA image of the given dimensions backed by the scratch buffer
+func (s *convertScratch) rgbaImage(width int, height int) *image.RGBA {
+	size := 4 * width * height
+	if cap(s.rgba) < size {
+		s.rgba = make([]byte, size)
+	}
+	return &image.RGBA{
+		Pix:    s.rgba[:size],
+		Stride: 4 * width,
+		Rect:   image.Rect(0, 0, width, height),
 	}
 }
 
-// PluginRC1Pass returns an instance of the 1-pass rate-control plugin, to be used in NewEncoder.
-// This plugin will choose specific quantizers to try to match the bitrate parameters.
-func PluginRC1Pass(init PluginRC1PassInit) Plugin {
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_single,
-			param: unsafe.Pointer(&C.xvid_plugin_single_t{
-				version:               C.XVID_VERSION,
-				bitrate:               C.int(init.Bitrate),
-				reaction_delay_factor: C.int(init.ReactionDelayFactor),
-				averaging_period:      C.int(init.AveragingPeriod),
-				buffer:                C.int(init.SmoothingBuffer),
-			}),
-		},
+// planarImage returns a ColorSpacePlanar Image of the given dimensions backed by the scratch buffers, or an Image
+// without planes (to be allocated by the conversion) for odd dimensions, which ColorSpacePlanar does not support
+func (s *convertScratch) planarImage(width int, height int) Image {
+	if width%2 != 0 || height%2 != 0 {
+		return Image{Colorspace: ColorSpacePlanar}
+	}
+	planes := make([][]byte, 3)
+	for j := range planes {
+		size := width * height
+		if j > 0 {
+			size /= 4
+		}
+		if cap(s.planar[j]) < size {
+			s.planar[j] = make([]byte, size)
+		}
+		planes[j] = s.planar[j][:size]
+	}
+	return Image{
+		Colorspace: ColorSpacePlanar,
+		Planes:     planes,
+		Strides:    []int{width, width / 2},
 	}
 }
 
-// PluginRC2Pass1 returns an instance of the 2-pass rate-control plugin for the first pass.
-// To do 2-pass rate-control in Xvid, encode the same images twice, in the first run using the
-// PluginRC2Pass1 plugin, and in the second run using the PluginRC2Pass2 plugin.
-//
-// PluginRC2Pass1 takes a filename which is used to store the rate-control information (the file will be overwritten).
-// If the file writing fails, Xvid will not return errors, so you can check for the file existence yourself
-// after the encoding ends.
-func PluginRC2Pass1(filename string) Plugin {
-	cFilename := C.CString(filename)
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_2pass1,
-			param: unsafe.Pointer(&C.xvid_plugin_2pass1_t{
-				version:  C.XVID_VERSION,
-				filename: cFilename,
-			}),
-		},
-		free: func() {
-			C.free(unsafe.Pointer(cFilename))
-		},
+// convertImage converts an image.Image to an Image of the color space outCS; the intermediate buffers are taken
+// from scratch if it is not nil
+func convertImage(img image.Image, outCS ColorSpace, scratch *convertScratch) (Image, error) {
+	if scratch == nil {
+		scratch = &convertScratch{}
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	output := Image{Colorspace: outCS}
+	if ycbcr, ok := img.(*image.YCbCr); ok && ycbcr.SubsampleRatio == image.YCbCrSubsampleRatio420 && width%2 == 0 && height%2 == 0 {
+		input := Image{
+			Colorspace: ColorSpacePlanar,
+			Planes: [][]byte{
+				ycbcr.Y[ycbcr.YOffset(bounds.Min.X, bounds.Min.Y):],
+				ycbcr.Cb[ycbcr.COffset(bounds.Min.X, bounds.Min.Y):],
+				ycbcr.Cr[ycbcr.COffset(bounds.Min.X, bounds.Min.Y):],
+			},
+			Strides: []int{ycbcr.YStride, ycbcr.CStride},
+		}
+		if err := Convert(input, &output, width, height, false); err != nil {
+			return Image{}, err
+		}
+		return output, nil
 	}
-}
 
-// PluginRC2Pass2Init is a configuration for the PluginRC2Pass2 plugin (2-pass rate-control, pass 2).
-// To return a configuration initialized to default values, use NewPluginRC2Pass2Init.
-type PluginRC2Pass2Init struct {
-	// target bitrate in bits per second; defaults to 700*1024
-	Bitrate int
-	// path to file to read rate-control info from, should be the same file as the first pass filename
-	Filename string
-	// I-frame boost percentage, range: [0..100]; defaults to 10
-	IFrameBoost int
-	// percentage of compression performed on the high part of the curve (above average); defaults to 0
-	CurveCompressionHigh int
-	// percentage of compression performed on the low  part of the curve (below average); defaults to 0
-	CurveCompressionLow int
-	// payback delay in number of frames; defaults to 5
-	OverflowControlStrength int
-	// percentage of allowed range for a frame that gets bigger because of overflow bonus; defaults to 5
-	MaxOverflowImprovement int
-	// percentage of allowed range for a frame that gets smaller because of overflow penalty; defaults to 5
-	MaxOverflowDegradation int
-
-	// maximum bitrate reduction applied to an I-frame under the kfthreshold distance limit; defaults to 20
-	IFrameReduction int
+	rgba, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = scratch.rgbaImage(width, height)
+		draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+	}
+	input := Image{
+		Colorspace: ColorSpaceRGBA,
+		Planes:     [][]byte{rgba.Pix},
+		Strides:    []int{rgba.Stride},
+	}
+	if r, g, b, a, size, ok := rgbLayout(outCS); ok {
+		if _, err := output.nativeOutput(width, height); err != nil {
+			return Image{}, err
+		}
+		for y := 0; y < height; y++ {
+			src := rgba.Pix[y*rgba.Stride:]
+			dst := output.Planes[0][y*output.Strides[0]:]
+			for x := 0; x < width; x++ {
+				pixel := dst[x*size : (x+1)*size]
+				pixel[r] = src[x*4]
+				pixel[g] = src[x*4+1]
+				pixel[b] = src[x*4+2]
+				if a >= 0 {
+					pixel[a] = src[x*4+3]
+				}
+			}
+		}
+		return output, nil
+	}
+	switch outCS.value {
+	case ColorSpacePlanar.value, ColorSpaceI420.value, ColorSpaceYV12.value:
+		if err := ConvertWithMatrix(input, &output, width, height, ColorMatrixBT601); err != nil {
+			return Image{}, err
+		}
+		return output, nil
+	}
+	// other color spaces: convert to ColorSpacePlanar first
+	planar := scratch.planarImage(width, height)
+	if err := ConvertWithMatrix(input, &planar, width, height, ColorMatrixBT601); err != nil {
+		return Image{}, err
+	}
+	if err := Convert(planar, &output, width, height, false); err != nil {
+		return Image{}, err
+	}
+	return output, nil
+}
 
-	// if an iframe is closer to the next iframe than this distance, a quantity of bits
-	// is substracted from its bit allocation. The reduction is computed as multiples of
-	// kfreduction/kthreshold. It reaches kfreduction when the distance == kfthreshold,
-	// 0 for 1<distance<kfthreshold
-	// defaults to 1
-	IFrameThreshold int
+// PatternKind is a kind of synthetic image generated by TestPattern.
+type PatternKind int
 
-	// how many bytes the controller has to compensate per frame due to container format overhead; defaults to 0
-	ContainerFrameOverhead int
+const (
+	// solid color, chosen from the seed
+	PatternSolid PatternKind = iota
+	// the 7 SMPTE 75% color bars (white, yellow, cyan, green, magenta, red, blue), from left to right
+	PatternBars
+	// horizontal luma gradient from black (left) to white (right), without chroma
+	PatternGradient
+	// uniform random luma and chroma noise, generated from the seed
+	PatternNoise
+)
 
-	// Video Buffering Verifier buffer size in bits; 0 disables VBV check; defaults to 0
-	VBVSize int
-	// Video Buffering Verifier max processing bitrate in bits per second
-	VBVMaxRate int
-	// Video Buffering Verifier initial buffer occupancy in bits; defaults to 0
-	VBVInitial int
+// SMPTE 75% color bars, in YUV (BT.601, limited range)
+var patternBars = [][3]byte{
+	{180, 128, 128},
+	{162, 44, 142},
+	{131, 156, 44},
+	{112, 72, 58},
+	{84, 184, 198},
+	{65, 100, 212},
+	{35, 212, 114},
 }
 
-// NewPluginRC2Pass2Init returns a PluginRC2Pass2Init initialized to default values.
-// It takes a filename which is used to read the rate-control information from a previous first pass.
-func NewPluginRC2Pass2Init(bitrate int, filename string) PluginRC2Pass2Init {
-	return PluginRC2Pass2Init{
-		Bitrate:                 bitrate,
-		Filename:                filename,
-		IFrameBoost:             10,
-		OverflowControlStrength: 5,
-		MaxOverflowImprovement:  5,
-		MaxOverflowDegradation:  5,
-		IFrameReduction:         20,
-		IFrameThreshold:         1,
-		ContainerFrameOverhead:  100,
+// TestPattern returns a newly allocated ColorSpacePlanar image of a synthetic pattern, e.g. for testing or
+// placeholder streams, which can be used as an EncoderFrame.Input. The patterns are deterministic: the same
+// arguments always return the same image; seed is only used by PatternSolid and PatternNoise.
+// It returns nil if the dimensions are not positive or if the kind is invalid.
+func TestPattern(width int, height int, kind PatternKind, seed int64) *Image {
+	if width <= 0 || height <= 0 {
+		return nil
 	}
-}
-
-// PluginRC2Pass2 returns an instance of the 2-pass rate-control plugin for the second pass.
-// To do 2-pass rate-control in Xvid, encode the same images twice, in the first run using the
-// PluginRC2Pass1 plugin, and in the second run using the PluginRC2Pass2 plugin.
-func PluginRC2Pass2(init PluginRC2Pass2Init) Plugin {
-	filename := C.CString(init.Filename)
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_2pass2,
-			param: unsafe.Pointer(&C.xvid_plugin_2pass2_t{
-				version:                   C.XVID_VERSION,
-				bitrate:                   C.int(init.Bitrate),
-				filename:                  filename,
-				keyframe_boost:            C.int(init.IFrameBoost),
-				curve_compression_high:    C.int(init.CurveCompressionHigh),
-				curve_compression_low:     C.int(init.CurveCompressionLow),
-				overflow_control_strength: C.int(init.OverflowControlStrength),
-				max_overflow_improvement:  C.int(init.MaxOverflowImprovement),
-				max_overflow_degradation:  C.int(init.MaxOverflowDegradation),
-				kfreduction:               C.int(init.IFrameReduction),
-				kfthreshold:               C.int(init.IFrameThreshold),
-				container_frame_overhead:  C.int(init.ContainerFrameOverhead),
-				vbv_size:                  C.int(init.VBVSize),
-				vbv_initial:               C.int(init.VBVInitial),
-				vbv_maxrate:               C.int(init.VBVMaxRate),
-			}),
-		},
-		free: func() {
-			C.free(unsafe.Pointer(filename))
-		},
+	if kind != PatternSolid && kind != PatternBars && kind != PatternGradient && kind != PatternNoise {
+		return nil
+	}
+	img := &Image{
+		Colorspace: ColorSpacePlanar,
+		Planes:     make([][]byte, 3),
+		Strides:    make([]int, 2),
+	}
+	for j := range img.Planes {
+		w, h := ColorSpacePlanar.planeSize(j, width, height)
+		if j < 2 {
+			img.Strides[j] = w
+		}
+		img.Planes[j] = make([]byte, w*h)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	solid := [3]byte{byte(16 + rng.Intn(220)), byte(16 + rng.Intn(225)), byte(16 + rng.Intn(225))}
+	for j, plane := range img.Planes {
+		w, h := ColorSpacePlanar.planeSize(j, width, height)
+		for y := 0; y < h; y++ {
+			row := plane[y*w : (y+1)*w]
+			for x := range row {
+				switch kind {
+				case PatternSolid:
+					row[x] = solid[j]
+				case PatternBars:
+					row[x] = patternBars[x*len(patternBars)/w][j]
+				case PatternGradient:
+					if j == 0 {
+						row[x] = byte(16 + x*219/w)
+					} else {
+						row[x] = 128
+					}
+				case PatternNoise:
+					row[x] = byte(16 + rng.Intn(220))
+				}
+			}
+		}
 	}
+	return img
 }
 
-// MaskingMethod is a method used for lumi-masking (adaptive quantization).
-type MaskingMethod uint
+// Decoder is an initialized Xvid decoder.
+// To create a Decoder, use NewDecoder.
+// A Decoder must be closed after use, by calling its Close method.
+// To decode a frame, use the Decode method.
+//
+// The memory used by a Decoder is bounded regardless of the stream length: it only keeps its input buffer
+// (see DecoderInit.BufferSize, grown only for frames larger than it),
+// the internal Xvid frame buffers, and the state of the current frame (with a copy of the last good frame when
+// DecoderFrame.ConcealErrors is used), so that streams of any size can be decoded frame by frame.
+type Decoder struct {
+	// current frame width in pixels
+	Width int
+	// current frame height in pixels
+	Height int
+	handle unsafe.Pointer
+	r      io.Reader
+	buf    []byte
+	i      int
+	n      int
+	eof    bool
+	err    error // permanent error
+
+	reference      *Decoder
+	referenceImage Image
+
+	timeCodes timeCodeParser
+	// user_data read since the last returned frame
+	userData []string
+
+	closed bool
+	// whether the stream is read from the bytes passed to NewDecoderBytes, stored in buf
+	fromBytes bool
+	// offset in buf from which the remaining data of a NewDecoderBytes stream is copied to a zero-padded buffer
+	// before decoding, as xvidcore reads past the end of its input; -1 once copied
+	tail int
+	// zero-padded copy of the input of DecodeFrameBytes
+	scratch []byte
+	// number of threads granted by SetMaxConcurrentThreads
+	threads int
+
+	// last good decoded frame and its stats, for DecoderFrame.ConcealErrors
+	concealImage Image
+	concealFrame *DecoderStatsFrame
+
+	// whether the last VOL is interlaced, for converting the internal buffers like xvidcore does
+	interlacing bool
+	// whether the dimensions were set in DecoderInit, and must match the VOL dimensions
+	fixedDimensions bool
+}
 
+// FourCC codes of MPEG-4 Part 2 streams, for DecoderInit.FourCC, as stored in little-endian order in containers
+// (e.g. the AVI stream header). Streams with these FourCC codes are known to decode correctly: xvidcore does not
+// change its behavior based on the FourCC, the quirks of the streams produced by older encoders are detected from
+// the bitstream itself (e.g. the DivX5 user data of packed bitstreams, or the build number of the Xvid user data).
 const (
-	// luminance masking
-	MaskingLuminance MaskingMethod = 0
-	// variance masking
-	MaskingVariance MaskingMethod = 1
+	// Xvid
+	FourCCXVID = 'X' | 'V'<<8 | 'I'<<16 | 'D'<<24
+	// DivX 4
+	FourCCDIVX = 'D' | 'I'<<8 | 'V'<<16 | 'X'<<24
+	// DivX 5 and later
+	FourCCDX50 = 'D' | 'X'<<8 | '5'<<16 | '0'<<24
+	// 3ivx
+	FourCC3IVX = '3' | 'I'<<8 | 'V'<<16 | 'X'<<24
 )
 
-// PluginAdaptiveQuantization returns an instance of the adaptive quantization plugin
-// (also-called lumi-masking).
-func PluginAdaptiveQuantization(method MaskingMethod) Plugin {
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_lumimasking,
-			param: unsafe.Pointer(&C.xvid_plugin_lumimasking_t{
-				version: C.XVID_VERSION,
-				method:  C.int(method),
-			}),
-		},
-	}
-}
+// unsupportedFourCCs are FourCC codes of streams that are not MPEG-4 Part 2 streams (DivX 3 and the Microsoft
+// MPEG-4 variants) and cannot be decoded by xvidcore
+var unsupportedFourCCs = []string{"DIV3", "DIV4", "MP41", "MP42", "MP43"}
 
-// PluginPSNR returns an instance of a plugin that writes PSNR values to the standard output.
-func PluginPSNR() Plugin {
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_psnr,
-			param: nil,
-		},
+// checkFourCC returns an error if fourCC is neither 0 nor a printable FourCC code of a supported stream
+func checkFourCC(fourCC int) error {
+	if fourCC == 0 {
+		return nil
+	}
+	if uint64(fourCC)>>32 != 0 {
+		return fmt.Errorf("xvid: invalid FourCC %#x, must be 4 printable characters", fourCC)
+	}
+	var b [4]byte
+	for i := range b {
+		b[i] = byte(fourCC >> (8 * uint(i)))
+		if b[i] < 0x20 || b[i] > 0x7e {
+			return fmt.Errorf("xvid: invalid FourCC %#x, must be 4 printable characters", fourCC)
+		}
 	}
+	for _, u := range unsupportedFourCCs {
+		if strings.EqualFold(string(b[:]), u) {
+			return fmt.Errorf("xvid: unsupported FourCC %s, not an MPEG-4 Part 2 stream", string(b[:]))
+		}
+	}
+	return nil
 }
 
-// PluginDump returns an instance of a plugin that writes original and encoded image data
-// to files in YUV in PGM format in the working directory.
-func PluginDump() Plugin {
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_dump,
-			param: nil,
-		},
-	}
+// DecoderInit is information used to create a Decoder in NewDecoder.
+// Its Input field must be set to the Reader from which to read an encoded raw Xvid stream data from, unless the
+// Decoder is created with NewDecoderBytes.
+type DecoderInit struct {
+	// Reader from which to read encoded frame data.
+	// the Reader will not be closed automatically, it has to be caller-closed after the Decoder is finished.
+	Input io.Reader
+	// optional frame width in pixels (can be automatically detected by the Decoder); if both Width and Height are
+	// set (e.g. known from a container), the output images are allocated with these dimensions before the first
+	// VOL is decoded, and Decode returns an error if a VOL of the stream has different dimensions
+	Width int
+	// optional frame height in pixels (can be automatically detected by the Decoder), see Width
+	Height int
+	// optional FourCC code of the raw Xvid stream, e.g. FourCCXVID or FourCCDX50; the FourCC codes of DivX 3 and of
+	// the Microsoft MPEG-4 variants (e.g. DIV3 or MP43) are rejected, as these are not MPEG-4 Part 2 streams
+	FourCC int
+	// optional number of threads to use for decoding, 0 meaning single-threaded; the creation can block until the
+	// threads are available, and the effective number of threads can be lower, see SetMaxConcurrentThreads
+	NumThreads int
+	// optional Decoder of a reference stream; if set, each decoded frame is compared against the next frame
+	// of the reference Decoder (decoded to the same color space) and the result is stored in DecoderStatsFrame.PSNR.
+	// The reference Decoder is not closed automatically and must not be used by the caller while decoding.
+	Reference *Decoder
+	// optional size in bytes of the buffer the Input is read into, at least 64 KiB and a multiple of 8; the buffer
+	// is grown if a single frame is larger than it; default is 0, meaning 4 MiB
+	BufferSize int
 }
 
-// PluginSSIMInit is a configuration for the PluginSSIM plugin (write SSIM values).
-// The SSIM values can be written to the standard output or to a file.
-type PluginSSIMInit struct {
-	// whether to output stats to stdout
-	PrintStats bool
-	// output stats filename (file will be overwritten); or empty to not output to a file
-	StatsFilename string
+// default and minimum sizes of the Decoder input buffer
+const (
+	defaultDecoderBufferSize = 4 * 1024 * 1024 // highly unlikely that any frame will be larger than 2MB
+	minDecoderBufferSize     = 64 * 1024
+)
 
-	// SSIM computation accuracy from 0 (gaussian weighted, very slow), 1 (unweighted, slow) to 4 (unweighted, very fast); default is 2
-	Accuracy int
-	// CPU flags to use for decoding, or nil to use the autodetected CPU features
-	CpuFlags *CPUFlag
+// DecoderFrame is information used when decoding a frame in Decoder.Decode.
+type DecoderFrame struct {
+	// output image to store the decoded data to
+	Output *Image
+	// optional decoder flags to use for decoding the frame
+	DecodeFlags DecoderFlag
+	// optional brightness offset, 0 meaning no offset
+	Brightness int
+	// optional, whether to fill DecoderStatsFrame.MacroblockTypes
+	MacroblockTypes bool
+	// optional buffer to store DecoderStatsFrame.Quantizers into, to avoid allocating a quantizers table for each
+	// frame: if its capacity is large enough it is overwritten and returned in Quantizers, otherwise a new table is
+	// allocated; pass the returned Quantizers as the buffer of the next frame to reuse the table across frames
+	QuantizerBuffer []int32
+	// optional, whether to conceal decoding errors: if the frame cannot be decoded, the last good frame decoded with
+	// ConcealErrors set is output again instead (with DecoderStatsFrame.Concealed set), the data up to the next VOP
+	// is skipped, and decoding continues instead of returning an error; this is best-effort concealment, not actual
+	// decoding: the frames predicted from the lost frame can still have artifacts until the next key frame, and
+	// xvidcore does not detect all bitstream errors; errors before the first good frame are still returned. The
+	// concealed frame has the PresentationTime and UserData of the lost frame. Each frame decoded with this option is
+	// copied (to internal buffers reused across frames), which has a cost for large output images
+	ConcealErrors bool
+	// advanced, optional raw xvidcore decoder flags, bitwise-or'd with DecodeFlags; not validated, for experimenting
+	// with xvidcore flags that have no DecoderFlag constant
+	RawFlags uint
+	// optional, whether to only write the key frames (I frames) to Output, e.g. for thumbnails or a scrubbing
+	// timeline: all frames are still decoded (to the internal decoder buffers, without color space conversion),
+	// since the following frames are predicted from them, but Output is left unchanged for the other frames, which
+	// are recognized by their DecoderStats.FrameType; all the frames of the stream must still be passed to the
+	// Decoder to keep the reference frames intact. The post-processing DecodeFlags and Brightness are not applied to
+	// the key frames written with this option. Ignored for ColorSpaceInternal and ColorSpaceNoOutput outputs
+	KeyFramesOnly bool
+}
 
-	// visualization is currently disabled in xvidcore
-	// Visualize  bool
+// DecoderStats is information about a decoded frame, returned by Decoder.Decode.
+// If the frame is a metadata pseudo-frame (VOL), StatsVOL is not nil, otherwise
+// StatsFrame is not nil.
+type DecoderStats struct {
+	// type of the decoded frame
+	FrameType FrameType
+	// non-nil if the frame type is FrameTypeVOL
+	StatsVOL *DecoderStatsVOL
+	// non-nil if the frame type is not FrameTypeVOL
+	StatsFrame *DecoderStatsFrame
+	// user_data strings found in the stream data read for this frame, typically after a VOL (e.g. the encoder name
+	// and build, such as "XviD0050"); they can be written back with EncoderInit.UserData.
+	// The DivX5 user data (e.g. "DivX503b1393p", see EncoderWriteDivX5UserData) is special: decoders read it to
+	// detect packed bitstreams (the trailing "p"), so it must not be copied to a stream that is encoded differently
+	UserData []string
+
+	// decoder dimensions when the frame was returned, see Dimensions
+	width  int
+	height int
 }
 
-// PluginSSIM returns an instance of a plugin that writes SSIM values to the standard output
-// or to a file.
-func PluginSSIM(init PluginSSIMInit) Plugin {
-	var filename *C.char = nil
-	if init.StatsFilename != "" {
-		filename = C.CString(init.StatsFilename)
-	}
-	var cpuFlags C.int = 0
-	if init.CpuFlags != nil {
-		cpuFlags = C.int(*init.CpuFlags | CPUFlag(C.CPU_FORCE))
-	}
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_ssim,
-			param: unsafe.Pointer(&C.xvid_plugin_ssim_t{
-				b_printstat: cbool(init.PrintStats),
-				stat_path:   filename,
-				acc:         C.int(init.Accuracy),
-				cpu_flags:   cpuFlags,
-			}),
-		},
-		destroyFree: func() {
-			if filename != nil {
-				C.free(unsafe.Pointer(filename))
-			}
-		},
-	}
+// IsVOL returns whether the frame is a metadata (VOL) frame, with StatsVOL set.
+func (s DecoderStats) IsVOL() bool {
+	return s.StatsVOL != nil
 }
 
-// PluginPSNRHVSM returns an instance of a plugin that writes PSNRHVSM values
-// to the standard output.
-func PluginPSNRHVSM() Plugin {
-	return pluginInternal{
-		cPlugin: C.xvid_enc_plugin_t{
-			_func: &C.xvid_plugin_psnrhvsm,
-			param: nil,
-		},
+// IsFrame returns whether the frame is an actual frame, with StatsFrame set.
+func (s DecoderStats) IsFrame() bool {
+	return s.StatsFrame != nil
+}
+
+// Dimensions returns the frame width and height in pixels: the VOL dimensions for metadata (VOL) frames, and
+// the dimensions of the decoder (Decoder.Width and Decoder.Height) when the frame was decoded for actual frames.
+func (s DecoderStats) Dimensions() (int, int) {
+	if s.StatsVOL != nil {
+		return s.StatsVOL.Width, s.StatsVOL.Height
 	}
+	return s.width, s.height
 }
 
-// PluginInit stores general information for an encoder, used for reading by plugins
-// in their Init callback.
-type PluginInit struct {
-	// encoder bitrate zones, that enforce a specific parameter for a range of frames; must be sorted in increasing frame start order
-	Zones []EncoderZone
+var decoderStatsNothing = DecoderStats{FrameType: frameTypeNothing}
+
+// DecoderStatsVOL is information specific to a metadata pseudo-frame, returned by Decoder.Decode in DecoderStats.
+type DecoderStatsVOL struct {
+	// whether the frame is interlaced
+	Interlacing bool
 	// frame width in pixels
 	Width int
 	// frame height in pixels
 	Height int
-	// frame width in macro blocks
-	WidthMacroBlocks int
-	// frame height in macro blocks
-	HeightMacroBlocks int
-	// framerate; Numerator=0 means variable framerate
-	FrameRate Fraction
+	// frame pixel aspect ratio
+	PixelAspectRatio PixelAspectRatio
 }
 
-// PluginClose stores information for an encoding session, used for reading by plugins
-// in their Close callback.
-type PluginClose struct {
+// DecoderStatsFrame is information specific to an actual non-metadata non-empty frame, returned by Decoder.Decode in DecoderStats.
+//
+// The macroblock motion vectors are not available: xvidcore does not export the decoded motion vectors, and
+// DebugMotionVectors only prints them to the debug output. The per-macroblock tables that are available, like the
+// quantizers, are laid out in rows of macroblocks, see QuantizerAt and QuantizerGrid.
+type DecoderStatsFrame struct {
+	// valid only for interlaced frames (see DecoderStatsVOL.Interlacing), whether the interlacing is upper field first
+	UpperFieldFirst bool
+	// macroblock quantizers table (one quantizer per macroblock), can be nil
+	Quantizers []int32
+	// quantizers table stride (equal to the count of macroblocks in a line)
+	QuantizersStride int
+	// macroblock coding modes table (one mode per macroblock), only set if DecoderFrame.MacroblockTypes was set;
+	// xvidcore does not export per-macroblock coding modes, so the modes are only known for I frames
+	// (all MBTypeIntra), all macroblocks of other frame types are MBTypeUnknown
+	MacroblockTypes []MBType
+	// macroblock coding modes table stride (equal to the count of macroblocks in a line)
+	MacroblockTypesStride int
+	// presentation time of the frame, computed from the time codes of the stream (VOL time resolution, GOV time codes
+	// and VOP time increments), for both constant and variable framerate streams; 0 if the stream does not
+	// carry time codes (e.g. if its VOL was not decoded)
+	PresentationTime time.Duration
+	// PSNR in dB of each component of the output image (e.g. Y, U, V for ColorSpacePlanar) compared to the
+	// corresponding reference frame, +Inf for identical components; nil if DecoderInit.Reference is not set
+	PSNR []float64
+	// whether the frame could not be decoded, and is a copy of the last good frame (see DecoderFrame.ConcealErrors)
+	Concealed bool
+
+	// TimeBase and TimeImplement are currently unimplemented in libxvidcore
+	// TimeIncrement is useless without access to vop_time_increment_resolution
+	// TimeBase int
+	// TimeIncrement int
+}
+
+// QuantizerAt returns the quantizer of the macroblock at column mbX and row mbY (in macroblocks), and false if
+// the coordinates are out of bounds or if the quantizers table is not available.
+func (s *DecoderStatsFrame) QuantizerAt(mbX int, mbY int) (int32, bool) {
+	if s.QuantizersStride <= 0 || mbX < 0 || mbX >= s.QuantizersStride || mbY < 0 {
+		return 0, false
+	}
+	i := mbY*s.QuantizersStride + mbX
+	if i >= len(s.Quantizers) {
+		return 0, false
+	}
+	return s.Quantizers[i], true
+}
+
+// QuantizerGrid returns the quantizers table reshaped as rows of macroblocks, indexed as [mbY][mbX], or nil if
+// the quantizers table is not available. The rows alias the Quantizers slice.
+func (s *DecoderStatsFrame) QuantizerGrid() [][]int32 {
+	if s.QuantizersStride <= 0 || len(s.Quantizers) == 0 {
+		return nil
+	}
+	grid := make([][]int32, len(s.Quantizers)/s.QuantizersStride)
+	for y := range grid {
+		grid[y] = s.Quantizers[y*s.QuantizersStride : (y+1)*s.QuantizersStride]
+	}
+	return grid
+}
+
+// NewDecoder creates a new Decoder based on a DecoderInit configuration. Init (or InitWithFlags) must be called once before calling this function.
+// Once created and finished using, a Decoder must be freed by calling Decoder.Close(); as a safety net, a Decoder
+// that was not closed is closed when it is garbage collected.
+// The Decoder is non-nil if and only if the returned error is nil.
+// An internal error can be returned by Xvid, in which case the Decoder won't be created.
+func NewDecoder(init DecoderInit) (*Decoder, error) {
+	if init.Width < 0 || init.Height < 0 {
+		return nil, fmt.Errorf("xvid: invalid dimensions %dx%d", init.Width, init.Height)
+	}
+	if err := checkFourCC(init.FourCC); err != nil {
+		return nil, err
+	}
+	bufferSize := defaultDecoderBufferSize
+	if init.BufferSize != 0 {
+		if init.BufferSize < minDecoderBufferSize || init.BufferSize%8 != 0 {
+			return nil, fmt.Errorf("xvid: invalid buffer size %d, must be a multiple of 8 of at least %d", init.BufferSize, minDecoderBufferSize)
+		}
+		bufferSize = init.BufferSize
+	}
+	cDecoreCreate := C.xvid_dec_create_t{
+		version:     C.XVID_VERSION,
+		width:       C.int(init.Width),
+		height:      C.int(init.Height),
+		fourcc:      C.int(init.FourCC),
+		num_threads: C.int(acquireThreads(init.NumThreads)),
+	}
+	if code := C.xvid_decore(nil, C.XVID_DEC_CREATE, unsafe.Pointer(&cDecoreCreate), nil); code != 0 {
+		releaseThreads(int(cDecoreCreate.num_threads))
+		return nil, xvidErr(code)
+	}
+	var buf []byte
+	if init.Input != nil {
+		buf = make([]byte, bufferSize)
+	}
+	d := &Decoder{
+		handle: cDecoreCreate.handle,
+		Width:  init.Width,
+		Height: init.Height,
+		r:      init.Input,
+		buf:    buf,
+		i:      -1,
+
+		threads:         int(cDecoreCreate.num_threads),
+		reference:       init.Reference,
+		fixedDimensions: init.Width > 0 && init.Height > 0,
+	}
+	runtime.SetFinalizer(d, (*Decoder).finalize)
+	return d, nil
+}
+
+// finalize closes a Decoder that was garbage collected without being closed, to free its native decoder
+func (d *Decoder) finalize() {
+	if d.closed {
+		return
+	}
+	warnNotClosed("Decoder")
+	d.Close()
+}
+
+// NewDecoderBytes creates a new Decoder like NewDecoder, decoding the raw Xvid stream in data, which is read
+// directly instead of being copied to an internal buffer; init.Input is ignored. Only the data of the last frame
+// is copied, to a zero-padded buffer, since xvidcore reads (up to 8 bytes) past the end of its input and only
+// accepts inputs of a multiple of 8 bytes.
+// data must not be modified until the Decoder is closed.
+func NewDecoderBytes(data []byte, init DecoderInit) (*Decoder, error) {
+	init.Input = nil
+	d, err := NewDecoder(init)
+	if err != nil {
+		return nil, err
+	}
+	d.fromBytes = true
+	d.buf = data
+	d.n = len(data)
+	d.i = 0
+	d.eof = true
+	// the data is copied once the decoder reaches the last VOP, i.e. once it is past the VOP preceding it
+	d.tail = 0
+	vop := []byte{0, 0, 1, 0xb6}
+	if last := bytes.LastIndex(data, vop); last > 0 {
+		if previous := bytes.LastIndex(data[:last], vop); previous >= 0 {
+			d.tail = previous + 1
+		}
+	}
+	return d, nil
+}
+
+// Decode decodes a single non-empty frame (either metadata (VOL) or an actual frame) from the encoded Xvid stream.
+//
+// Decode returns an int, which is the length in bytes of the frame that was read. Decode might buffer up data from
+// its Reader so the returned value might be less than the actual data read.
+//
+// Decode returns a DecoderStats, which stores information about the decoded frame,
+// which can be either a VOL (metadata), or an actual frame. If Decoder returns a non-nil error,
+// DecoderStats in invalid.
+//
+// Decode returns an error, which if it is not nil can be either io.EOF or another error.
+// If it is io.EOF, this is an expected value which means that the entire stream has been decoded.
+// Otherwise, it is an unexpected value, which can be due to invalid images, reader i/o errors, or internal
+// Xvid errors.
+//
+// In any case, the Decoder should not be used after any error and Decode will always return
+// the same error after an error occurs. The Decoder must still be closed with Close.
+func (d *Decoder) Decode(frame DecoderFrame) (int, DecoderStats, error) {
+	if d.closed {
+		return 0, decoderStatsNothing, errors.New("xvid: decoder is closed")
+	}
+	if d.r == nil && !d.fromBytes {
+		return 0, decoderStatsNothing, errors.New("xvid: Input Reader is nil, must be passed in Init")
+	}
+
+	if d.err != nil {
+		return 0, decoderStatsNothing, d.err
+	}
+
+	if d.i == -1 { // initial read burst
+		d.i = 0
+		r, err := io.ReadFull(d.r, d.buf[d.n:])
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				d.eof = true
+			} else {
+				d.err = err
+				return 0, decoderStatsNothing, d.err
+			}
+		}
+		d.n += r
+	}
+
+	total := 0
+	needData := false
+	for { // read at least one non-nothing frame
+		if d.eof && d.n-d.i <= 1 { // no bytes remaining: flush decoder
+			r, stats, err := d.decodeBuffer(frame, nil)
+			d.i += r
+			total += r
+			if err != nil {
+				if e, ok := err.(*Error); ok && e.code == C.XVID_ERR_END {
+					d.err = io.EOF
+				} else {
+					d.err = err
+				}
+				return 0, decoderStatsNothing, d.err
+			}
+			if stats.FrameType == frameTypeNothing {
+				continue
+			}
+			if stats.StatsFrame != nil {
+				stats.StatsFrame.PresentationTime = d.timeCodes.next()
+			}
+			if err := d.compareReference(frame, stats); err != nil {
+				d.err = err
+				return 0, decoderStatsNothing, d.err
+			}
+			stats.UserData = d.userData
+			d.userData = nil
+			stats.width, stats.height = d.Width, d.Height
+			return total, stats, nil
+		}
+
+		if !d.eof && (needData || d.i > len(d.buf)/2) {
+			needData = false
+			if d.i == 0 && d.n == len(d.buf) { // a single frame is larger than the buffer: grow it
+				buf := make([]byte, 2*len(d.buf))
+				copy(buf, d.buf[:d.n])
+				d.buf = buf
+			}
+			copy(d.buf[:d.n-d.i], d.buf[d.i:d.n])
+			d.n = d.n - d.i
+			d.i = 0
+			r, err := io.ReadFull(d.r, d.buf[d.n:])
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					d.eof = true
+				} else {
+					d.err = err
+					return 0, decoderStatsNothing, d.err
+				}
+			}
+			d.n += r
+		}
+		if d.fromBytes && d.tail >= 0 && d.i >= d.tail {
+			d.copyTail()
+		}
+		r, stats, err := d.decodeBuffer(frame, d.buf[d.i:d.n])
+		if err != nil && frame.ConcealErrors && d.concealFrame != nil {
+			r = d.conceal(frame.Output)
+			// the skipped data still carries the time code and user data of the lost frame
+			d.timeCodes.parse(d.buf[d.i : d.i+r])
+			d.userData = append(d.userData, parseUserData(d.buf[d.i:d.i+r])...)
+			d.i += r
+			total += r
+			concealFrame := *d.concealFrame
+			concealFrame.PresentationTime = d.timeCodes.next()
+			userData := d.userData
+			d.userData = nil
+			return total, DecoderStats{
+				FrameType:  FrameTypeP,
+				StatsFrame: &concealFrame,
+				UserData:   userData,
+				width:      d.Width,
+				height:     d.Height,
+			}, nil
+		}
+		if err != nil {
+			d.err = err
+			return 0, decoderStatsNothing, d.err
+		}
+		if d.i+r > d.n { // read past buffer limit... abort decoding
+			d.err = errors.New("xvid: read past buffer limit, should not happen")
+			return 0, decoderStatsNothing, d.err
+		}
+		d.timeCodes.parse(d.buf[d.i : d.i+r])
+		d.userData = append(d.userData, parseUserData(d.buf[d.i:d.i+r])...)
+		d.i += r
+		total += r
+		if stats.FrameType != frameTypeNothing {
+			if stats.StatsFrame != nil {
+				stats.StatsFrame.PresentationTime = d.timeCodes.next()
+			}
+			if err := d.compareReference(frame, stats); err != nil {
+				d.err = err
+				return 0, decoderStatsNothing, d.err
+			}
+			if frame.ConcealErrors && stats.StatsFrame != nil {
+				d.saveConcealment(frame.Output, stats.StatsFrame)
+			}
+			stats.UserData = d.userData
+			d.userData = nil
+			stats.width, stats.height = d.Width, d.Height
+			return total, stats, nil
+		}
+		if r == 0 { // the decoder needs more data
+			if d.eof { // the remaining bytes cannot form a frame: flush decoder
+				d.i = d.n
+			}
+			needData = true
+		}
+	}
+}
+
+// copyTail copies the remaining data of a NewDecoderBytes stream to a buffer padded with zeros, to a multiple of
+// 8 bytes followed by 8 more bytes
+func (d *Decoder) copyTail() {
+	remaining := d.n - d.i
+	n := remaining
+	if n%8 != 0 {
+		n += 8 - n%8
+	}
+	buf := make([]byte, n+8)
+	copy(buf, d.buf[d.i:d.n])
+	d.buf = buf
+	d.i = 0
+	d.n = n
+	d.tail = -1
+}
+
+// saveConcealment copies the last good decoded frame, to be output instead of the next frames that cannot be decoded
+// the copy is made for every frame decoded with ConcealErrors, since the caller can overwrite the output afterwards;
+// the buffers of the copy are reused across frames
+func (d *Decoder) saveConcealment(output *Image, stats *DecoderStatsFrame) {
+	d.concealImage.Colorspace = output.Colorspace
+	d.concealImage.VerticalFlip = output.VerticalFlip
+	d.concealImage.Strides = append(d.concealImage.Strides[:0], output.Strides...)
+	if len(d.concealImage.Planes) != len(output.Planes) {
+		d.concealImage.Planes = make([][]byte, len(output.Planes))
+	}
+	for j, plane := range output.Planes {
+		d.concealImage.Planes[j] = append(d.concealImage.Planes[j][:0], plane...)
+	}
+	concealFrame := *stats
+	concealFrame.Concealed = true
+	d.concealFrame = &concealFrame
+}
+
+// conceal outputs the last good decoded frame instead of the frame that could not be decoded, skips the data up to
+// the next VOP start code, and returns the number of bytes skipped
+func (d *Decoder) conceal(output *Image) int {
+	fits := output.Colorspace.value != ColorSpaceInternal.value && len(output.Planes) == len(d.concealImage.Planes) &&
+		len(output.Strides) == len(d.concealImage.Strides)
+	for j := 0; fits && j < len(output.Strides); j++ {
+		fits = output.Strides[j] == d.concealImage.Strides[j]
+	}
+	for j := 0; fits && j < len(output.Planes); j++ {
+		fits = len(output.Planes[j]) >= len(d.concealImage.Planes[j])
+	}
+	if fits {
+		for j, plane := range d.concealImage.Planes {
+			copy(output.Planes[j], plane)
+		}
+	} else {
+		output.Colorspace = d.concealImage.Colorspace
+		output.VerticalFlip = d.concealImage.VerticalFlip
+		output.Strides = append([]int(nil), d.concealImage.Strides...)
+		output.Planes = make([][]byte, len(d.concealImage.Planes))
+		for j, plane := range d.concealImage.Planes {
+			output.Planes[j] = append([]byte(nil), plane...)
+		}
+	}
+	data := d.buf[d.i:d.n]
+	for i := 1; i+4 <= len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && data[i+3] == 0xb6 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// DecodeGray decodes a single non-empty frame like Decode, and returns the decoded image of actual frames
+// (nil for metadata (VOL) frames), which is an *image.Gray containing only the luma if the frame is greyscale
+// (e.g. encoded with VOPGreyscale), and an *image.YCbCr otherwise.
+//
+// The frame Output is ignored: the frame is decoded to the internal decoder buffers (see ColorSpaceInternal),
+// from which only the luma is copied for greyscale frames, skipping any chroma conversion. A frame is greyscale
+// if its chroma is neutral (all chroma samples are 128), which is detected for each frame, so that streams with
+// chroma are still decoded correctly.
+//
+// The returned image is newly allocated and can be retained. See Decode for the other return values.
+func (d *Decoder) DecodeGray(frame DecoderFrame) (int, DecoderStats, image.Image, error) {
+	output := Image{Colorspace: ColorSpaceInternal}
+	frame.Output = &output
+	n, stats, err := d.Decode(frame)
+	if err != nil || stats.StatsFrame == nil {
+		return n, stats, nil, err
+	}
+	rect := image.Rect(0, 0, d.Width, d.Height)
+	cw, ch := ColorSpaceInternal.planeSize(1, d.Width, d.Height)
+	greyscale := true
+	for j := 1; j < 3 && greyscale; j++ {
+		for y := 0; y < ch && greyscale; y++ {
+			for _, v := range output.Planes[j][y*output.Strides[1] : y*output.Strides[1]+cw] {
+				if v != 128 {
+					greyscale = false
+					break
+				}
+			}
+		}
+	}
+	if greyscale {
+		gray := image.NewGray(rect)
+		for y := 0; y < d.Height; y++ {
+			copy(gray.Pix[y*gray.Stride:y*gray.Stride+d.Width], output.Planes[0][y*output.Strides[0]:])
+		}
+		return n, stats, gray, nil
+	}
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	for y := 0; y < d.Height; y++ {
+		copy(ycbcr.Y[y*ycbcr.YStride:y*ycbcr.YStride+d.Width], output.Planes[0][y*output.Strides[0]:])
+	}
+	for y := 0; y < ch; y++ {
+		copy(ycbcr.Cb[y*ycbcr.CStride:y*ycbcr.CStride+cw], output.Planes[1][y*output.Strides[1]:])
+		copy(ycbcr.Cr[y*ycbcr.CStride:y*ycbcr.CStride+cw], output.Planes[2][y*output.Strides[1]:])
+	}
+	return n, stats, ycbcr, nil
+}
+
+// DecodeN decodes up to n actual (non-VOL) frames, skipping the metadata (VOL) frames, and returns the decoded
+// images with their stats. Each image is newly allocated with the Colorspace and VerticalFlip of template (whose
+// Planes and Strides are ignored), so that it can be retained; ColorSpaceInternal is not supported.
+//
+// The decoder is left positioned after the last returned frame, so that DecodeN can be called again to decode
+// the next frames. If the stream ends before n frames are decoded, the decoded frames are returned with io.EOF.
+// On other errors, the frames decoded before the error are returned with the error.
+func (d *Decoder) DecodeN(n int, template Image) ([]Image, []DecoderStatsFrame, error) {
+	if template.Colorspace.value == ColorSpaceInternal.value {
+		return nil, nil, errors.New("xvid: invalid color space for DecodeN, must not be ColorSpaceInternal")
+	}
+	if n < 0 {
+		return nil, nil, fmt.Errorf("xvid: invalid negative frame count %d", n)
+	}
+	images := make([]Image, 0, n)
+	stats := make([]DecoderStatsFrame, 0, n)
+	for len(images) < n {
+		output := Image{
+			Colorspace:   template.Colorspace,
+			VerticalFlip: template.VerticalFlip,
+		}
+		_, s, err := d.Decode(DecoderFrame{
+			Output: &output,
+		})
+		if err != nil {
+			return images, stats, err
+		}
+		if s.StatsFrame == nil {
+			continue
+		}
+		images = append(images, output)
+		stats = append(stats, *s.StatsFrame)
+	}
+	return images, stats, nil
+}
+
+// DecodedFrame is an actual (non-VOL) frame decoded by Decoder.DecodeAll.
+type DecodedFrame struct {
+	// decoded image, with its own planes so that it can be retained
+	Image Image
+	// stats of the frame; the UserData of the metadata (VOL) frames preceding the frame is prepended to its UserData
+	Stats DecoderStats
+	// index of the frame in the decoded frames, starting at 0
+	Index int
+	// metadata of the last VOL preceding the frame since the previous frame, nil if none
+	VOL *DecoderStatsVOL
+}
+
+// DecodeAll decodes all the remaining frames of the stream to newly allocated images of the colorspace, until the end
+// of the stream, and returns them. The metadata (VOL) frames are not returned but attached to the following frame,
+// see DecodedFrame; ColorSpaceInternal is not supported.
+//
+// DecodeAll is intended for short streams, as all the decoded frames are kept in memory. On errors other than the
+// end of the stream, the frames decoded before the error are returned with the error.
+func (d *Decoder) DecodeAll(colorspace ColorSpace) ([]DecodedFrame, error) {
+	if colorspace.value == ColorSpaceInternal.value {
+		return nil, errors.New("xvid: invalid color space for DecodeAll, must not be ColorSpaceInternal")
+	}
+	var frames []DecodedFrame
+	var vol *DecoderStatsVOL
+	var userData []string
+	for {
+		// a new image for each frame: the decoder allocates its planes, so that they are not reused
+		output := Image{
+			Colorspace: colorspace,
+		}
+		_, stats, err := d.Decode(DecoderFrame{
+			Output: &output,
+		})
+		if err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return frames, err
+		}
+		if stats.StatsVOL != nil {
+			vol = stats.StatsVOL
+			userData = append(userData, stats.UserData...)
+			continue
+		}
+		if stats.StatsFrame == nil {
+			continue
+		}
+		stats.UserData = append(userData, stats.UserData...)
+		frames = append(frames, DecodedFrame{
+			Image: output,
+			Stats: stats,
+			Index: len(frames),
+			VOL:   vol,
+		})
+		vol = nil
+		userData = nil
+	}
+}
+
+// Thumbnail decodes the frame of a raw Xvid stream displayed at a given time, for a constant frame rate fps
+// (in frames per second, e.g. Fraction{25, 1}), and returns it as an *image.RGBA.
+//
+// The frames are counted in display order, which differs from the coding order for streams with B-frames.
+// The stream is first scanned (without decoding) up to the target frame, to find the key frame preceding it in
+// coding order, or the key frame before that one if the target frame is a B-frame displayed before that key frame
+// (and predicted from the preceding GOP); the stream header is then decoded, followed by the frames from that key
+// frame to the target frame, with ColorSpaceNoOutput for the frames displayed before the target frame. This assumes
+// that only the B-frames directly following a key frame reference the frames preceding it, which is the case
+// for the streams encoded by Xvid.
+// Init (or InitWithFlags) must be called once before calling this function.
+// An error is returned if the time is past the end of the stream, or on decoding or i/o errors.
+func Thumbnail(r io.ReadSeeker, at time.Duration, fps Fraction) (image.Image, error) {
+	if fps.Numerator <= 0 || fps.Denominator <= 0 {
+		return nil, fmt.Errorf("xvid: invalid frame rate %d/%d", fps.Numerator, fps.Denominator)
+	}
+	if at < 0 {
+		return nil, fmt.Errorf("xvid: invalid negative time %v", at)
+	}
+	target := int(int64(at) * int64(fps.Numerator) / (int64(fps.Denominator) * int64(time.Second)))
+
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	// scan the VOP start codes: the stream header is the data before the first VOP
+	var header []byte
+	headerDone := false
+	// display index of each frame, indexed by coding order; -1 until known
+	var display []int
+	// number of frames with a known display index
+	displayed := 0
+	// coding index of the last reference (I/P/S) frame, which is displayed after the B-frames that follow it
+	reference := -1
+	// coding indexes of the key frames, and offsets of their VOP relative to start
+	var keyFrames []int
+	var keyFrameOffsets []int64
+	// last 4 bytes read
+	var window uint32 = 0xffffffff
+	// whether the next byte is the start of a VOP
+	vopType := false
+	var offset int64
+	buf := make([]byte, 64*1024)
+scan:
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			if vopType {
+				vopType = false
+				i := len(display)
+				display = append(display, -1)
+				if c>>6 == 2 { // B-VOP
+					display[i] = displayed
+					displayed++
+				} else {
+					if c>>6 == 0 { // I-VOP
+						keyFrames = append(keyFrames, i)
+						keyFrameOffsets = append(keyFrameOffsets, offset-4)
+					}
+					if reference >= 0 {
+						display[reference] = displayed
+						displayed++
+					}
+					reference = i
+				}
+				if displayed > target {
+					break scan
+				}
+			}
+			window = window<<8 | uint32(c)
+			offset++
+			if window == 0x000001b6 {
+				vopType = true
+				if !headerDone {
+					header = header[:len(header)-3]
+					headerDone = true
+				}
+			} else if !headerDone {
+				header = append(header, c)
+			}
+		}
+		if err == io.EOF {
+			if reference >= 0 {
+				display[reference] = displayed
+				displayed++
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if displayed <= target {
+		return nil, fmt.Errorf("xvid: time %v is past the end of the stream (%d frames)", at, displayed)
+	}
+	coded := 0
+	for display[coded] != target {
+		coded++
+	}
+	k := len(keyFrames) - 1
+	for k >= 0 && keyFrames[k] > coded {
+		k--
+	}
+	if k < 0 {
+		return nil, errors.New("xvid: no key frame found before the target frame")
+	}
+	if display[coded] < display[keyFrames[k]] && k > 0 {
+		// B-frame predicted from the preceding GOP
+		k--
+	}
+	// the decoder returns the frames from the key frame in display order: skip those displayed before the target
+	skip := 0
+	for _, d := range display[keyFrames[k]:] {
+		if d >= 0 && d < target {
+			skip++
+		}
+	}
+
+	if _, err := r.Seek(start+keyFrameOffsets[k], io.SeekStart); err != nil {
+		return nil, err
+	}
+	decoder, err := NewDecoder(DecoderInit{
+		Input: io.MultiReader(bytes.NewReader(header), r),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	skipped := Image{Colorspace: ColorSpaceNoOutput}
+	output := Image{Colorspace: ColorSpaceRGBA}
+	for i := 0; ; {
+		frame := DecoderFrame{Output: &skipped}
+		if i == skip {
+			frame.Output = &output
+		}
+		_, stats, err := decoder.Decode(frame)
+		if err == io.EOF {
+			return nil, fmt.Errorf("xvid: time %v is past the end of the stream", at)
+		} else if err != nil {
+			return nil, err
+		}
+		if stats.StatsVOL != nil {
+			continue
+		}
+		if i == skip {
+			break
+		}
+		i++
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, decoder.Width, decoder.Height))
+	for y := 0; y < decoder.Height; y++ {
+		copy(rgba.Pix[y*rgba.Stride:y*rgba.Stride+decoder.Width*4], output.Planes[0][y*output.Strides[0]:])
+	}
+	return rgba, nil
+}
+
+// parseUserData returns the user_data strings of encoded data
+func parseUserData(data []byte) []string {
+	var userData []string
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 || data[i+3] != 0xb2 {
+			continue
+		}
+		start := i + 4
+		end := start
+		for end < len(data) && !(end+3 <= len(data) && data[end] == 0 && data[end+1] == 0 && data[end+2] == 1) {
+			end++
+		}
+		i = end - 1
+		// zero stuffing before the next start code
+		for end > start && data[end-1] == 0 {
+			end--
+		}
+		userData = append(userData, string(data[start:end]))
+	}
+	return userData
+}
+
+// bitReader reads big-endian bit fields from a buffer
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+// read reads an n-bit field (n <= 32); returns false if the buffer is too short
+func (b *bitReader) read(n int) (uint32, bool) {
+	if b.pos+n > len(b.buf)*8 {
+		return 0, false
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(b.buf[b.pos/8]>>(7-uint(b.pos%8))&1)
+		b.pos++
+	}
+	return v, true
+}
+
+// maximum number of presentation times of frames read but not returned yet, more than the frames buffered by Xvid
+const maxPendingTimeCodes = 16
+
+// timeCodeParser computes the presentation time of the frames of a stream from its VOL, GOV and VOP headers
+type timeCodeParser struct {
+	// vop_time_increment_resolution of the last VOL, 0 if no VOL was read
+	resolution int
+	// time base in seconds of the last I/P VOP and of the one before it
+	timeBase     int64
+	lastTimeBase int64
+	// presentation times of the frames read but not returned yet, sorted
+	pending []time.Duration
+}
+
+// parse reads the headers found in data, which contains a part of the stream
+func (p *timeCodeParser) parse(data []byte) {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		code := data[i+3]
+		b := bitReader{buf: data[i+4:]}
+		switch {
+		case code >= 0x20 && code <= 0x2f:
+			p.parseVOL(&b)
+		case code == 0xb3:
+			p.parseGOV(&b)
+		case code == 0xb6:
+			p.parseVOP(&b)
+		}
+		i += 3
+	}
+}
+
+func (p *timeCodeParser) parseVOL(b *bitReader) {
+	b.read(1) // random_accessible_vol
+	b.read(8) // video_object_type_indication
+	verid := uint32(1)
+	if v, _ := b.read(1); v == 1 { // is_object_layer_identifier
+		verid, _ = b.read(4)
+		b.read(3) // video_object_layer_priority
+	}
+	if v, _ := b.read(4); v == 15 { // aspect_ratio_info: extended PAR
+		b.read(16)
+	}
+	if v, _ := b.read(1); v == 1 { // vol_control_parameters
+		// chroma_format, low_delay
+		b.read(3)
+		if v, _ := b.read(1); v == 1 { // vbv_parameters
+			b.read(79)
+		}
+	}
+	shape, _ := b.read(2)
+	if shape == 3 && verid != 1 { // grayscale shape
+		b.read(4)
+	}
+	b.read(1) // marker
+	if resolution, ok := b.read(16); ok && resolution > 0 {
+		p.resolution = int(resolution)
+	}
+}
+
+func (p *timeCodeParser) parseGOV(b *bitReader) {
+	hours, _ := b.read(5)
+	minutes, _ := b.read(6)
+	b.read(1) // marker
+	if seconds, ok := b.read(6); ok {
+		p.timeBase = int64(hours)*3600 + int64(minutes)*60 + int64(seconds)
+	}
+}
+
+func (p *timeCodeParser) parseVOP(b *bitReader) {
+	if p.resolution == 0 {
+		return
+	}
+	codingType, _ := b.read(2)
+	var modulo int64
+	for {
+		v, ok := b.read(1)
+		if !ok {
+			return
+		}
+		if v == 0 {
+			break
+		}
+		modulo++
+	}
+	b.read(1) // marker
+	bits := 1
+	for 1<<uint(bits) < p.resolution {
+		bits++
+	}
+	increment, ok := b.read(bits)
+	if !ok {
+		return
+	}
+	var seconds int64
+	if codingType == 2 { // B-VOP: relative to the time base of the previous I/P VOP
+		seconds = p.lastTimeBase + modulo
+	} else {
+		p.lastTimeBase = p.timeBase
+		p.timeBase += modulo
+		seconds = p.timeBase
+	}
+	t := time.Duration(seconds)*time.Second + time.Duration(int64(increment)*int64(time.Second)/int64(p.resolution))
+	if len(p.pending) >= maxPendingTimeCodes {
+		// more VOPs read than frames returned (e.g. VOPs not decoded as frames): drop the oldest, so that the
+		// memory used does not grow with the stream length
+		p.pending = append(p.pending[:0], p.pending[1:]...)
+	}
+	// frames are returned in display order, i.e. in increasing presentation time
+	i := len(p.pending)
+	for i > 0 && p.pending[i-1] > t {
+		i--
+	}
+	p.pending = append(p.pending, 0)
+	copy(p.pending[i+1:], p.pending[i:])
+	p.pending[i] = t
+}
+
+// next returns the presentation time of the next returned frame, or 0 if unknown
+func (p *timeCodeParser) next() time.Duration {
+	if len(p.pending) == 0 {
+		return 0
+	}
+	t := p.pending[0]
+	p.pending = p.pending[1:]
+	return t
+}
+
+// compareReference decodes the next frame of the reference Decoder, if any, and stores
+// the PSNR of the decoded frame compared to it in its stats
+func (d *Decoder) compareReference(frame DecoderFrame, stats DecoderStats) error {
+	if d.reference == nil || stats.StatsFrame == nil {
+		return nil
+	}
+	if frame.Output.Colorspace.value == ColorSpaceNoOutput.value {
+		return errors.New("xvid: comparing with a reference requires an output color space, got ColorSpaceNoOutput")
+	}
+	if d.referenceImage.Colorspace.value != frame.Output.Colorspace.value {
+		d.referenceImage = Image{Colorspace: frame.Output.Colorspace}
+	}
+	d.referenceImage.VerticalFlip = frame.Output.VerticalFlip
+	for {
+		_, referenceStats, err := d.reference.Decode(DecoderFrame{
+			Output:      &d.referenceImage,
+			DecodeFlags: frame.DecodeFlags,
+		})
+		if err == io.EOF {
+			return errors.New("xvid: reference stream ended before the decoded stream")
+		} else if err != nil {
+			return fmt.Errorf("xvid: decoding reference stream: %v", err)
+		}
+		if referenceStats.StatsFrame != nil {
+			break
+		}
+	}
+	if d.reference.Width != d.Width || d.reference.Height != d.Height {
+		return fmt.Errorf("xvid: reference frame dimensions %dx%d differ from decoded frame dimensions %dx%d", d.reference.Width, d.reference.Height, d.Width, d.Height)
+	}
+	stats.StatsFrame.PSNR = imagePSNR(frame.Output, &d.referenceImage, d.Width, d.Height)
+	return nil
+}
+
+// DecodeFrameBytes decodes one (possibly empty) frame from input, and returns the number of bytes of input that were
+// consumed. It is a low-level alternative to Decode for callers that already have the frame data, e.g. the frame
+// payloads of a container demuxer, and must not be mixed with Decode on the same Decoder. The Input of the
+// DecoderInit is not used and can be nil.
+//
+// The decoder might consume only part of input, in which case DecodeFrameBytes should be called again with the rest
+// of input. If no error is returned and the consumed length is 0, the decoder needs more data: call
+// DecodeFrameBytes again with input extended with the next data. The returned stats FrameType is not a valid frame
+// type (neither FrameTypeVOL nor an actual frame type) when no frame was decoded from the data consumed, in which
+// case the stats StatsVOL and StatsFrame are nil.
+//
+// At the end of the stream, call DecodeFrameBytes with a nil input repeatedly to flush the frames buffered by the
+// decoder (e.g. the last frame when the stream has B-frames), until io.EOF is returned.
+//
+// The decoder reads its input by blocks of 8 bytes, and up to 8 bytes past its end: input is always copied to an
+// internal buffer (reused across calls) padded with zeros, so that input needs no extra capacity. The user data of the data consumed is
+// returned in the stats UserData; unlike Decode, the frame PresentationTime is not set, DecoderInit.Reference is
+// not used and DecoderFrame.ConcealErrors is ignored.
+func (d *Decoder) DecodeFrameBytes(frame DecoderFrame, input []byte) (int, DecoderStats, error) {
+	if d.closed {
+		return 0, decoderStatsNothing, errors.New("xvid: decoder is closed")
+	}
+	var data []byte
+	if input != nil {
+		n := len(input)
+		if n%8 != 0 {
+			n += 8 - n%8
+		}
+		if cap(d.scratch) < n+8 {
+			d.scratch = make([]byte, n+8)
+		}
+		// extra zeros past the padded length, as the decoder might read past it
+		d.scratch = d.scratch[:n+8]
+		copy(d.scratch, input)
+		for i := len(input); i < len(d.scratch); i++ {
+			d.scratch[i] = 0
+		}
+		data = d.scratch[:n]
+	}
+	r, stats, err := d.decodeBuffer(frame, data)
+	if endErr, ok := err.(*Error); ok && endErr.code == C.XVID_ERR_END {
+		return 0, decoderStatsNothing, io.EOF
+	} else if err != nil {
+		return 0, decoderStatsNothing, err
+	}
+	if r > len(input) {
+		r = len(input)
+	}
+	stats.UserData = parseUserData(input[:r])
+	stats.width, stats.height = d.Width, d.Height
+	return r, stats, nil
+}
+
+// decodes one (possibly empty) frame from the input buffer
+// this low-level method should not be used directly, use Decode (or DecodeFrameBytes) instead to automatically handle data buffering
+// no error and int=0 means the decoder needs more data
+// at the end of the stream call with input=nil to flush decoder
+// due to implementation quirks the buffer length will be reduced to the nearest length multiple of 8 below the buffer length
+// due to implementation quirks the decoder might read more data past the buffer end if the buffer is small and only contains part of a frame
+func (d *Decoder) decodeBuffer(frame DecoderFrame, input []byte) (int, DecoderStats, error) {
+	if frame.KeyFramesOnly && frame.Output.Colorspace.value != ColorSpaceInternal.value && frame.Output.Colorspace.value != ColorSpaceNoOutput.value {
+		// decode to the internal decoder buffers, then convert only the key frames
+		output := frame.Output
+		internal := Image{Colorspace: ColorSpaceInternal}
+		frame.Output = &internal
+		frame.KeyFramesOnly = false
+		n, stats, err := d.decodeBuffer(frame, input)
+		if err != nil || stats.StatsFrame == nil || stats.FrameType != FrameTypeI {
+			return n, stats, err
+		}
+		internal.Colorspace = ColorSpacePlanar
+		if err := Convert(internal, output, d.Width, d.Height, d.interlacing); err != nil {
+			return 0, DecoderStats{FrameType: frameTypeNothing}, err
+		}
+		return n, stats, nil
+	}
+	if frame.Output.Colorspace.value == colorSpaceGray {
+		// decode to the internal decoder buffers, then copy the luma
+		gray := frame.Output
+		internal := Image{Colorspace: ColorSpaceInternal}
+		frame.Output = &internal
+		n, stats, err := d.decodeBuffer(frame, input)
+		if err != nil || stats.StatsFrame == nil {
+			return n, stats, err
+		}
+		if err := copyLuma(&internal, gray, d.Width, d.Height); err != nil {
+			return 0, DecoderStats{FrameType: frameTypeNothing}, err
+		}
+		return n, stats, nil
+	}
+	l := -1
+	var bitstream unsafe.Pointer = nil
+	if input != nil {
+		l = len(input)
+		l = l - l%8
+		if l == 0 {
+			return 0, DecoderStats{FrameType: frameTypeNothing}, nil
+		}
+		bitstream = unsafe.Pointer(&input[0])
+	}
+	cOutput, err := frame.Output.nativeOutput(d.Width, d.Height)
+	if err != nil {
+		return 0, DecoderStats{FrameType: frameTypeNothing}, err
+	}
+	cDecoreFrame := C.xvid_dec_frame_t{
+		version:    C.XVID_VERSION,
+		general:    C.int(uint(frame.DecodeFlags) | frame.RawFlags),
+		bitstream:  bitstream,
+		length:     C.int(l),
+		output:     cOutput,
+		brightness: C.int(frame.Brightness),
+	}
+	cDecodeStats := C.xvid_dec_stats_t{
+		version: C.XVID_VERSION,
+	}
+	code := C.xvid_decore(d.handle, C.XVID_DEC_DECODE, unsafe.Pointer(&cDecoreFrame), unsafe.Pointer(&cDecodeStats))
+	if code < 0 {
+		return 0, DecoderStats{FrameType: frameTypeNothing}, xvidErr(code)
+	}
+	stats := DecoderStats{
+		FrameType: FrameType(cDecodeStats._type),
+	}
+	if stats.FrameType > 0 {
+		if frame.Output.Colorspace.value == ColorSpaceInternal.value {
+			for j := 0; j < ColorSpaceInternal.Planes; j++ {
+				stride := int(cDecoreFrame.output.stride[j])
+				w, rows := ColorSpaceInternal.planeSize(j, d.Width, d.Height)
+				// the internal buffers are edged, the rows are longer than the image width
+				l := stride*(rows-1) + w
+				sh := reflect.SliceHeader{
+					Data: uintptr(cDecoreFrame.output.plane[j]),
+					Len:  l,
+					Cap:  l,
+				}
+				frame.Output.Planes[j] = *(*[]byte)(unsafe.Pointer(&sh))
+				if j < ColorSpaceInternal.Strides {
+					frame.Output.Strides[j] = stride
+				}
+			}
+		}
+		frame.Output.fixAlpha(d.Width, d.Height)
+
+		cVopData := C.vop_data(&cDecodeStats)
+		var quantizers []int32
+		if cVopData.qscale != nil {
+			mbWidth := (d.Width + 15) / 16
+			mbHeight := (d.Height + 15) / 16
+			if mbWidth != int(cVopData.qscale_stride) {
+				// macroblock size computation mismatch, should not happen
+				// dont return any quantizers
+				// TODO: print to stderr?
+			} else {
+				n := mbWidth * mbHeight
+				if cap(frame.QuantizerBuffer) >= n {
+					quantizers = frame.QuantizerBuffer[:n]
+				} else {
+					quantizers = make([]int32, n)
+				}
+				copyCInts(quantizers, unsafe.Pointer(cVopData.qscale), C.sizeof_int == unsafe.Sizeof(int32(0)) && !forceCIntCopy)
+			}
+		}
+		stats.StatsFrame = &DecoderStatsFrame{
+			UpperFieldFirst:  cVopData.general&C.XVID_VOP_TOPFIELDFIRST != 0,
+			Quantizers:       quantizers,
+			QuantizersStride: int(cVopData.qscale_stride),
+		}
+		if frame.MacroblockTypes {
+			mbWidth := (d.Width + 15) / 16
+			mbHeight := (d.Height + 15) / 16
+			mbTypes := make([]MBType, mbWidth*mbHeight)
+			if stats.FrameType == FrameTypeI {
+				for i := range mbTypes {
+					mbTypes[i] = MBTypeIntra
+				}
+			}
+			stats.StatsFrame.MacroblockTypes = mbTypes
+			stats.StatsFrame.MacroblockTypesStride = mbWidth
+		}
+	} else if stats.FrameType == FrameTypeVOL {
+		cVolData := C.vol_data(&cDecodeStats)
+		var par PixelAspectRatio
+		switch cVolData.par {
+		case C.XVID_PAR_11_VGA:
+			par = PixelAspectRatio11VGA
+		case C.XVID_PAR_43_PAL:
+			par = PixelAspectRatio43PAL
+		case C.XVID_PAR_43_NTSC:
+			par = PixelAspectRatio43NTSC
+		case C.XVID_PAR_169_PAL:
+			par = PixelAspectRatio169PAL
+		case C.XVID_PAR_169_NTSC:
+			par = PixelAspectRatio169NTSC
+		case C.XVID_PAR_EXT:
+			par = newPixelAspectRatio(int(cVolData.par_width), int(cVolData.par_height))
+		default:
+			par = PixelAspectRatio11VGA
+		}
+		stats.StatsVOL = &DecoderStatsVOL{
+			Interlacing:      cVolData.general&C.XVID_VOL_INTERLACING != 0,
+			Width:            int(cVolData.width),
+			Height:           int(cVolData.height),
+			PixelAspectRatio: par,
+		}
+		d.interlacing = stats.StatsVOL.Interlacing
+		if d.fixedDimensions && (stats.StatsVOL.Width != d.Width || stats.StatsVOL.Height != d.Height) {
+			return 0, DecoderStats{FrameType: frameTypeNothing}, fmt.Errorf("xvid: stream dimensions %dx%d do not match the DecoderInit dimensions %dx%d", stats.StatsVOL.Width, stats.StatsVOL.Height, d.Width, d.Height)
+		}
+		d.Width = stats.StatsVOL.Width
+		d.Height = stats.StatsVOL.Height
+	}
+	return int(code), stats, nil
+}
+
+// Close closes any internal resources specific to the Decoder, and returns any internal Xvid error.
+// No other methods of the Decoder must be called after Close. Calling Close again is a no-op.
+func (d *Decoder) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	runtime.SetFinalizer(d, nil)
+	releaseThreads(d.threads)
+	if code := C.xvid_decore(d.handle, C.XVID_DEC_DESTROY, nil, nil); code < 0 {
+		return xvidErr(code)
+	}
+	return nil
+}
+
+// ProfileConstraint is a constraint of a profile and level, that can be violated by a stream.
+type ProfileConstraint int
+
+const (
+	// maximum number of macroblocks per frame
+	ProfileConstraintMacroblocks ProfileConstraint = iota
+	// maximum number of macroblocks per second
+	ProfileConstraintMacroblockRate
+	// maximum bitrate in bits per second
+	ProfileConstraintBitrate
+	// Video Buffering Verifier buffer size: the VBV buffer underflowed
+	ProfileConstraintVBV
+)
+
+// ProfileViolation is a violation of a profile and level constraint by a frame of a stream, returned by ValidateStreamProfile.
+type ProfileViolation struct {
+	// index of the frame, not counting VOL pseudo-frames
+	Frame int
+	// violated constraint
+	Constraint ProfileConstraint
+	// actual value for the frame: macroblocks for ProfileConstraintMacroblocks, macroblocks per second for
+	// ProfileConstraintMacroblockRate, bits per second for ProfileConstraintBitrate, missing bits for ProfileConstraintVBV
+	Value int
+	// constraint limit: macroblocks, macroblocks per second, bits per second, VBV buffer size in bits
+	Limit int
+}
+
+// profileLimits are the constraints of a profile and level
+type profileLimits struct {
+	macroblocks    int
+	macroblockRate int
+	bitrate        int
+	vbvSize        int
+}
+
+var profileLimitsTable = map[EncoderProfile]profileLimits{
+	EncoderProfileS_L0:    {99, 1485, 64000, 10 * 16384},
+	EncoderProfileS_L1:    {99, 1485, 64000, 10 * 16384},
+	EncoderProfileS_L2:    {396, 5940, 128000, 40 * 16384},
+	EncoderProfileS_L3:    {396, 11880, 384000, 40 * 16384},
+	EncoderProfileS_L4A:   {1200, 36000, 4000000, 80 * 16384},
+	EncoderProfileS_L5:    {1620, 40500, 8000000, 112 * 16384},
+	EncoderProfileS_L6:    {3600, 108000, 12000000, 248 * 16384},
+	EncoderProfileARTS_L1: {99, 1485, 64000, 10 * 16384},
+	EncoderProfileARTS_L2: {396, 5940, 128000, 40 * 16384},
+	EncoderProfileARTS_L3: {396, 11880, 384000, 40 * 16384},
+	EncoderProfileARTS_L4: {396, 11880, 2000000, 80 * 16384},
+	EncoderProfileAS_L0:   {99, 2970, 128000, 10 * 16384},
+	EncoderProfileAS_L1:   {99, 2970, 128000, 10 * 16384},
+	EncoderProfileAS_L2:   {396, 5940, 384000, 40 * 16384},
+	EncoderProfileAS_L3:   {396, 11880, 768000, 40 * 16384},
+	EncoderProfileAS_L4:   {792, 23760, 3000000, 80 * 16384},
+}
+
+// ProbeStream reads a raw MPEG-4 Part 2 stream from r up to its first VOL header, and returns the VOL metadata
+// (dimensions, interlacing and pixel aspect ratio), e.g. to allocate output images or choose a pipeline before
+// decoding. Only the beginning of the stream is read (with a small buffer), and no frame is decoded.
+// An error is returned if the stream has no VOL header.
+// Init (or InitWithFlags) must be called once before calling this function.
+func ProbeStream(r io.Reader) (*DecoderStatsVOL, error) {
+	d, err := NewDecoder(DecoderInit{Input: r, BufferSize: minDecoderBufferSize})
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	output := Image{Colorspace: ColorSpaceNoOutput}
+	for {
+		_, stats, err := d.Decode(DecoderFrame{Output: &output})
+		if err == io.EOF {
+			return nil, errors.New("xvid: no VOL header found in stream")
+		} else if err != nil {
+			return nil, err
+		}
+		if stats.StatsVOL != nil {
+			return stats.StatsVOL, nil
+		}
+	}
+}
+
+// ValidateStreamProfile decodes an encoded raw Xvid stream and returns the violations of the constraints of a
+// profile and level by its frames, in stream order. Init (or InitWithFlags) must be called once before calling this function.
+//
+// The frame size is always checked. The macroblock rate, bitrate and VBV constraints are computed from the
+// frame presentation times (see DecoderStatsFrame.PresentationTime) and are only checked if the stream carries
+// time codes; the bitrate is measured over a sliding window of one second, and the VBV buffer is assumed to be
+// initially full and filled at the maximum bitrate of the level. As frames are decoded in display order but
+// transmitted in decoding order, the checks are approximate for streams with B-frames.
+//
+// An error is returned if the profile is EncoderProfileAuto or unknown, or if the stream could not be decoded,
+// in which case the violations found before the error are returned.
+func ValidateStreamProfile(r io.Reader, profile EncoderProfile) ([]ProfileViolation, error) {
+	limits, ok := profileLimitsTable[profile]
+	if !ok {
+		return nil, fmt.Errorf("xvid: cannot validate stream for unknown profile %#x", int(profile))
+	}
+	d, err := NewDecoder(DecoderInit{Input: r})
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	type windowFrame struct {
+		time        time.Duration
+		bits        int
+		macroblocks int
+	}
+	var violations []ProfileViolation
+	var window []windowFrame
+	var last time.Duration
+	vbv := limits.vbvSize
+	bits := 0
+	output := Image{Colorspace: ColorSpaceNoOutput}
+	for i := 0; ; {
+		n, stats, err := d.Decode(DecoderFrame{Output: &output})
+		if err == io.EOF {
+			return violations, nil
+		} else if err != nil {
+			return violations, err
+		}
+		bits += n * 8
+		if stats.StatsFrame == nil {
+			// count the VOL bits with the next frame
+			continue
+		}
+		macroblocks := ((d.Width + 15) / 16) * ((d.Height + 15) / 16)
+		if macroblocks > limits.macroblocks {
+			violations = append(violations, ProfileViolation{Frame: i, Constraint: ProfileConstraintMacroblocks, Value: macroblocks, Limit: limits.macroblocks})
+		}
+		t := stats.StatsFrame.PresentationTime
+		if i == 0 || t > last {
+			if i > 0 {
+				vbv += int(int64(limits.bitrate) * int64(t-last) / int64(time.Second))
+				if vbv > limits.vbvSize {
+					vbv = limits.vbvSize
+				}
+			}
+			vbv -= bits
+			if vbv < 0 {
+				violations = append(violations, ProfileViolation{Frame: i, Constraint: ProfileConstraintVBV, Value: -vbv, Limit: limits.vbvSize})
+				vbv = 0
+			}
+
+			window = append(window, windowFrame{time: t, bits: bits, macroblocks: macroblocks})
+			for t-window[0].time >= time.Second {
+				window = window[1:]
+			}
+			windowBits := 0
+			windowMacroblocks := 0
+			for _, f := range window {
+				windowBits += f.bits
+				windowMacroblocks += f.macroblocks
+			}
+			if windowBits > limits.bitrate {
+				violations = append(violations, ProfileViolation{Frame: i, Constraint: ProfileConstraintBitrate, Value: windowBits, Limit: limits.bitrate})
+			}
+			if windowMacroblocks > limits.macroblockRate {
+				violations = append(violations, ProfileViolation{Frame: i, Constraint: ProfileConstraintMacroblockRate, Value: windowMacroblocks, Limit: limits.macroblockRate})
+			}
+			last = t
+		}
+		bits = 0
+		i++
+	}
+}
+
+// Plugin is an Xvid plugin that is used during the encoding process as a callback
+// for both read and write operations to some internal frame encoding data.
+// Plugins are used in the Encoder methods.
+//
+// Some default plugins are provided, which include 1-pass and 2-pass rate control.
+//
+// Custom plugins can also be created by implementing the Plugin interface.
+type Plugin interface {
+	// called during Encoder.Init
+	// return the information the plugins needs
+	Info() PluginFlag
+	// called during Encoder.Init to init the plugin (any startup setup should be done here)
+	// return false to disable the plugin for an Encoder
+	Init(create PluginInit) bool
+	// called during Encoder.Close to close any open plugin resources
+	Close(close PluginClose)
+
+	// frame-related callbacks
+	// check FrameData for what fields are readable/writable depending on the call
+
+	// called during Encoder.Encode, before starting to encode a frame
+	Before(data *PluginData)
+	// called during Encoder.Encode, while encoding a frame
+	Frame(data *PluginData)
+	// called during Encoder.Encode, after encoding a frame
+	After(data *PluginData)
+}
+
+// PluginPriorityRateControl is the priority of the rate-control plugins (PluginRC1Pass, PluginRC2Pass1,
+// PluginRC2Pass2), and the default priority of the other plugins. See WithPriority.
+const PluginPriorityRateControl = 0
+
+type prioritizedPlugin struct {
+	Plugin
+	priority int
+}
+
+// WithPriority returns a plugin wrapping p, with an explicit priority for its execution order.
+//
+// The plugins of an Encoder are run in a deterministic order, in each of the Before, Frame and After callbacks:
+// by increasing priority, then in the EncoderInit.Plugins order for plugins of equal priority. Plugins not wrapped
+// with WithPriority have the PluginPriorityRateControl priority, so that a plugin with a priority lower than
+// PluginPriorityRateControl is run before the rate-control plugin (e.g. to see its Before data before the
+// quantizer is decided), and a plugin with a higher priority is run after it (e.g. to see or override the quantizer
+// decided by the rate-control plugin).
+func WithPriority(p Plugin, priority int) Plugin {
+	if pp, ok := p.(prioritizedPlugin); ok {
+		p = pp.Plugin
+	}
+	return prioritizedPlugin{Plugin: p, priority: priority}
+}
+
+// orderPlugins returns the plugins unwrapped from WithPriority, in their execution order
+func orderPlugins(plugins []Plugin) []Plugin {
+	type entry struct {
+		plugin   Plugin
+		priority int
+	}
+	entries := make([]entry, len(plugins))
+	for i, p := range plugins {
+		entries[i] = entry{plugin: p, priority: PluginPriorityRateControl}
+		if pp, ok := p.(prioritizedPlugin); ok {
+			entries[i] = entry{plugin: pp.Plugin, priority: pp.priority}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].priority < entries[j].priority
+	})
+	ordered := make([]Plugin, len(entries))
+	for i, e := range entries {
+		ordered[i] = e.plugin
+	}
+	return ordered
+}
+
+type pluginInternal struct {
+	// name of the function that created the plugin
+	name    string
+	cPlugin C.xvid_enc_plugin_t
+	// optional, allocates the plugin param for each encoder creation, so that the plugin can be reused;
+	// returns functions (that can be nil) to free it after the encoder creation and after the encoder destruction
+	newParam func() (param unsafe.Pointer, free func(), destroyFree func())
+	// optional, name of the xvidcore feature required by the plugin, and whether it is supported by the capabilities
+	feature   string
+	supported func(c *Capabilities) bool
+}
+
+func (p pluginInternal) Info() PluginFlag            { return 0 }
+func (p pluginInternal) Init(create PluginInit) bool { return true }
+func (p pluginInternal) Close(close PluginClose)     {}
+func (p pluginInternal) Before(data *PluginData)     {}
+func (p pluginInternal) Frame(data *PluginData)      {}
+func (p pluginInternal) After(data *PluginData)      {}
+
+// PluginRC1PassInit is a configuration for the PluginRC1Pass plugin (1-pass rate-control).
+// To return a configuration initialized to default values, use NewPluginRC1PassInit.
+type PluginRC1PassInit struct {
+	// target bitrate in bits per second
+	Bitrate int
+	// reaction delay factor; defaults to 16
+	ReactionDelayFactor int
+	// averaging period; defaults to 100
+	AveragingPeriod int
+	// smoothing buffer; defaults to 100
+	SmoothingBuffer int
+}
+
+// NewPluginRC1PassInit returns a PluginRC1PassInit initialized to default values.
+func NewPluginRC1PassInit(bitrate int) PluginRC1PassInit {
+	return PluginRC1PassInit{
+		Bitrate:             bitrate,
+		ReactionDelayFactor: 16,
+		AveragingPeriod:     100,
+		SmoothingBuffer:     100,
+	}
+}
+
+// PluginRC1Pass returns an instance of the 1-pass rate-control plugin, to be used in NewEncoder.
+// This plugin will choose specific quantizers to try to match the bitrate parameters.
+func PluginRC1Pass(init PluginRC1PassInit) Plugin {
+	return pluginInternal{
+		name: "PluginRC1Pass",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_single,
+			param: unsafe.Pointer(&C.xvid_plugin_single_t{
+				version:               C.XVID_VERSION,
+				bitrate:               C.int(init.Bitrate),
+				reaction_delay_factor: C.int(init.ReactionDelayFactor),
+				averaging_period:      C.int(init.AveragingPeriod),
+				buffer:                C.int(init.SmoothingBuffer),
+			}),
+		},
+	}
+}
+
+// PluginRC2Pass1 returns an instance of the 2-pass rate-control plugin for the first pass.
+// To do 2-pass rate-control in Xvid, encode the same images twice, in the first run using the
+// PluginRC2Pass1 plugin, and in the second run using the PluginRC2Pass2 plugin.
+//
+// PluginRC2Pass1 takes a filename which is used to store the rate-control information (the file will be overwritten).
+// If the file writing fails, Xvid will not return errors, so you can check for the file existence yourself
+// after the encoding ends.
+func PluginRC2Pass1(filename string) Plugin {
+	return pluginInternal{
+		name: "PluginRC2Pass1",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_2pass1,
+		},
+		newParam: func() (unsafe.Pointer, func(), func()) {
+			cFilename := C.CString(filename)
+			param := unsafe.Pointer(&C.xvid_plugin_2pass1_t{
+				version:  C.XVID_VERSION,
+				filename: cFilename,
+			})
+			return param, func() {
+				C.free(unsafe.Pointer(cFilename))
+			}, nil
+		},
+	}
+}
+
+// PluginRC2Pass2Init is a configuration for the PluginRC2Pass2 plugin (2-pass rate-control, pass 2).
+// To return a configuration initialized to default values, use NewPluginRC2Pass2Init.
+type PluginRC2Pass2Init struct {
+	// target bitrate in bits per second; defaults to 700*1024
+	Bitrate int
+	// path to file to read rate-control info from, should be the same file as the first pass filename
+	Filename string
+	// I-frame boost percentage, range: [0..100]; defaults to 10
+	IFrameBoost int
+	// percentage of compression performed on the high part of the curve (above average); defaults to 0
+	CurveCompressionHigh int
+	// percentage of compression performed on the low  part of the curve (below average); defaults to 0
+	CurveCompressionLow int
+	// payback delay in number of frames; defaults to 5
+	OverflowControlStrength int
+	// percentage of allowed range for a frame that gets bigger because of overflow bonus; defaults to 5
+	MaxOverflowImprovement int
+	// percentage of allowed range for a frame that gets smaller because of overflow penalty; defaults to 5
+	MaxOverflowDegradation int
+
+	// maximum bitrate reduction applied to an I-frame under the kfthreshold distance limit; defaults to 20
+	IFrameReduction int
+
+	// if an iframe is closer to the next iframe than this distance, a quantity of bits
+	// is substracted from its bit allocation. The reduction is computed as multiples of
+	// kfreduction/kthreshold. It reaches kfreduction when the distance == kfthreshold,
+	// 0 for 1<distance<kfthreshold
+	// defaults to 1
+	IFrameThreshold int
+
+	// how many bytes the controller has to compensate per frame due to container format overhead; defaults to 0
+	ContainerFrameOverhead int
+
+	// Video Buffering Verifier buffer size in bits; 0 disables VBV check; defaults to 0
+	VBVSize int
+	// Video Buffering Verifier max processing bitrate in bits per second
+	VBVMaxRate int
+	// Video Buffering Verifier initial buffer occupancy in bits; defaults to 0
+	VBVInitial int
+}
+
+// NewPluginRC2Pass2Init returns a PluginRC2Pass2Init initialized to default values.
+// It takes a filename which is used to read the rate-control information from a previous first pass.
+func NewPluginRC2Pass2Init(bitrate int, filename string) PluginRC2Pass2Init {
+	return PluginRC2Pass2Init{
+		Bitrate:                 bitrate,
+		Filename:                filename,
+		IFrameBoost:             10,
+		OverflowControlStrength: 5,
+		MaxOverflowImprovement:  5,
+		MaxOverflowDegradation:  5,
+		IFrameReduction:         20,
+		IFrameThreshold:         1,
+		ContainerFrameOverhead:  100,
+	}
+}
+
+// PluginRC2Pass2 returns an instance of the 2-pass rate-control plugin for the second pass.
+// To do 2-pass rate-control in Xvid, encode the same images twice, in the first run using the
+// PluginRC2Pass1 plugin, and in the second run using the PluginRC2Pass2 plugin.
+func PluginRC2Pass2(init PluginRC2Pass2Init) Plugin {
+	return pluginInternal{
+		name: "PluginRC2Pass2",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_2pass2,
+		},
+		newParam: func() (unsafe.Pointer, func(), func()) {
+			filename := C.CString(init.Filename)
+			param := unsafe.Pointer(&C.xvid_plugin_2pass2_t{
+				version:                   C.XVID_VERSION,
+				bitrate:                   C.int(init.Bitrate),
+				filename:                  filename,
+				keyframe_boost:            C.int(init.IFrameBoost),
+				curve_compression_high:    C.int(init.CurveCompressionHigh),
+				curve_compression_low:     C.int(init.CurveCompressionLow),
+				overflow_control_strength: C.int(init.OverflowControlStrength),
+				max_overflow_improvement:  C.int(init.MaxOverflowImprovement),
+				max_overflow_degradation:  C.int(init.MaxOverflowDegradation),
+				kfreduction:               C.int(init.IFrameReduction),
+				kfthreshold:               C.int(init.IFrameThreshold),
+				container_frame_overhead:  C.int(init.ContainerFrameOverhead),
+				vbv_size:                  C.int(init.VBVSize),
+				vbv_initial:               C.int(init.VBVInitial),
+				vbv_maxrate:               C.int(init.VBVMaxRate),
+			})
+			return param, func() {
+				C.free(unsafe.Pointer(filename))
+			}, nil
+		},
+	}
+}
+
+// FrameRCInfo is the rate-control information of an encoded frame, recorded during a first pass by the plugin returned by NewTwoPassStatsRecorder.
+type FrameRCInfo struct {
+	// frame type of the encoded frame
+	Type FrameType
+	// quantizer used for the frame
+	Quantizer int
+	// length of frame in bytes
+	Length int
+	// length of frame header in bytes
+	HeaderLength int
+	// number of blocks coded as intra
+	IntraBlocks int
+	// number of blocks coded as inter
+	InterBlocks int
+	// number of blocks not coded
+	UncodedBlocks int
+}
+
+// Bits returns the size of the frame in bits.
+func (f FrameRCInfo) Bits() int {
+	return f.Length * 8
+}
+
+// TwoPassStats stores the rate-control information of the frames encoded during a first pass.
+// It is filled by the plugin returned by NewTwoPassStatsRecorder.
+type TwoPassStats struct {
+	frames []FrameRCInfo
+}
+
+// Frames returns the rate-control information of each encoded frame, in encoding order.
+func (s *TwoPassStats) Frames() []FrameRCInfo {
+	return s.frames
+}
+
+// WriteTo writes the stats in the format of the stats file of the PluginRC2Pass1 plugin, so that it can
+// be used as the Filename of a PluginRC2Pass2 plugin, to give the same results as a file-based first pass.
+func (s *TwoPassStats) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# XviD 2pass stat file (core version %s)\n# Please do not modify this file\n\n", Version{C.XVID_VERSION}.String())
+	for _, f := range s.frames {
+		var t byte
+		switch f.Type {
+		case FrameTypeI:
+			t = 'i'
+		case FrameTypeP:
+			t = 'p'
+		case FrameTypeB:
+			t = 'b'
+		case FrameTypeS:
+			t = 's'
+		default:
+			continue
+		}
+		fmt.Fprintf(&buf, "%c %d %d %d %d %d %d\n", t, f.Quantizer, f.IntraBlocks, f.InterBlocks, f.UncodedBlocks, f.Length, f.HeaderLength)
+	}
+	return buf.WriteTo(w)
+}
+
+type twoPassStatsRecorder struct {
+	stats *TwoPassStats
+}
+
+func (p twoPassStatsRecorder) Info() PluginFlag { return 0 }
+func (p twoPassStatsRecorder) Init(create PluginInit) bool {
+	p.stats.frames = nil
+	return true
+}
+func (p twoPassStatsRecorder) Close(close PluginClose) {}
+func (p twoPassStatsRecorder) Before(data *PluginData) {}
+func (p twoPassStatsRecorder) Frame(data *PluginData)  {}
+func (p twoPassStatsRecorder) After(data *PluginData) {
+	p.stats.frames = append(p.stats.frames, FrameRCInfo{
+		Type:          data.Type,
+		Quantizer:     data.Stats.Quantizer,
+		Length:        data.Stats.Length,
+		HeaderLength:  data.Stats.HeaderLength,
+		IntraBlocks:   data.Stats.IntraBlocks,
+		InterBlocks:   data.Stats.InterBlocks,
+		UncodedBlocks: data.Stats.UncodedBlocks,
+	})
+}
+
+// NewTwoPassStatsRecorder returns a plugin that records the rate-control information of a first pass in memory,
+// to be used in NewEncoder instead of PluginRC2Pass1, and the TwoPassStats it fills while encoding.
+// The stats are cleared when the plugin is initialized, at the creation (or reset) of the Encoder.
+func NewTwoPassStatsRecorder() (Plugin, *TwoPassStats) {
+	stats := &TwoPassStats{}
+	return twoPassStatsRecorder{stats: stats}, stats
+}
+
+type lambdaController struct {
+	fn func(frameNum int, mbX int, mbY int, defaults [6]float32) [6]float32
+}
+
+func (p lambdaController) Info() PluginFlag            { return PluginRequireLambda }
+func (p lambdaController) Init(create PluginInit) bool { return true }
+func (p lambdaController) Close(close PluginClose)     {}
+func (p lambdaController) Before(data *PluginData)     {}
+func (p lambdaController) Frame(data *PluginData) {
+	if len(data.Lambda) < 6*data.WidthMacroBlocks*data.HeightMacroBlocks {
+		return
+	}
+	for mbY := 0; mbY < data.HeightMacroBlocks; mbY++ {
+		for mbX := 0; mbX < data.WidthMacroBlocks; mbX++ {
+			lambda := data.Lambda[6*(mbY*data.WidthMacroBlocks+mbX):]
+			var defaults [6]float32
+			copy(defaults[:], lambda)
+			values := p.fn(data.FrameNum, mbX, mbY, defaults)
+			copy(lambda, values[:])
+		}
+	}
+}
+func (p lambdaController) After(data *PluginData) {}
+
+// NewLambdaController returns a plugin that sets the rate-distortion lambdas of each macroblock of each frame,
+// by calling fn for each macroblock with the frame number, the macroblock coordinates (in macroblocks), and the
+// lambdas that would be used otherwise (as set by the encoder and the previous plugins), and using its return value.
+//
+// The six lambdas of a macroblock are the weights of each of its 8x8 blocks in the rate-distortion decisions
+// of the encoder (VOPTrellisQuantization, VOPModeDecisionRD, ...): the four luma blocks in raster order
+// (top left, top right, bottom left, bottom right), then the U and V chroma blocks. The default value is 1;
+// a higher value gives more weight to the distortion of the block, so that more bits are spent on it.
+// They have no effect if no rate-distortion flags are used.
+func NewLambdaController(fn func(frameNum int, mbX int, mbY int, defaults [6]float32) [6]float32) Plugin {
+	return lambdaController{fn: fn}
+}
+
+// fixedQuantizer is the plugin implementing EncoderInit.FixedQuantizer
+type fixedQuantizer struct {
+	quantizer int
+}
+
+func (p fixedQuantizer) Info() PluginFlag            { return 0 }
+func (p fixedQuantizer) Init(create PluginInit) bool { return true }
+func (p fixedQuantizer) Close(close PluginClose)     {}
+func (p fixedQuantizer) Before(data *PluginData) {
+	if data.Quantizer > 0 {
+		// quantizer forced in EncoderFrame.Quantizer or decided by a rate-control plugin
+		return
+	}
+	q := p.quantizer
+	if data.Type == FrameTypeB {
+		q = (q*data.BFrameQuantizer.Ratio + data.BFrameQuantizer.Offset) / 100
+		if q < 1 {
+			q = 1
+		} else if q > 31 {
+			q = 31
+		}
+	}
+	data.Quantizer = q
+}
+func (p fixedQuantizer) Frame(data *PluginData) {}
+func (p fixedQuantizer) After(data *PluginData) {}
+
+// MaskingMethod is a method used for lumi-masking (adaptive quantization).
+type MaskingMethod uint
+
+const (
+	// luminance masking
+	MaskingLuminance MaskingMethod = 0
+	// variance masking
+	MaskingVariance MaskingMethod = 1
+)
+
+// PluginAdaptiveQuantization returns an instance of the adaptive quantization plugin
+// (also-called lumi-masking).
+func PluginAdaptiveQuantization(method MaskingMethod) Plugin {
+	return pluginInternal{
+		name: "PluginAdaptiveQuantization",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_lumimasking,
+			param: unsafe.Pointer(&C.xvid_plugin_lumimasking_t{
+				version: C.XVID_VERSION,
+				method:  C.int(method),
+			}),
+		},
+	}
+}
+
+// PluginPSNR returns an instance of a plugin that writes PSNR values to the standard output.
+func PluginPSNR() Plugin {
+	return pluginInternal{
+		name: "PluginPSNR",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_psnr,
+			param: nil,
+		},
+	}
+}
+
+type psnrCallback struct {
+	fn func(frameNum int, psnrY float64, psnrU float64, psnrV float64)
+}
+
+func (p psnrCallback) Info() PluginFlag            { return PluginRequirePSNR }
+func (p psnrCallback) Init(create PluginInit) bool { return true }
+func (p psnrCallback) Close(close PluginClose)     {}
+func (p psnrCallback) Before(data *PluginData)     {}
+func (p psnrCallback) Frame(data *PluginData)      {}
+func (p psnrCallback) After(data *PluginData) {
+	// same sample counts as the PluginPSNR plugin
+	n := data.Width * data.Height
+	p.fn(data.FrameNum, psnrFromSSE(int64(data.Stats.SSEY), n), psnrFromSSE(int64(data.Stats.SSEU), n/4), psnrFromSSE(int64(data.Stats.SSEV), n/4))
+}
+
+// PluginPSNRCallback returns a plugin that computes the PSNR of each encoded frame, like PluginPSNR, and passes it
+// to fn instead of writing it to the standard output. fn is called after each frame is encoded, with the frame
+// number (see PluginData.FrameNum) and the PSNR in dB of the Y, U and V planes (+Inf for identical planes).
+func PluginPSNRCallback(fn func(frameNum int, psnrY float64, psnrU float64, psnrV float64)) Plugin {
+	return psnrCallback{fn: fn}
+}
+
+// PluginDump returns an instance of a plugin that writes original and encoded image data
+// to files in YUV in PGM format in the working directory.
+func PluginDump() Plugin {
+	return pluginInternal{
+		name: "PluginDump",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_dump,
+			param: nil,
+		},
+	}
+}
+
+// DumpFrames selects the frames written by a PluginDumpTo plugin.
+type DumpFrames int
+
+const (
+	// dump both the original and the reconstructed frames
+	DumpBoth DumpFrames = iota
+	// dump only the original (uncompressed) frames
+	DumpOriginal
+	// dump only the reconstructed (encoded then decoded) frames
+	DumpReconstructed
+)
+
+// PluginDumpInit is a configuration for the PluginDumpTo plugin.
+type PluginDumpInit struct {
+	// directory to write the files to, which must exist; default is "", meaning the working directory
+	Directory string
+	// prefix of the names of the files: the files are named <prefix><frame number>_orig.pgm for the original frames,
+	// and <prefix><frame number>_enc.pgm for the reconstructed frames, with the frame number padded to 5 digits
+	Prefix string
+	// frames to write; default is DumpBoth
+	Frames DumpFrames
+	// optional function called with the errors of writing the files, which are ignored otherwise
+	OnError func(err error)
+}
+
+type frameDumper struct {
+	init PluginDumpInit
+}
+
+func (p frameDumper) Info() PluginFlag {
+	if p.init.Frames == DumpReconstructed {
+		return 0
+	}
+	return PluginRequireOriginal
+}
+func (p frameDumper) Init(create PluginInit) bool { return true }
+func (p frameDumper) Close(close PluginClose)     {}
+func (p frameDumper) Before(data *PluginData)     {}
+func (p frameDumper) Frame(data *PluginData)      {}
+func (p frameDumper) After(data *PluginData) {
+	if p.init.Frames != DumpReconstructed {
+		p.dump(&data.Original, fmt.Sprintf("%s%05d_orig.pgm", p.init.Prefix, data.FrameNum), data.Width, data.Height)
+	}
+	if p.init.Frames != DumpOriginal {
+		p.dump(&data.Current, fmt.Sprintf("%s%05d_enc.pgm", p.init.Prefix, data.FrameNum), data.Width, data.Height)
+	}
+}
+
+// dump writes a ColorSpacePlanar image to a file in the PGM YUV format of PluginDump: the Y plane, followed by
+// the U and V planes side by side
+func (p frameDumper) dump(img *Image, name string, width int, height int) {
+	if len(img.Planes) != 3 {
+		return
+	}
+	cw, ch := (width+1)/2, (height+1)/2
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "P5\n%d %d\n255\n", 2*cw, height+ch)
+	padding := make([]byte, 2*cw-width)
+	for y := 0; y < height; y++ {
+		buf.Write(img.Planes[0][y*img.Strides[0] : y*img.Strides[0]+width])
+		buf.Write(padding)
+	}
+	for y := 0; y < ch; y++ {
+		buf.Write(img.Planes[1][y*img.Strides[1] : y*img.Strides[1]+cw])
+		buf.Write(img.Planes[2][y*img.Strides[1] : y*img.Strides[1]+cw])
+	}
+	if err := ioutil.WriteFile(filepath.Join(p.init.Directory, name), buf.Bytes(), 0666); err != nil && p.init.OnError != nil {
+		p.init.OnError(err)
+	}
+}
+
+// PluginDumpTo returns an instance of a plugin that writes original and/or reconstructed image data to files in
+// YUV in PGM format, like PluginDump, but in a configurable directory and with configurable file names.
+// It is implemented in Go, so that the files are written after each frame is encoded.
+func PluginDumpTo(init PluginDumpInit) Plugin {
+	return frameDumper{init: init}
+}
+
+// PluginSSIMInit is a configuration for the PluginSSIM plugin (write SSIM values).
+// The SSIM values can be written to the standard output or to a file.
+type PluginSSIMInit struct {
+	// whether to output stats to stdout
+	PrintStats bool
+	// output stats filename (file will be overwritten); or empty to not output to a file
+	StatsFilename string
+
+	// SSIM computation accuracy from 0 (gaussian weighted, very slow), 1 (unweighted, slow) to 4 (unweighted, very fast); default is 2
+	Accuracy int
+	// CPU flags to use for decoding, or nil to use the autodetected CPU features
+	CpuFlags *CPUFlag
+
+	// visualization is currently disabled in xvidcore
+	// Visualize  bool
+}
+
+// PluginSSIM returns an instance of a plugin that writes SSIM values to the standard output
+// or to a file.
+func PluginSSIM(init PluginSSIMInit) Plugin {
+	var cpuFlags C.int = 0
+	if init.CpuFlags != nil {
+		cpuFlags = C.int(*init.CpuFlags | CPUFlag(C.CPU_FORCE))
+	}
+	return pluginInternal{
+		name: "PluginSSIM",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_ssim,
+		},
+		feature:   "SSIM plugin",
+		supported: func(c *Capabilities) bool { return c.SSIM },
+		newParam: func() (unsafe.Pointer, func(), func()) {
+			var filename *C.char = nil
+			if init.StatsFilename != "" {
+				filename = C.CString(init.StatsFilename)
+			}
+			param := unsafe.Pointer(&C.xvid_plugin_ssim_t{
+				b_printstat: cbool(init.PrintStats),
+				stat_path:   filename,
+				acc:         C.int(init.Accuracy),
+				cpu_flags:   cpuFlags,
+			})
+			return param, nil, func() {
+				if filename != nil {
+					C.free(unsafe.Pointer(filename))
+				}
+			}
+		},
+	}
+}
+
+// PluginPSNRHVSM returns an instance of a plugin that writes PSNRHVSM values
+// to the standard output.
+func PluginPSNRHVSM() Plugin {
+	return pluginInternal{
+		name: "PluginPSNRHVSM",
+		cPlugin: C.xvid_enc_plugin_t{
+			_func: &C.xvid_plugin_psnrhvsm,
+			param: nil,
+		},
+		feature:   "PSNR-HVS-M plugin",
+		supported: func(c *Capabilities) bool { return c.PSNRHVSM },
+	}
+}
+
+// PluginInit stores general information for an encoder, used for reading by plugins
+// in their Init callback.
+type PluginInit struct {
+	// encoder bitrate zones, that enforce a specific parameter for a range of frames; must be sorted in increasing frame start order
+	Zones []EncoderZone
+	// frame width in pixels
+	Width int
+	// frame height in pixels
+	Height int
+	// frame width in macro blocks
+	WidthMacroBlocks int
+	// frame height in macro blocks
+	HeightMacroBlocks int
+	// framerate; Numerator=0 means variable framerate
+	FrameRate Fraction
+}
+
+// PluginClose stores information for an encoding session, used for reading by plugins
+// in their Close callback.
+type PluginClose struct {
 	// total count of encoded frames
 	NumFrames int
 }
 
-// PluginData stores information about an encoder and a specific frame to encode.
-// It is used in plugins Before, Frame, and After callbacks.
+// PluginData stores information about an encoder and a specific frame to encode.
+// It is used in plugins Before, Frame, and After callbacks.
+//
+// Depending on the callback ([B]efore, [F]rame, [A]fter), some fields can be
+// [R]eadable or [W]ritable. To represent this, each field description starts
+// with a list [<B(efore)/F(rame)/A(fter)><R(ead)/W(rite)>, ...].
+// For example [AR,FW] means: writable during Frame, readable during After.
+//
+// The slices of a PluginData (DiffQuantizers, Lambda, and the planes of the images) alias Xvid memory that is only
+// valid during the callback: they must not be retained after the callback returns, and must be copied instead (see
+// CopyReference, CopyCurrent and CopyOriginal for the images).
+// Building with the xvid_pluginguard build tag makes the callbacks receive copies that are poisoned after each
+// callback returns, and panics on the next callback (or Encoder.Close) if a retained slice was modified.
+type PluginData struct {
+	// [BR,FR,AR] current encoder zone, or nil if none
+	Zone *EncoderZone
+	// [BR,FR,AR] frame width in pixels
+	Width int
+	// [BR,FR,AR] frame height in pixels
+	Height int
+	// [BR,FR,AR] frame width in macro blocks
+	WidthMacroBlocks int
+	// [BR,FR,AR] frame height in macro blocks
+	HeightMacroBlocks int
+	// [BR,FR,AR] framerate; Numerator=0 means variable framerate
+	FrameRate Fraction
+	// [BR,FR,AR] quantizer range for I frames
+	QuantizerI QuantizerRange
+	// [BR,FR,AR] quantizer range for P frames
+	QuantizerP QuantizerRange
+	// [BR,FR,AR] quantizer range for B frames
+	QuantizerB QuantizerRange
+	// [BR,FR,AR] frame number
+	FrameNum int
+	// [BR,FR,AR] reference frame; only valid during the callback, see CopyReference
+	Reference Image
+	// [BR,FR,AR] current frame; only valid during the callback, see CopyCurrent
+	Current Image
+	// [AR] the original (uncompressed) copy of the current frame; only valid during the callback, see CopyOriginal
+	Original Image
+	// [BR,FR,AR,BW] type of this frame
+	Type FrameType
+	// [BR,FR,AR,BW,FW] quantizer used for this frame
+	Quantizer int
+	// [AR,FW] diff quantizers for this frame, only present if PluginRequireDiffQuantizer was set during Info()
+	DiffQuantizers []int
+	// [FR,AR] diff quantizers stride (quantizers per row), only set if PluginRequireDiffQuantizer was set during Info()
+	DiffQuantizersStride int
+	// [BR,AR,BW] actual group of pictures flags
+	VOLFlags VOLFlag
+	// [BR,AR,BW] encoding flags for this frame
+	VOPFlags VOPFlag
+	// [BR,AR,BW] motion estimation flags for this frame
+	MotionFlags MotionFlag
+	// [FW] lambda table for this frame, only present if PluginRequireLambda was set during Info(); six floats for each macroblock
+	Lambda []float32
+	// [BR,FR,AR] B-frames quantizer multipier/offset; used to decide B-frames quantizer when automatic quantizer is used
+	BFrameQuantizer BFrameQuantizer
+	// [AR] frame statistics
+	Stats EncoderStats
+}
+
+// encoderMutex serializes the creation of native encoders: xvidcore calls XVID_PLG_INFO without any plugin
+// parameter, so the plugins of the encoder being created are found with creatingEncoder
+var encoderMutex = sync.Mutex{}
+var creatingEncoder *Encoder
+
+// goPlugin is a custom plugin of an Encoder, registered in goPlugins
+type goPlugin struct {
+	// the Encoder of the plugin, only set during the native encoder calls that run plugins (see bindGoPlugins),
+	// so that goPlugins does not keep the Encoder reachable and it can be finalized
+	encoder *Encoder
+	plugin  Plugin
+}
+
+// goPlugins is the registry of the custom plugins of the live native encoders, keyed by an ID stored in C memory
+// passed as the plugin parameter (and handle), so that C does not reference Go memory and each plugin callback
+// resolves its own plugin and Encoder
+var goPlugins = make(map[uintptr]*goPlugin)
+var goPluginsMutex = sync.RWMutex{}
+var goPluginsNextID uintptr
+
+// registerGoPlugin registers a custom plugin and returns its plugin parameter, allocated in C memory, and a function
+// unregistering it and freeing the parameter
+func registerGoPlugin(e *Encoder, plugin Plugin) (unsafe.Pointer, func()) {
+	p := &goPlugin{plugin: plugin}
+	e.goPlugins = append(e.goPlugins, p)
+	goPluginsMutex.Lock()
+	goPluginsNextID++
+	id := goPluginsNextID
+	goPlugins[id] = p
+	goPluginsMutex.Unlock()
+	param := C.malloc(C.size_t(unsafe.Sizeof(id)))
+	*(*uintptr)(param) = id
+	return param, func() {
+		goPluginsMutex.Lock()
+		delete(goPlugins, id)
+		goPluginsMutex.Unlock()
+		C.free(param)
+	}
+}
+
+// bindGoPlugins sets (or clears, if bound is false) the Encoder of its custom plugins, around a native encoder call
+func (e *Encoder) bindGoPlugins(bound bool) {
+	for _, p := range e.goPlugins {
+		if bound {
+			p.encoder = e
+		} else {
+			p.encoder = nil
+		}
+	}
+}
+
+// lookupGoPlugin returns the custom plugin of a plugin parameter (or handle)
+func lookupGoPlugin(param unsafe.Pointer) *goPlugin {
+	goPluginsMutex.RLock()
+	defer goPluginsMutex.RUnlock()
+	return goPlugins[*(*uintptr)(param)]
+}
+
+// DiffQuantizerAt returns the diff quantizer of the macroblock at column mbX and row mbY (in macroblocks), and false
+// if the coordinates are out of bounds or if the diff quantizers table is not available.
+func (d *PluginData) DiffQuantizerAt(mbX int, mbY int) (int, bool) {
+	if d.DiffQuantizersStride <= 0 || mbX < 0 || mbX >= d.DiffQuantizersStride || mbY < 0 {
+		return 0, false
+	}
+	i := mbY*d.DiffQuantizersStride + mbX
+	if i >= len(d.DiffQuantizers) {
+		return 0, false
+	}
+	return d.DiffQuantizers[i], true
+}
+
+// DiffQuantizerGrid returns the diff quantizers table reshaped as rows of macroblocks, indexed as [mbY][mbX], or
+// nil if the diff quantizers table is not available. The rows alias the DiffQuantizers slice, so that writing
+// to them (when writable) writes the diff quantizers; like DiffQuantizers, they are only valid during the callback.
+func (d *PluginData) DiffQuantizerGrid() [][]int {
+	if d.DiffQuantizersStride <= 0 || len(d.DiffQuantizers) == 0 {
+		return nil
+	}
+	grid := make([][]int, len(d.DiffQuantizers)/d.DiffQuantizersStride)
+	for y := range grid {
+		grid[y] = d.DiffQuantizers[y*d.DiffQuantizersStride : (y+1)*d.DiffQuantizersStride]
+	}
+	return grid
+}
+
+// CopyReference returns a deep copy of the Reference image, with its own planes, that can be retained after the
+// callback returns, e.g. to compare frames across callbacks.
+func (d *PluginData) CopyReference() Image {
+	return copyPlanes(&d.Reference, d.Width, d.Height)
+}
+
+// CopyCurrent returns a deep copy of the Current image, with its own planes, that can be retained after the
+// callback returns, e.g. to compare frames across callbacks.
+func (d *PluginData) CopyCurrent() Image {
+	return copyPlanes(&d.Current, d.Width, d.Height)
+}
+
+// CopyOriginal returns a deep copy of the Original image, with its own planes, that can be retained after the
+// callback returns; it returns an empty Image if Original is not set.
+func (d *PluginData) CopyOriginal() Image {
+	return copyPlanes(&d.Original, d.Width, d.Height)
+}
+
+// copyPlanes returns a copy of the planes of input into new planes, with the rows packed (the strides are the plane
+// widths); input must not be flipped.
+func copyPlanes(input *Image, width int, height int) Image {
+	if len(input.Planes) == 0 {
+		return Image{}
+	}
+	output := Image{
+		Colorspace: input.Colorspace,
+		Planes:     make([][]byte, len(input.Planes)),
+		Strides:    make([]int, input.Colorspace.Strides),
+	}
+	for i, plane := range input.Planes {
+		w, rows := input.Colorspace.planeSize(i, width, height)
+		output.Planes[i] = make([]byte, w*rows)
+		if i < len(output.Strides) {
+			output.Strides[i] = w
+		}
+		// the planes without their own stride (e.g. the V plane of ColorSpacePlanar) use the last stride
+		stride := input.Strides[len(input.Strides)-1]
+		if i < len(input.Strides) {
+			stride = input.Strides[i]
+		}
+		for y := 0; y < rows; y++ {
+			copy(output.Planes[i][y*w:(y+1)*w], plane[y*stride:])
+		}
+	}
+	return output
+}
+
+func internalImage(cImage C.xvid_image_t, width int, height int) (*Image, error) {
+	if int(cImage.csp) != ColorSpacePlanar.value {
+		return nil, fmt.Errorf("xvid: unexpected encoder internal image colorspace %d", int(cImage.csp))
+	}
+	colorspace := ColorSpacePlanar
+	image := Image{
+		Colorspace:   colorspace,
+		VerticalFlip: false,
+		Planes:       make([][]byte, colorspace.Planes),
+		Strides:      make([]int, colorspace.Planes),
+	}
+	for i := range image.Planes {
+		// the internal buffers are edged, the rows are longer than the image width
+		w, rows := colorspace.planeSize(i, width, height)
+		l := int(cImage.stride[i])*(rows-1) + w
+		sh := reflect.SliceHeader{
+			Data: uintptr(cImage.plane[i]),
+			Len:  l,
+			Cap:  l,
+		}
+		image.Planes[i] = *(*[]byte)(unsafe.Pointer(&sh))
+		image.Strides[i] = int(cImage.stride[i])
+	}
+	return &image, nil
+}
+
+//export pluginCallback
+func pluginCallback(handle unsafe.Pointer, option int, param1 unsafe.Pointer, param2 unsafe.Pointer) int {
+	switch option {
+	case C.XVID_PLG_INFO:
+		cInfo := (*C.xvid_plg_info_t)(param1)
+		e := creatingEncoder
+		for {
+			if _, ok := e.plugins[e.currentPlugin].(pluginInternal); ok {
+				e.currentPlugin++
+				continue
+			}
+			break
+		}
+		cInfo.flags = C.int(e.plugins[e.currentPlugin].Info())
+		e.currentPlugin++
+		return 0
+	case C.XVID_PLG_DESTROY:
+		cDestroy := (*C.xvid_plg_destroy_t)(param1)
+		if cDestroy == nil {
+			// can happen if oom during encoding init, ignore
+			return 0
+		}
+		plugin := lookupGoPlugin(handle).plugin
+		plugin.Close(PluginClose{
+			NumFrames: int(cDestroy.num_frames),
+		})
+		return 0
+	case C.XVID_PLG_CREATE:
+		cCreate := (*C.xvid_plg_create_t)(param1)
+		plugin := lookupGoPlugin(cCreate.param)
+		pluginInit := PluginInit{
+			Zones:             plugin.encoder.zones,
+			Width:             int(cCreate.width),
+			Height:            int(cCreate.height),
+			WidthMacroBlocks:  int(cCreate.mb_width),
+			HeightMacroBlocks: int(cCreate.mb_height),
+			FrameRate:         Fraction{int(cCreate.fbase), int(cCreate.fincr)},
+		}
+		// the handle of the plugin is its parameter
+		*(*unsafe.Pointer)(param2) = cCreate.param
+		if !plugin.plugin.Init(pluginInit) {
+			return -1
+		}
+		return 0
+	case C.XVID_PLG_BEFORE:
+		cData := (*C.xvid_plg_data_t)(param1)
+		plugin := lookupGoPlugin(handle)
+		pluginCall(plugin.encoder, cData, plugin.plugin.Before)
+		return 0
+	case C.XVID_PLG_FRAME:
+		cData := (*C.xvid_plg_data_t)(param1)
+		plugin := lookupGoPlugin(handle)
+		pluginCall(plugin.encoder, cData, plugin.plugin.Frame)
+		return 0
+	case C.XVID_PLG_AFTER:
+		cData := (*C.xvid_plg_data_t)(param1)
+		plugin := lookupGoPlugin(handle)
+		pluginCall(plugin.encoder, cData, plugin.plugin.After)
+		return 0
+	}
+	// should not happen, ignore
+	return 0
+}
+
+// pluginCall calls a plugin frame callback with the plugin data of cData, and writes back the data
+func pluginCall(e *Encoder, cData *C.xvid_plg_data_t, callback func(data *PluginData)) {
+	data := pluginReadData(cData)
+	if data == nil {
+		return
+	}
+	if !pluginGuard {
+		callback(data)
+		pluginWriteData(cData, data)
+		return
+	}
+	e.lastPluginGuard.check()
+	g := newPluginDataGuard(data)
+	callback(data)
+	g.release(data)
+	e.lastPluginGuard = g
+	pluginWriteData(cData, data)
+}
+
+// pluginDataGuard stores the Xvid memory slices of a PluginData, replaced by copies during a callback (only used with
+// the xvid_pluginguard build tag)
+type pluginDataGuard struct {
+	diffQuantizers []int
+	lambda         []float32
+	planes         [][]byte
+	// copies given to the callback, poisoned after it returns
+	copies pluginDataCopies
+}
+
+type pluginDataCopies struct {
+	diffQuantizers []int
+	lambda         []float32
+	planes         [][]byte
+}
+
+const pluginGuardPoisonByte = 0xA5
+const pluginGuardPoisonInt = -0x5A5A5A5A
+
+var pluginGuardPoisonFloat = float32(math.NaN())
+
+func newPluginDataGuard(data *PluginData) *pluginDataGuard {
+	g := &pluginDataGuard{
+		diffQuantizers: data.DiffQuantizers,
+		lambda:         data.Lambda,
+	}
+	if data.DiffQuantizers != nil {
+		data.DiffQuantizers = append([]int(nil), data.DiffQuantizers...)
+		g.copies.diffQuantizers = data.DiffQuantizers
+	}
+	if data.Lambda != nil {
+		data.Lambda = append([]float32(nil), data.Lambda...)
+		g.copies.lambda = data.Lambda
+	}
+	for _, image := range []*Image{&data.Reference, &data.Current, &data.Original} {
+		for j, plane := range image.Planes {
+			g.planes = append(g.planes, plane)
+			image.Planes[j] = append([]byte(nil), plane...)
+			g.copies.planes = append(g.copies.planes, image.Planes[j])
+		}
+	}
+	return g
+}
+
+// release copies the writable data back to the Xvid memory, restores the PluginData slices, and poisons the copies
+func (g *pluginDataGuard) release(data *PluginData) {
+	if g.diffQuantizers != nil {
+		copy(g.diffQuantizers, data.DiffQuantizers)
+		data.DiffQuantizers = g.diffQuantizers
+	}
+	if g.lambda != nil {
+		copy(g.lambda, data.Lambda)
+		data.Lambda = g.lambda
+	}
+	for i := range g.copies.diffQuantizers {
+		g.copies.diffQuantizers[i] = pluginGuardPoisonInt
+	}
+	for i := range g.copies.lambda {
+		g.copies.lambda[i] = pluginGuardPoisonFloat
+	}
+	for _, plane := range g.copies.planes {
+		for i := range plane {
+			plane[i] = pluginGuardPoisonByte
+		}
+	}
+}
+
+// check panics if the poisoned copies were modified after their callback returned
+func (g *pluginDataGuard) check() {
+	if g == nil {
+		return
+	}
+	const msg = "xvid: PluginData slice (%s) modified after its plugin callback returned; " +
+		"PluginData slices alias Xvid memory valid only during the callback, copy them to retain them"
+	for _, v := range g.copies.diffQuantizers {
+		if v != pluginGuardPoisonInt {
+			panic(fmt.Sprintf(msg, "DiffQuantizers"))
+		}
+	}
+	for _, v := range g.copies.lambda {
+		if !math.IsNaN(float64(v)) {
+			panic(fmt.Sprintf(msg, "Lambda"))
+		}
+	}
+	for _, plane := range g.copies.planes {
+		for _, v := range plane {
+			if v != pluginGuardPoisonByte {
+				panic(fmt.Sprintf(msg, "image plane"))
+			}
+		}
+	}
+}
+
+func pluginReadData(cData *C.xvid_plg_data_t) *PluginData {
+	var zone *EncoderZone = nil
+	if cData.zone != nil {
+		zone = &EncoderZone{
+			Frame: int(cData.zone.frame),
+			Mode:  ZoneType(cData.zone.mode),
+			Value: Fraction{int(cData.zone.increment), int(cData.zone.base)},
+		}
+	}
+	pluginData := PluginData{
+		Zone:                 zone,
+		Width:                int(cData.width),
+		Height:               int(cData.height),
+		WidthMacroBlocks:     int(cData.mb_width),
+		HeightMacroBlocks:    int(cData.mb_height),
+		FrameRate:            Fraction{int(cData.fbase), int(cData.fincr)},
+		QuantizerI:           QuantizerRange{int(cData.min_quant[0]), int(cData.max_quant[0])},
+		QuantizerP:           QuantizerRange{int(cData.min_quant[1]), int(cData.max_quant[1])},
+		QuantizerB:           QuantizerRange{int(cData.min_quant[2]), int(cData.max_quant[2])},
+		FrameNum:             int(cData.frame_num),
+		Type:                 FrameType(cData._type),
+		Quantizer:            int(cData.quant),
+		DiffQuantizersStride: int(cData.dquant_stride),
+		VOLFlags:             VOLFlag(cData.vol_flags),
+		VOPFlags:             VOPFlag(cData.vop_flags),
+		MotionFlags:          MotionFlag(cData.motion_flags),
+		BFrameQuantizer:      BFrameQuantizer{int(cData.bquant_ratio), int(cData.bquant_offset)},
+		Stats: EncoderStats{
+			FrameType:     FrameType(cData.stats._type),
+			KeyFrame:      FrameType(cData.stats._type) == FrameTypeI,
+			Quantizer:     int(cData.stats.quant),
+			VOLFlags:      VOLFlag(cData.stats.vol_flags),
+			VOPFlags:      VOPFlag(cData.stats.vop_flags),
+			Length:        int(cData.stats.length),
+			HeaderLength:  int(cData.stats.hlength),
+			IntraBlocks:   int(cData.stats.kblks),
+			InterBlocks:   int(cData.stats.mblks),
+			UncodedBlocks: int(cData.stats.ublks),
+			SSEY:          int(cData.stats.sse_y),
+			SSEU:          int(cData.stats.sse_u),
+			SSEV:          int(cData.stats.sse_v),
+		},
+	}
+	referenceImage, err := internalImage(cData.reference, pluginData.Width, pluginData.Height)
+	if err != nil {
+		// TODO print to stderr?
+		return nil
+	}
+	pluginData.Reference = *referenceImage
+	currentImage, err := internalImage(cData.current, pluginData.Width, pluginData.Height)
+	if err != nil {
+		// TODO print to stderr?
+		return nil
+	}
+	pluginData.Current = *currentImage
+	if cData.original.csp != 0 {
+		originalImage, err := internalImage(cData.original, pluginData.Width, pluginData.Height)
+		if err != nil {
+			// TODO print to stderr?
+			return nil
+		}
+		pluginData.Original = *originalImage
+	}
+	if cData.dquant != nil {
+		l := pluginData.WidthMacroBlocks * pluginData.HeightMacroBlocks
+		if aliasCInts() { // avoid expensive copy if C.int == int
+			pluginData.DiffQuantizers = *(*[]int)(unsafe.Pointer(&reflect.SliceHeader{
+				Data: uintptr(unsafe.Pointer(cData.dquant)),
+				Len:  l,
+				Cap:  l,
+			}))
+		} else {
+			pluginData.DiffQuantizers = make([]int, l)
+			cDiffQuantizers := *(*[]C.int)(unsafe.Pointer(&reflect.SliceHeader{
+				Data: uintptr(unsafe.Pointer(cData.dquant)),
+				Len:  l,
+				Cap:  l,
+			}))
+			for i, v := range cDiffQuantizers {
+				pluginData.DiffQuantizers[i] = int(v)
+			}
+		}
+	}
+	if cData.lambda != nil {
+		n := 6 * pluginData.WidthMacroBlocks * pluginData.HeightMacroBlocks
+		pluginData.Lambda = *(*[]float32)(unsafe.Pointer(&reflect.SliceHeader{
+			Data: uintptr(unsafe.Pointer(cData.lambda)),
+			Len:  n,
+			Cap:  n,
+		}))
+	}
+	return &pluginData
+}
+
+func pluginWriteData(cData *C.xvid_plg_data_t, pluginData *PluginData) {
+	cData._type = C.int(pluginData.Type)
+	cData.quant = C.int(pluginData.Quantizer)
+	if pluginData.DiffQuantizers != nil {
+		if !aliasCInts() { // only copy back if we had copied before
+			cDiffQuantizers := *(*[]C.int)(unsafe.Pointer(&reflect.SliceHeader{
+				Data: uintptr(unsafe.Pointer(cData.dquant)),
+				Len:  len(pluginData.DiffQuantizers),
+				Cap:  len(pluginData.DiffQuantizers),
+			}))
+			for i, v := range pluginData.DiffQuantizers {
+				cDiffQuantizers[i] = C.int(v)
+			}
+		}
+	}
+	cData.vol_flags = C.int(pluginData.VOLFlags)
+	cData.vop_flags = C.int(pluginData.VOPFlags)
+	cData.motion_flags = C.int(pluginData.MotionFlags)
+}
+
+// BufferSize returns the minimal output buffer size for encoding a frame.
+// The Output buffer of an EncoderFrame will automatically be reallocated to
+// this size if it is smaller.
+func BufferSize(width int, height int) int {
+	// inspired by FFMPEG libxvid encoder
+	return 16384 + width*height*30*3/8 + 120 + 8
+}
+
+// EstimateEncoderMemory returns the approximate working set size in bytes of an Encoder encoding frames of the given
+// dimensions, with the given number of threads (see EncoderInit.NumThreads) and maximum sequential B-frames
+// (see EncoderInit.MaxBFrames), to size encoding workers on memory-constrained hosts.
 //
-// Depending on the callback ([B]efore, [F]rame, [A]fter), some fields can be
-// [R]eadable or [W]ritable. To represent this, each field description starts
-// with a list [<B(efore)/F(rame)/A(fter)><R(ead)/W(rite)>, ...].
-// For example [AR,FW] means: writable during Frame, readable during After.
-type PluginData struct {
-	// [BR,FR,AR] current encoder zone, or nil if none
-	Zone *EncoderZone
-	// [BR,FR,AR] frame width in pixels
+// The estimate is approximate: it is based on the main allocations of xvidcore (the edged reference, interpolated,
+// and queued frames, the macroblock tables, and the per-thread buffers), and does not include the plugins memory.
+// Each thread adds about one frame size of working buffers, and each B-frame about two frames.
+func EstimateEncoderMemory(width int, height int, numThreads int, maxBFrames int) int {
+	if numThreads < 0 {
+		numThreads = 0
+	}
+	if maxBFrames < 0 {
+		maxBFrames = 0
+	}
+	mbWidth := (width + 15) / 16
+	mbHeight := (height + 15) / 16
+	// xvid allocates frames with 64 pixels edges, used for unrestricted motion vectors
+	const edge = 64
+	frameSize := (mbWidth*16 + 2*edge) * (mbHeight*16 + 2*edge) * 3 / 2
+	// current & reference, 3 interpolated references, GMC, 2 original copies, B-frames and input queue
+	frames := 2 + 3 + 1 + 2 + maxBFrames + (maxBFrames + 1)
+	// macroblock tables of the current, reference, and B-frames
+	mbSize := 1024
+	mbs := mbWidth * mbHeight * mbSize * (2 + maxBFrames)
+	// per-thread bitstream and motion estimation buffers
+	threads := numThreads * (width*height + 256*1024)
+	return frames*frameSize + mbs + threads + BufferSize(width, height)
+}
+
+// BFrameQuantizer stores parameters for choosing B-frames quantizers.
+// The actual formula used is:
+//   quantizer = (average(pastReferenceQuantizer, futureReferenceQuantizer) * Ratio + Offset) / 100
+type BFrameQuantizer struct {
+	// ratio in percent (see formula); default is 150
+	Ratio int
+	// offset in 0.01 units (see formula); default is 100
+	Offset int
+}
+
+// Encoder is an initialized Xvid encoder.
+// To create a Encoder, use NewEncoder.
+// An Encoder must be closed after use, by calling its Close method.
+// To encode a frame, use the Encode method.
+type Encoder struct {
+	handle        unsafe.Pointer
+	width         int
+	height        int
+	zones         []EncoderZone
+	plugins       []Plugin
+	currentPlugin int
+	destroyFrees  []func()
+	goPlugins     []*goPlugin
+	threads       int
+	closed        bool
+	err           error
+
+	frameTypeSchedule map[int]FrameType
+	gopPattern        string
+	intraOnly         bool
+	// input frame number from which the GOP pattern is applied, i.e. of the last frame forced with ForceKeyFrame
+	gopPatternStart int
+	// number of frames passed to Encode
+	frameNum int
+
+	maxKeyFrameInterval int
+	// number of frames emitted since the last keyframe, -1 before the first keyframe
+	framesSinceKeyFrame int
+	// number of forced keyframes not yet emitted
+	forcedKeyFrames int
+
+	// 4:2:0 image for downsampling ColorSpacePlanar422 input images
+	downsampled Image
+
+	config EncoderConfig
+
+	// guard of the last plugin callback, checked on the next callback (only used with the xvid_pluginguard build tag)
+	lastPluginGuard *pluginDataGuard
+	// configuration the encoder was created from, for Warmup and Reset
+	init EncoderInit
+
+	coalesceFrames bool
+	// data written without a frame, to be returned with the next frame
+	pending []byte
+
+	// Writer for EncodeFrame, and the scratch buffer the frames are encoded to before being written
+	output    io.Writer
+	outputBuf []byte
+
+	// encoded user_data start codes and strings, written after each VOL header
+	userData []byte
+
+	volHeaderInterval int
+	// headers of the last frame carrying a VOL header, and number of frames emitted since
+	volHeader            []byte
+	framesSinceVOLHeader int
+
+	// timestamps of the input frames, starting at input frame timestampsBase
+	timestamps     []time.Duration
+	timestampsBase int
+	// number of emitted frames
+	codedFrames int
+	// number of input frames accepted by the encoder, excluding the flushes
+	inputFrames int
+	// input frame number of the last emitted frame, as seen by xvid plugins, and of the first emitted frame
+	lastFrameNum  *int
+	firstFrameNum int
+	reorderDelay  int
+	frameDuration time.Duration
+
+	// quantizer set by SetNextQuantizer for the next Encode call, 0 if none
+	nextQuantizer int
+	// whether ForceKeyFrame was called since the last input frame
+	forceKeyFrame bool
+
+	frameDropRatio int
+	// number of frames dropped because of the frame drop ratio
+	droppedFrames int
+
+	// cumulative statistics of the emitted frames, see Stats, and sum of their quantizers
+	totals       EncoderTotals
+	quantizerSum int64
+	frameRate    Fraction
+
+	// flags of the last emitted frame, see EffectiveFlags
+	effectiveVOLFlags    VOLFlag
+	effectiveVOPFlags    VOPFlag
+	effectiveMotionFlags MotionFlag
+}
+
+// EncoderInit is information used to create an Encoder in NewEncoder.
+// To initialize an EncoderInit with default values, use NewEncoderInit.
+type EncoderInit struct {
+	// frame width in pixels
 	Width int
-	// [BR,FR,AR] frame height in pixels
+	// frame height in pixels
 	Height int
-	// [BR,FR,AR] frame width in macro blocks
-	WidthMacroBlocks int
-	// [BR,FR,AR] frame height in macro blocks
-	HeightMacroBlocks int
-	// [BR,FR,AR] framerate; Numerator=0 means variable framerate
+
+	// optional encoder profile; default is EncoderAuto for automatic profile selection
+	Profile EncoderProfile
+	// optional encoder bitrate zones, that enforce a specific parameter for a range of frames; must be sorted in increasing frame start order
+	Zones []EncoderZone
+	// optional encoder plugins, run in this order unless reordered with WithPriority
+	Plugins []Plugin
+	// optional number of threads to use for encoding, 0 means single-threaded; default is GetGlobalInfo().NumThreads-1;
+	// the creation can block until the threads are available, and the effective number of threads can be lower,
+	// see SetMaxConcurrentThreads
+	NumThreads int
+	// optional maximum sequential B-frames, 0 means disabling B-frames; default is 2
+	MaxBFrames int
+	// optional global encoder flags; default is no flags
+	Flags EncoderFlag
+
+	// framerate; Numerator=0 means variable framerate; only the Denominator can be changed after initialization
 	FrameRate Fraction
-	// [BR,FR,AR] quantizer range for I frames
+
+	// optional maximum interval between key frames; default is 300; xvidcore has no frame-level parameter to change
+	// it after the creation of the Encoder, it can only be changed with Encoder.Reset; key frames can be forced
+	// at any time with Encoder.ForceKeyFrame
+	MaxKeyFrameInterval int
+	// optional frame dropping ratio in percent between 0 (drop none) to 100 (drop all); default is 0;
+	// a P frame is dropped if the percentage of its coded (not skipped) macroblocks is at most the ratio: it is then
+	// encoded as a minimal not-coded frame, which repeats the previous frame when decoded, so that the frame timing
+	// is kept; I frames (keyframes) and B frames are never dropped; see EncoderStats.Dropped
+	FrameDropRatio int
+
+	// optional B-frames quantizer multipier/offset; used to decide B-frames quantizer when automatic quantizer is used
+	BFrameQuantizer BFrameQuantizer
+
+	// optional quantizer range for I frames
 	QuantizerI QuantizerRange
-	// [BR,FR,AR] quantizer range for P frames
+	// optional quantizer range for P frames
 	QuantizerP QuantizerRange
-	// [BR,FR,AR] quantizer range for B frames
+	// optional quantizer range for B frames
 	QuantizerB QuantizerRange
-	// [BR,FR,AR] frame number
-	FrameNum int
-	// [BR,FR,AR] reference frame
-	Reference Image
-	// [BR,FR,AR] current frame
-	Current Image
-	// [AR] the original (uncompressed) copy of the current frame
-	Original Image
-	// [BR,FR,AR,BW] type of this frame
+
+	// optional starting frame number, relative to the zones start frames; default is 0
+	StartFrameNumber int
+	// optional number of slices to encode for each frame; default is 0, meaning 1 slice
+	NumSlices int
+
+	// optional, whether Encoder.Encode should buffer the data written without a frame (with nil EncoderStats)
+	// internally, and return it with the data of the next frame, so that each chunk returned by Encode is exactly
+	// one complete frame (suitable for packetization); default is false
+	CoalesceFrames bool
+
+	// optional constant quantizer (1-31) used for every frame without any rate-control plugin, for a predictable
+	// quality: I and P frames use it, B frames use it with the BFrameQuantizer ratio and offset applied;
+	// a quantizer set in EncoderFrame.Quantizer or by a rate-control plugin takes precedence;
+	// default is 0, meaning no constant quantizer
+	FixedQuantizer int
+
+	// optional, whether to encode every frame as an I frame (intra-only, like MJPEG), so that every frame can be
+	// decoded independently, for frame-accurate seeking and editing; this overrides MaxBFrames (to 0),
+	// MaxKeyFrameInterval (to 1), FrameTypeSchedule, GOPPattern, and EncoderFrame.Type; default is false.
+	// Intra-only streams are much larger than regular streams at the same quality, typically 3 to 10 times larger,
+	// as no temporal redundancy is used
+	IntraOnly bool
+
+	// optional interval in frames at which the stream headers (VOS, VO and VOL headers, see
+	// EncoderStats.VOLHeaderLength) are repeated before frames, so that decoders joining a live stream mid-way can
+	// be configured without waiting for the next key frame carrying them; the headers are written at most every
+	// interval frames after the last frame carrying them, without forcing key frames, so the GOP length is unchanged;
+	// the overhead is small, typically a few dozen bytes per repetition; default is 0, meaning only at key frames
+	VOLHeaderInterval int
+
+	// optional user_data strings written after each VOL header, e.g. provenance tags read from DecoderStats.UserData;
+	// a string must not contain two consecutive zero bytes, which would emulate a start code; the "XviD" encoder
+	// tag is always written by Xvid, and the DivX5 user data should be enabled with EncoderWriteDivX5UserData instead
+	// of being written here; default is none
+	UserData []string
+
+	// optional memory budget in bytes; if > 0, NewEncoder returns an error if the approximate working set of the
+	// encoder, as returned by EstimateEncoderMemory, exceeds it; default is 0, meaning no budget
+	MemoryBudget int
+
+	// optional forced frame types, keyed by frame number (the index of the frame passed to Encoder.Encode, starting
+	// at 0, regardless of StartFrameNumber); the frame type of the schedule is only used for frames whose
+	// EncoderFrame.Type is FrameTypeAuto, a per-frame Type takes precedence over the schedule;
+	// frame 0 cannot be FrameTypeB, and FrameTypeB can only be used if MaxBFrames > 0; to repeat a GOP structure
+	// (e.g. IBBPBBP...) rather than scheduling each frame, use GOPPattern instead
+	FrameTypeSchedule map[int]FrameType
+
+	// optional repeating pattern of frame types, in input order, e.g. "IBBP" for the IBBPBBPBBP... GOP structure,
+	// for reproducible GOP structures: the pattern must start with 'I', the key frame starting each GOP, followed by
+	// 'P' and 'B' characters that are repeated cyclically until the next key frame; key frames are forced every
+	// MaxKeyFrameInterval frames (from the first frame, or from the last key frame forced with Encoder.ForceKeyFrame,
+	// at which the pattern restarts); sequences of 'B' (including across repetitions) must not be longer than
+	// MaxBFrames; frame types set in FrameTypeSchedule or EncoderFrame.Type take precedence; default is "",
+	// meaning frame types are chosen by Xvid
+	GOPPattern string
+
+	// optional Writer to which Encoder.EncodeFrame writes the encoded data; it is not closed automatically, it has
+	// to be caller-closed after the Encoder is finished; default is nil, meaning EncodeFrame cannot be used
+	Output io.Writer
+}
+
+// EncoderZone is a bitrate enforcement zone used for encoding, which applies during
+// a range of frames, starting on its Frame (inclusive) and ending on the next EncoderZone frame
+// (exclusive).
+type EncoderZone struct {
+	// start frame (inclusive) of the zone
+	Frame int
+	// zone type
+	Mode ZoneType
+	// value, meaning depends on the ZoneType used
+	Value Fraction
+}
+
+// MPEGIntraMatrix returns the default MPEG-4 quantizer matrix for intraframe encoding, in 8x8 row-major order,
+// to be used as EncoderFrame.QuantizerIntraMatrix. The returned slice is a new copy that can be modified.
+func MPEGIntraMatrix() []uint8 {
+	return []uint8{
+		8, 17, 18, 19, 21, 23, 25, 27,
+		17, 18, 19, 21, 23, 25, 27, 28,
+		20, 21, 22, 23, 24, 26, 28, 30,
+		21, 22, 23, 24, 26, 28, 30, 32,
+		22, 23, 24, 26, 28, 30, 32, 35,
+		23, 24, 26, 28, 30, 32, 35, 38,
+		25, 26, 28, 30, 32, 35, 38, 41,
+		27, 28, 30, 32, 35, 38, 41, 45,
+	}
+}
+
+// MPEGInterMatrix returns the default MPEG-4 quantizer matrix for interframe encoding, in 8x8 row-major order,
+// to be used as EncoderFrame.QuantizerInterMatrix. The returned slice is a new copy that can be modified.
+func MPEGInterMatrix() []uint8 {
+	return []uint8{
+		16, 17, 18, 19, 20, 21, 22, 23,
+		17, 18, 19, 20, 21, 22, 23, 24,
+		18, 19, 20, 21, 22, 23, 24, 25,
+		19, 20, 21, 22, 23, 24, 26, 27,
+		20, 21, 22, 23, 25, 26, 27, 28,
+		21, 22, 23, 24, 26, 27, 28, 30,
+		22, 23, 24, 26, 27, 28, 30, 31,
+		23, 24, 25, 27, 28, 30, 31, 33,
+	}
+}
+
+// H263Matrix returns a flat quantizer matrix (all coefficients are 16), in 8x8 row-major order, that weights all
+// the frequencies equally like H.263 quantization, to be used as EncoderFrame.QuantizerIntraMatrix or
+// EncoderFrame.QuantizerInterMatrix with VOLMPEGQuantization. The H.263 quantization itself (used when
+// VOLMPEGQuantization is not set) does not use matrices. The returned slice is a new copy that can be modified.
+func H263Matrix() []uint8 {
+	m := make([]uint8, 64)
+	for i := range m {
+		m[i] = 16
+	}
+	return m
+}
+
+// checkQuantizerMatrix returns an error if a quantizer matrix does not have 64 coefficients in the range 1-255
+func checkQuantizerMatrix(name string, matrix []uint8) error {
+	if len(matrix) != 64 {
+		return fmt.Errorf("xvid: expected quantization %s table of 64 coefficients, got %d", name, len(matrix))
+	}
+	for i, v := range matrix {
+		if v == 0 {
+			return fmt.Errorf("xvid: invalid zero coefficient %d in quantization %s table, must be in range 1-255", i, name)
+		}
+	}
+	return nil
+}
+
+// Preset is a set of encoding flags for a speed/quality tradeoff, to be applied to each EncoderFrame with Apply,
+// as returned by PresetUltraFast, PresetBalanced and PresetBestQuality. Its flags can be adjusted before use.
+type Preset struct {
+	// flags for the group of pictures, see EncoderFrame.VOLFlags
+	VOLFlags VOLFlag
+	// encoding flags, see EncoderFrame.VOPFlags
+	VOPFlags VOPFlag
+	// motion estimation flags, see EncoderFrame.MotionFlags
+	MotionFlags MotionFlag
+}
+
+// PresetUltraFast returns the fastest preset, with the lowest quality: it only enables the advanced diamond
+// search for 16x16 blocks (MotionAdvancedDiamond16), without subpixel motion estimation.
+func PresetUltraFast() Preset {
+	return Preset{
+		MotionFlags: MotionAdvancedDiamond16,
+	}
+}
+
+// PresetBalanced returns a preset with a good speed/quality tradeoff, similar to the default quality of the
+// reference Xvid encoder: it enables half pixel motion estimation (VOPHalfPixel), four motion vectors per
+// macroblock (VOPInter4Vectors), trellis quantization (VOPTrellisQuantization), high quality AC prediction
+// (VOPHighQualityACPrediction), advanced diamond search and half pixel refinement for both 16x16 and 8x8 blocks
+// (MotionAdvancedDiamond16, MotionAdvancedDiamond8, MotionHalfPixelRefine16, MotionHalfPixelRefine8), and chroma
+// motion estimation (MotionChromaPFrame, MotionChromaBFrame).
+func PresetBalanced() Preset {
+	return Preset{
+		VOPFlags: VOPHalfPixel | VOPInter4Vectors | VOPTrellisQuantization | VOPHighQualityACPrediction,
+		MotionFlags: MotionAdvancedDiamond16 | MotionAdvancedDiamond8 | MotionHalfPixelRefine16 | MotionHalfPixelRefine8 |
+			MotionChromaPFrame | MotionChromaBFrame,
+	}
+}
+
+// PresetBestQuality returns the slowest preset, with the best quality: in addition to the flags of PresetBalanced,
+// it enables rate-distortion mode decision (VOPModeDecisionRD, VOPRateDistortionBFrames), extended search for both
+// 16x16 and 8x8 blocks (MotionExtendSearch16, MotionExtendSearch8), quarter pixel refinement (MotionQuarterPixelRefine16,
+// MotionQuarterPixelRefine8), and the rate-distortion refinements (MotionHalfPixelRefine16RD, MotionHalfPixelRefine8RD,
+// MotionQuarterPixelRefine16RD, MotionQuarterPixelRefine8RD, MotionExtendSearchRD, MotionCheckPredictionRD).
+//
+// It does not enable VOLQuarterPixel, which is not supported by many hardware decoders, so that the quarter pixel
+// refinements have no effect unless it is added to VOLFlags.
+func PresetBestQuality() Preset {
+	p := PresetBalanced()
+	p.VOPFlags |= VOPModeDecisionRD | VOPRateDistortionBFrames
+	p.MotionFlags |= MotionExtendSearch16 | MotionExtendSearch8 | MotionQuarterPixelRefine16 | MotionQuarterPixelRefine8 |
+		MotionHalfPixelRefine16RD | MotionHalfPixelRefine8RD | MotionQuarterPixelRefine16RD | MotionQuarterPixelRefine8RD |
+		MotionExtendSearchRD | MotionCheckPredictionRD
+	return p
+}
+
+// Apply adds the flags of the preset to the flags of frame.
+func (p Preset) Apply(frame *EncoderFrame) {
+	frame.VOLFlags |= p.VOLFlags
+	frame.VOPFlags |= p.VOPFlags
+	frame.MotionFlags |= p.MotionFlags
+}
+
+// EncoderFrame is information used when encoding a frame in Encoder.Encode.
+// Its only required fields are the Input Image and its Output buffer.
+type EncoderFrame struct {
+	// input image to encode
+	Input *Image
+	// buffer to store the encoded frame data into, if pointing to a nil or too small slice, will realloc it to the minimum buffer size as returned by BufferSize
+	Output *[]byte
+
+	// optional flags for the next group of pictures; the encoder will not react to any changes until the next VOL (keyframe)
+	VOLFlags VOLFlag
+	// optional 8x8 row-major quantizer matrix for intraframe encoding, with coefficients in the range 1-255, used with
+	// VOLMPEGQuantization, e.g. MPEGIntraMatrix()
+	QuantizerIntraMatrix []uint8
+	// optional 8x8 row-major quantizer matrix for interframe encoding, with coefficients in the range 1-255, used
+	// with VOLMPEGQuantization, e.g. MPEGInterMatrix()
+	QuantizerInterMatrix []uint8
+	// optional pixel aspect ratio, defaults to square pixel
+	PixelAspectRatio PixelAspectRatio
+
+	// optional; sets the frame rate by changing the Denominator of the frame rate fraction defined in Init; default means unchanged frame rate
+	FrameRateDenominator int
+	// optional encoding flags for this frame, see Preset for common sets of flags
+	VOPFlags VOPFlag
+	// optional motion estimation flags for this frame, see Preset for common sets of flags
+	MotionFlags MotionFlag
+
+	// optional forced type for this frame, defaults to FrameTypeAuto; the first frame of a stream is always
+	// encoded as an I frame carrying the VOL, so that the stream is decodable: a conflicting type forced on
+	// the first frame is ignored, with a warning printed to standard error if DebugError is set (see InitWithFlags)
 	Type FrameType
-	// [BR,FR,AR,BW,FW] quantizer used for this frame
+	// optional quantizer for this frame, 0 defaults to automatic rate-controlled quantizer, recommended range is 2-31
+	Quantizer int
+	// optional adjustment for choosing between encoding a P-frame or a B-frame; > 0 means more B-frames, <0 means less B-frames
+	BFrameThreshold int
+	// optional precision of the intra DC coefficients in bits; xvidcore does not expose this setting and always
+	// uses 8 bits (the only precision of the MPEG-4 Simple and Advanced Simple profiles, supported by all decoders),
+	// so only 0 (default) and 8 are accepted, other values are rejected by Encode; the effective DC precision
+	// still depends on the quantizer, through the DC scaler: use a lower Quantizer for a finer DC precision
+	IntraDCPrecision int
+	// optional filter used to downsample the chroma of a ColorSpacePlanar422 input image; default is ChromaFilterAverage
+	ChromaFilter ChromaFilter
+	// optional presentation timestamp of the frame, returned in EncoderStats.PTS when the frame is emitted;
+	// timestamps must be increasing
+	Timestamp time.Duration
+
+	// advanced, optional raw xvidcore VOL flags, bitwise-or'd with VOLFlags; not validated, for experimenting with
+	// xvidcore flags that have no VOLFlag constant
+	RawVOLFlags uint
+	// advanced, optional raw xvidcore VOP flags, bitwise-or'd with VOPFlags; not validated, for experimenting with
+	// xvidcore flags that have no VOPFlag constant
+	RawVOPFlags uint
+	// advanced, optional raw xvidcore motion estimation flags, bitwise-or'd with MotionFlags; not validated, for
+	// experimenting with xvidcore flags that have no MotionFlag constant
+	RawMotionFlags uint
+}
+
+// EncoderStats is information about an encoded frame, returned by Encoder.Encode.
+type EncoderStats struct {
+	// frame type of the encoded frame
+	FrameType FrameType
+	// whether this frame was encoded as an I frame
+	KeyFrame bool
+	// quantizer used for the frame
 	Quantizer int
-	// [AR,FW] diff quantizers for this frame, only present if PluginRequireDiffQuantizer was set during Info()
-	DiffQuantizers []int
-	// [FR,AR] diff quantizers stride (quantizers per row), only set if PluginRequireDiffQuantizer was set during Info()
-	DiffQuantizersStride int
-	// [BR,AR,BW] actual group of pictures flags
+	// actual VOL flags used for the frame
 	VOLFlags VOLFlag
-	// [BR,AR,BW] encoding flags for this frame
+	// actual VOP flags used for the frame
 	VOPFlags VOPFlag
-	// [BR,AR,BW] motion estimation flags for this frame
-	MotionFlags MotionFlag
-	// [FW] lambda table for this frame, only present if PluginRequireLambda was set during Info(); six floats for each macroblock
-	Lambda []float32
-	// [BR,FR,AR] B-frames quantizer multipier/offset; used to decide B-frames quantizer when automatic quantizer is used
-	BFrameQuantizer BFrameQuantizer
-	// [AR] frame statistics
-	Stats EncoderStats
+	// length of frame in bytes
+	Length int
+	// length of frame header in bytes
+	HeaderLength int
+	// number of blocks coded as intra
+	IntraBlocks int
+	// number of blocks coded as inter
+	InterBlocks int
+	// number of blocks not coded
+	UncodedBlocks int
+
+	// only present if VOLExtraStats is set; Y plane SSE; see PSNR
+	SSEY int
+	// only present if VOLExtraStats is set; U plane SSE
+	SSEU int
+	// only present if VOLExtraStats is set; V plane SSE
+	SSEV int
+
+	// only meaningful for interlaced frames (if VOLInterlacing is set in VOLFlags), whether the frame was encoded
+	// with the upper (top) field first, as read from the VOP flags actually used (see VOPUpperFieldFirst), to check
+	// that it matches the field order of the source; mirrors DecoderStatsFrame.UpperFieldFirst; false otherwise
+	UpperFieldFirst bool
+
+	// only set by Encoder.Encode; whether this frame is a keyframe that was inserted by xvid because of a scene change,
+	// i.e. a keyframe that was neither forced with FrameTypeI, nor the first frame, nor inserted because the
+	// EncoderInit.MaxKeyFrameInterval was reached; xvidcore does not expose a scene change sensitivity setting nor
+	// a scene change flag, so that this is derived from the keyframe placement; see also SceneChangeScore
+	SceneChange bool
+	// only set by Encoder.Encode; presentation timestamp of the frame, the EncoderFrame.Timestamp of its input frame;
+	// frames are emitted in coding order, so that with B-frames the PTS are not increasing
+	PTS time.Duration
+	// only set by Encoder.Encode; decoding timestamp of the frame, increasing (and at most PTS for a constant
+	// framerate): the Timestamp of the n-th input frame for the n-th emitted frame, minus Encoder.ReorderDelay
+	// frame durations (from EncoderInit.FrameRate, or 1ms for variable framerate)
+	DTS time.Duration
+	// only set by Encoder.Encode; length in bytes of the stream headers (VOS, VO and VOL headers and their user data)
+	// at the start of the returned data, which can be stored separately as the codec configuration (e.g. the
+	// decoder specific info of MP4 containers), the rest of the data being the frame itself; only non-zero for
+	// frames carrying a VOL header, i.e. the first frame and the key frames on which Xvid repeats the headers
+	VOLHeaderLength int
+	// only set by Encoder.Encode, if EncoderInit.FrameDropRatio is set; whether this frame was probably dropped
+	// because of the FrameDropRatio (see Encoder.DroppedFrameCount); this is a heuristic: xvidcore does not report
+	// dropped frames, so that the P frames without any coded macroblock are reported as dropped, which also
+	// includes the frames of a static scene that would be fully skipped without frame dropping
+	Dropped bool
+
+	// encoder dimensions when the frame was encoded, see PSNR
+	width  int
+	height int
+}
+
+// SceneChangeScore returns a scene change score of the frame in the range 0-1: the ratio of the blocks coded as
+// intra (IntraBlocks) over the coded blocks (IntraBlocks and InterBlocks), or 0 if no block is coded, e.g. for a
+// fully skipped frame. It is 1 for I frames, and close to 1 for P frames that could not be predicted from their
+// reference frame, e.g. P frames right after a cut that xvid did not encode as a keyframe (for example because
+// of a forced frame type): unlike SceneChange, it can be used with a custom threshold to detect cuts.
+func (s EncoderStats) SceneChangeScore() float64 {
+	total := s.IntraBlocks + s.InterBlocks
+	if total == 0 {
+		return 0
+	}
+	return float64(s.IntraBlocks) / float64(total)
+}
+
+// PSNR returns the PSNR in dB of the Y, U and V planes of the encoded frame, computed from SSEY, SSEU and SSEV, and
+// the PSNR of the whole frame (computed from the sum of the SSE of all planes, rather than the mean of the PSNR of
+// the planes, which is biased towards the planes that are encoded losslessly). The PSNR of a plane encoded
+// losslessly (with an SSE of 0) is +Inf. All values are NaN if the SSE was not computed, i.e. if VOLExtraStats is
+// not set in VOLFlags, or if the stats were not returned by Encoder.Encode.
+func (s EncoderStats) PSNR() (y float64, u float64, v float64, avg float64) {
+	if s.VOLFlags&VOLExtraStats == 0 || s.width <= 0 || s.height <= 0 {
+		nan := math.NaN()
+		return nan, nan, nan, nan
+	}
+	n := s.width * s.height
+	y = psnrFromSSE(int64(s.SSEY), n)
+	u = psnrFromSSE(int64(s.SSEU), n/4)
+	v = psnrFromSSE(int64(s.SSEV), n/4)
+	avg = psnrFromSSE(int64(s.SSEY)+int64(s.SSEU)+int64(s.SSEV), n+n/4*2)
+	return y, u, v, avg
+}
+
+// KeyframeIntervalForSeekLatency returns the maximum interval between key frames, to be used in
+// EncoderInit.MaxKeyFrameInterval, so that seeking to any frame of a stream of the given frame rate requires
+// decoding at most maxSeekLatency of video from the previous key frame. The returned interval is at least 1.
+//
+// Short intervals have a compression cost: key frames are typically several times larger than predicted frames,
+// so at a constant quality the bitrate increases quickly when the interval is below a few seconds of video.
+func KeyframeIntervalForSeekLatency(fps Fraction, maxSeekLatency time.Duration) int {
+	if fps.Numerator <= 0 || fps.Denominator <= 0 {
+		return 1
+	}
+	interval := int(int64(maxSeekLatency) * int64(fps.Numerator) / (int64(fps.Denominator) * int64(time.Second)))
+	if interval < 1 {
+		return 1
+	}
+	return interval
+}
+
+// AdaptiveBFrameController is a pre-Encode hook that discourages B-frames during high-motion sections, e.g. to
+// reduce latency, by setting EncoderFrame.BFrameThreshold from the motion of the previously encoded frames.
+// It can only reduce the number of B-frames: Xvid never uses more sequential B-frames than EncoderInit.MaxBFrames.
+// To create an AdaptiveBFrameController, use NewAdaptiveBFrameController.
+type AdaptiveBFrameController struct {
+	threshold  int
+	highMotion bool
+}
+
+// NewAdaptiveBFrameController returns an AdaptiveBFrameController considering the motion high when the percentage
+// of coded (not skipped) macroblocks of the last predicted (P or B) frame is greater than threshold (0-100).
+//
+// For each frame, call Apply on the EncoderFrame before Encoder.Encode, then Update with the returned EncoderStats.
+func NewAdaptiveBFrameController(threshold int) *AdaptiveBFrameController {
+	return &AdaptiveBFrameController{threshold: threshold}
+}
+
+// Apply sets the BFrameThreshold of a frame to be encoded: to -255 (strongly discouraging B-frames) if the motion
+// is high, and 0 (the default) otherwise.
+func (c *AdaptiveBFrameController) Apply(frame *EncoderFrame) {
+	if c.highMotion {
+		frame.BFrameThreshold = -255
+	} else {
+		frame.BFrameThreshold = 0
+	}
+}
+
+// Update updates the motion estimate with the stats of an encoded frame, as returned by Encoder.Encode; stats can be
+// nil, and stats of key frames are ignored.
+func (c *AdaptiveBFrameController) Update(stats *EncoderStats) {
+	if stats == nil || (stats.FrameType != FrameTypeP && stats.FrameType != FrameTypeB) {
+		return
+	}
+	total := stats.IntraBlocks + stats.InterBlocks + stats.UncodedBlocks
+	if total == 0 {
+		return
+	}
+	c.highMotion = (stats.IntraBlocks+stats.InterBlocks)*100/total > c.threshold
+}
+
+// checkEncoderInit returns an error naming the invalid field if the basic fields of init are invalid, rather than
+// letting xvidcore fail with an opaque ErrFail
+func checkEncoderInit(init *EncoderInit) error {
+	if init.Width <= 0 || init.Height <= 0 {
+		return fmt.Errorf("xvid: invalid dimensions %dx%d, Width and Height must be positive", init.Width, init.Height)
+	}
+	if init.FrameRate.Numerator < 0 || init.FrameRate.Denominator < 0 {
+		return fmt.Errorf("xvid: invalid FrameRate %d/%d, must not be negative", init.FrameRate.Numerator, init.FrameRate.Denominator)
+	}
+	if init.FrameRate.Numerator > 0 && init.FrameRate.Denominator == 0 {
+		return fmt.Errorf("xvid: invalid FrameRate %d/0, Denominator must not be zero", init.FrameRate.Numerator)
+	}
+	if init.MaxBFrames < 0 {
+		return fmt.Errorf("xvid: invalid negative MaxBFrames %d", init.MaxBFrames)
+	}
+	if init.NumSlices < 0 {
+		return fmt.Errorf("xvid: invalid negative NumSlices %d", init.NumSlices)
+	}
+	if init.NumThreads < 0 {
+		return fmt.Errorf("xvid: invalid negative NumThreads %d", init.NumThreads)
+	}
+	if init.MaxKeyFrameInterval < 0 {
+		return fmt.Errorf("xvid: invalid negative MaxKeyFrameInterval %d", init.MaxKeyFrameInterval)
+	}
+	for _, q := range []struct {
+		name string
+		r    QuantizerRange
+	}{{"QuantizerI", init.QuantizerI}, {"QuantizerP", init.QuantizerP}, {"QuantizerB", init.QuantizerB}} {
+		min, max := q.r.Min, q.r.Max
+		if min < 0 || min > 31 || max < 0 || max > 31 {
+			return fmt.Errorf("xvid: invalid %s range %d-%d, Min and Max must be between 1 and 31", q.name, min, max)
+		}
+		// only the default Min can be greater than a valid Max
+		defaults := ""
+		if min == 0 {
+			min = 2
+			defaults = " (with the default Min of 2)"
+		}
+		if max == 0 {
+			max = 31
+		}
+		if min > max {
+			return fmt.Errorf("xvid: invalid %s range %d-%d%s, Min must not be greater than Max", q.name, q.r.Min, q.r.Max, defaults)
+		}
+	}
+	return nil
+}
+
+// checkGOPPattern returns an error if the GOP pattern is invalid, see EncoderInit.GOPPattern
+func checkGOPPattern(pattern string, maxBFrames int) error {
+	if pattern == "" {
+		return nil
+	}
+	if pattern[0] != 'I' {
+		return fmt.Errorf("xvid: invalid GOP pattern %q, must start with 'I'", pattern)
+	}
+	body := pattern[1:]
+	for _, c := range body {
+		if c != 'P' && c != 'B' {
+			return fmt.Errorf("xvid: invalid GOP pattern %q, must only contain 'P' and 'B' after the first 'I'", pattern)
+		}
+	}
+	// check the B-frames sequences across repetitions of the pattern
+	b := 0
+	for _, c := range body + body {
+		if c != 'B' {
+			b = 0
+			continue
+		}
+		b++
+		if b > maxBFrames {
+			return fmt.Errorf("xvid: invalid GOP pattern %q, has sequences of more B-frames than MaxBFrames (%d)", pattern, maxBFrames)
+		}
+	}
+	return nil
+}
+
+// gopPatternType returns the frame type of input frame i according to the GOP pattern
+func (e *Encoder) gopPatternType(i int) FrameType {
+	if e.maxKeyFrameInterval > 0 {
+		i %= e.maxKeyFrameInterval
+	}
+	if i == 0 || len(e.gopPattern) == 1 {
+		return FrameTypeI
+	}
+	if e.gopPattern[1+(i-1)%(len(e.gopPattern)-1)] == 'B' {
+		return FrameTypeB
+	}
+	return FrameTypeP
+}
+
+// NewEncoderInit returns an EncoderInit initialized with the default encoding parameters.
+//
+// In Xvid rate-control is done with plugins: either 1-pass with PluginRC1Pass, or 2-pass
+// with PluginRC2Pass1 (on the first pass) and PluginRC2Pass2 (on the second pass).
+// For a constant quantizer without rate control, set EncoderInit.FixedQuantizer instead.
+func NewEncoderInit(width int, height int, frameRate Fraction, plugins []Plugin) *EncoderInit {
+	nThreads := 1
+	if info, err := GetGlobalInfo(); err == nil && info.NumThreads > 2 {
+		nThreads = info.NumThreads - 1
+	}
+	return &EncoderInit{
+		Width:  width,
+		Height: height,
+
+		Profile:    EncoderProfileAuto,
+		Zones:      nil,
+		Plugins:    plugins,
+		NumThreads: nThreads,
+		MaxBFrames: 2,
+		Flags:      0,
+
+		FrameRate: Fraction{frameRate.Numerator, frameRate.Denominator},
+
+		MaxKeyFrameInterval: 300,
+		FrameDropRatio:      0,
+
+		BFrameQuantizer: BFrameQuantizer{150, 100},
+
+		QuantizerI: QuantizerRange{},
+		QuantizerP: QuantizerRange{},
+		QuantizerB: QuantizerRange{},
+
+		StartFrameNumber: 0,
+		NumSlices:        1,
+	}
+}
+
+// NewEncoder creates a new Encoder based on a EncoderInit configuration. Init (or InitWithFlags) must be called once before calling this function.
+// Once created and finished using, an Encoder must be freed by calling Encoder.Close(); as a safety net, an Encoder
+// that was not closed is closed when it is garbage collected.
+// The Encoder is non-nil if and only if the returned error is nil.
+// The EncoderInit fields are validated first, and an error naming the invalid field is returned (e.g. for
+// non-positive dimensions or a quantizer range outside 1-31); an internal error can then be returned by Xvid,
+// in which case the Encoder won't be created.
+func NewEncoder(init *EncoderInit) (*Encoder, error) {
+	if init == nil {
+		return nil, errors.New("EncoderInit must not be nil")
+	}
+	var e Encoder
+	if err := e.create(init); err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(&e, (*Encoder).finalize)
+	return &e, nil
+}
+
+// finalize closes an Encoder that was garbage collected without being closed, to free its native encoder
+func (e *Encoder) finalize() {
+	if e.closed {
+		return
+	}
+	warnNotClosed("Encoder")
+	e.Close()
+}
+
+// checkEncoderCreate returns the effective EncoderInit of an Encoder (with IntraOnly applied), or an error if it is
+// invalid, before creating the native encoder
+func checkEncoderCreate(init *EncoderInit) (*EncoderInit, error) {
+	if init.IntraOnly {
+		intraInit := *init
+		intraInit.MaxBFrames = 0
+		intraInit.MaxKeyFrameInterval = 1
+		intraInit.FrameTypeSchedule = nil
+		intraInit.GOPPattern = ""
+		init = &intraInit
+	}
+	if err := checkEncoderInit(init); err != nil {
+		return nil, err
+	}
+	if init.FrameDropRatio < 0 || init.FrameDropRatio > 100 {
+		return nil, fmt.Errorf("xvid: invalid frame drop ratio %d, must be between 0 and 100", init.FrameDropRatio)
+	}
+	if init.MemoryBudget > 0 {
+		if m := EstimateEncoderMemory(init.Width, init.Height, init.NumThreads, init.MaxBFrames); m > init.MemoryBudget {
+			for threads := init.NumThreads - 1; threads >= 0; threads-- {
+				if EstimateEncoderMemory(init.Width, init.Height, threads, init.MaxBFrames) <= init.MemoryBudget {
+					return nil, fmt.Errorf("xvid: estimated encoder memory %d bytes exceeds the memory budget of %d bytes, use at most %d threads (0 meaning single-threaded)", m, init.MemoryBudget, threads)
+				}
+			}
+			return nil, fmt.Errorf("xvid: estimated encoder memory %d bytes exceeds the memory budget of %d bytes, even single-threaded: use fewer B-frames or smaller frames", m, init.MemoryBudget)
+		}
+	}
+	for frame, frameType := range init.FrameTypeSchedule {
+		if frame < 0 {
+			return nil, fmt.Errorf("xvid: invalid negative frame number %d in frame type schedule", frame)
+		}
+		switch frameType {
+		case FrameTypeAuto, FrameTypeI, FrameTypeP, FrameTypeS:
+		case FrameTypeB:
+			if frame == 0 {
+				return nil, errors.New("xvid: invalid frame type schedule, frame 0 cannot be a B-frame")
+			}
+			if init.MaxBFrames <= 0 {
+				return nil, fmt.Errorf("xvid: invalid frame type schedule, frame %d is a B-frame but B-frames are disabled (MaxBFrames is 0)", frame)
+			}
+		default:
+			return nil, fmt.Errorf("xvid: invalid frame type %d for frame %d in frame type schedule", frameType, frame)
+		}
+	}
+	for _, u := range init.UserData {
+		if strings.Contains(u, "\x00\x00") {
+			return nil, fmt.Errorf("xvid: invalid user data %q, must not contain two consecutive zero bytes", u)
+		}
+	}
+	if err := checkGOPPattern(init.GOPPattern, init.MaxBFrames); err != nil {
+		return nil, err
+	}
+	if init.VOLHeaderInterval < 0 {
+		return nil, fmt.Errorf("xvid: invalid negative VOL header interval %d", init.VOLHeaderInterval)
+	}
+	if init.FixedQuantizer < 0 || init.FixedQuantizer > 31 {
+		return nil, fmt.Errorf("xvid: invalid fixed quantizer %d, must be between 1 and 31", init.FixedQuantizer)
+	}
+	for _, v := range orderPlugins(init.Plugins) {
+		if pi, ok := v.(pluginInternal); ok && pi.supported != nil {
+			if err := requireFeature(pi.feature, pi.supported); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return init, nil
+}
+
+// create creates the native encoder and resets the encoder state based on a EncoderInit configuration
+func (e *Encoder) create(init *EncoderInit) error {
+	init, err := checkEncoderCreate(init)
+	if err != nil {
+		return err
+	}
+	e.init = *init
+	e.userData = e.userData[:0]
+	for _, u := range init.UserData {
+		e.userData = append(e.userData, 0, 0, 1, 0xb2)
+		e.userData = append(e.userData, u...)
+	}
+	e.frameTypeSchedule = init.FrameTypeSchedule
+	e.gopPattern = init.GOPPattern
+	e.gopPatternStart = 0
+	e.intraOnly = init.IntraOnly
+	e.frameNum = 0
+	e.width = init.Width
+	e.height = init.Height
+	e.zones = init.Zones
+	e.currentPlugin = 0
+	e.maxKeyFrameInterval = init.MaxKeyFrameInterval
+	e.framesSinceKeyFrame = -1
+	e.forcedKeyFrames = 0
+	e.forceKeyFrame = false
+	e.config = newEncoderConfig(init)
+	e.coalesceFrames = init.CoalesceFrames
+	e.output = init.Output
+	e.frameDropRatio = init.FrameDropRatio
+	e.timestamps = e.timestamps[:0]
+	e.timestampsBase = 0
+	e.codedFrames = 0
+	e.inputFrames = 0
+	e.firstFrameNum = -1
+	e.reorderDelay = 0
+	if init.MaxBFrames > 0 {
+		e.reorderDelay = 1
+	}
+	e.frameDuration = time.Millisecond
+	if init.FrameRate.Numerator > 0 {
+		e.frameDuration = time.Duration(int64(init.FrameRate.Denominator) * int64(time.Second) / int64(init.FrameRate.Numerator))
+	}
+	e.droppedFrames = 0
+	e.totals = EncoderTotals{}
+	e.quantizerSum = 0
+	e.frameRate = init.FrameRate
+	e.nextQuantizer = 0
+	e.pending = e.pending[:0]
+	e.effectiveVOLFlags = 0
+	e.effectiveVOPFlags = 0
+	e.effectiveMotionFlags = 0
+	if e.maxKeyFrameInterval <= 0 && init.FrameRate.Denominator != 0 {
+		// xvid default: 10 seconds
+		e.maxKeyFrameInterval = 10 * init.FrameRate.Numerator / init.FrameRate.Denominator
+	}
+	var cZonesPtr *C.xvid_enc_zone_t = nil
+	if len(init.Zones) > 0 {
+		cZones := make([]C.xvid_enc_zone_t, len(init.Zones))
+		for i, z := range init.Zones {
+			cZones[i] = C.xvid_enc_zone_t{
+				frame:     C.int(z.Frame),
+				mode:      C.int(z.Mode),
+				increment: C.int(z.Value.Numerator),
+				base:      C.int(z.Value.Denominator),
+			}
+		}
+		cZonesPtr = &cZones[0]
+	}
+	e.volHeaderInterval = init.VOLHeaderInterval
+	e.volHeader = e.volHeader[:0]
+	e.framesSinceVOLHeader = 0
+	plugins := orderPlugins(init.Plugins)
+	if init.FixedQuantizer > 0 {
+		plugins = append(plugins, fixedQuantizer{quantizer: init.FixedQuantizer})
+	}
+	// records the input frame number of the emitted frames, for their timestamps; without B-frames, the frames are
+	// emitted in input order
+	e.lastFrameNum = nil
+	if e.reorderDelay > 0 {
+		e.lastFrameNum = new(int)
+		plugins = append(plugins, frameNumRecorder{lastFrameNum: e.lastFrameNum})
+	}
+	var frees []func()
+	e.plugins = nil
+	e.destroyFrees = nil
+	e.goPlugins = nil
+	var cPluginsPtr *C.xvid_enc_plugin_t = nil
+	if len(plugins) > 0 {
+		cPlugins := make([]C.xvid_enc_plugin_t, len(plugins))
+		cPluginsPtr = &cPlugins[0]
+		e.plugins = plugins
+		for i, v := range plugins {
+			if pi, ok := v.(pluginInternal); ok {
+				cPlugins[i] = pi.cPlugin
+				if pi.newParam != nil {
+					param, free, destroyFree := pi.newParam()
+					cPlugins[i].param = param
+					if free != nil {
+						frees = append(frees, free)
+					}
+					if destroyFree != nil {
+						e.destroyFrees = append(e.destroyFrees, destroyFree)
+					}
+				}
+			} else {
+				param, unregister := registerGoPlugin(e, v)
+				e.destroyFrees = append(e.destroyFrees, unregister)
+				cPlugins[i] = C.xvid_enc_plugin_t{
+					_func: (*C.xvid_plugin_func)(unsafe.Pointer(C.pluginCallback_cgo)),
+					param: param,
+				}
+			}
+		}
+	}
+
+	cEncoreCreate := C.xvid_enc_create_t{
+		version:          C.XVID_VERSION,
+		profile:          C.int(init.Profile),
+		width:            C.int(init.Width),
+		height:           C.int(init.Height),
+		num_zones:        C.int(len(init.Zones)),
+		zones:            cZonesPtr,
+		num_plugins:      C.int(len(plugins)),
+		plugins:          cPluginsPtr,
+		num_threads:      C.int(acquireThreads(init.NumThreads)),
+		max_bframes:      C.int(init.MaxBFrames),
+		global:           C.int(init.Flags),
+		fincr:            C.int(init.FrameRate.Denominator),
+		fbase:            C.int(init.FrameRate.Numerator),
+		max_key_interval: C.int(init.MaxKeyFrameInterval),
+		frame_drop_ratio: C.int(init.FrameDropRatio),
+		bquant_ratio:     C.int(init.BFrameQuantizer.Ratio),
+		bquant_offset:    C.int(init.BFrameQuantizer.Offset),
+		min_quant:        [3]C.int{C.int(init.QuantizerI.Min), C.int(init.QuantizerB.Min), C.int(init.QuantizerP.Min)},
+		max_quant:        [3]C.int{C.int(init.QuantizerI.Max), C.int(init.QuantizerB.Max), C.int(init.QuantizerP.Max)},
+		start_frame_num:  C.int(init.StartFrameNumber),
+		num_slices:       C.int(init.NumSlices),
+	}
+	encoderMutex.Lock()
+	creatingEncoder = e
+	e.bindGoPlugins(true)
+	code := C.xvid_encore(nil, C.XVID_ENC_CREATE, unsafe.Pointer(&cEncoreCreate), nil)
+	e.bindGoPlugins(false)
+	creatingEncoder = nil
+	encoderMutex.Unlock()
+	for _, free := range frees {
+		free()
+	}
+
+	if code != 0 {
+		releaseThreads(int(cEncoreCreate.num_threads))
+		e.freePlugins()
+		return xvidErr(code)
+	}
+	e.handle = cEncoreCreate.handle
+	e.threads = int(cEncoreCreate.num_threads)
+	e.config.NumThreads = e.threads
+	return nil
+}
+
+// freePlugins frees the resources of the standard plugins of a destroyed native encoder
+func (e *Encoder) freePlugins() {
+	for _, destroyFree := range e.destroyFrees {
+		destroyFree()
+	}
+	e.destroyFrees = nil
+}
+
+// Reset destroys the native encoder and creates a new one from an EncoderInit configuration, so that the Encoder
+// starts encoding a new independent stream, reusing the Encoder object.
+// The plugins are closed and initialized again with their Close and Init callbacks; the standard plugins can be
+// reused in the new configuration.
+//
+// All the EncoderInit fields can be changed, except the frame Width and Height: to encode frames with other
+// dimensions, a new Encoder must be created. If init is nil, the EncoderInit of the last creation of the Encoder
+// (by NewEncoder or Reset) is reused, to encode several independent streams with the same configuration, e.g. short
+// clips, each starting with a key frame.
+//
+// If init is invalid (including other dimensions), an error is returned and the Encoder is left unchanged, still
+// encoding its current stream. If creating the new native encoder fails, the Encoder is closed and an error is
+// returned; the Encoder must not be used anymore.
+func (e *Encoder) Reset(init *EncoderInit) error {
+	if e.closed {
+		return fmt.Errorf("xvid: encoder is closed")
+	}
+	if init == nil {
+		reuse := e.init
+		init = &reuse
+	}
+	if init.Width != e.width || init.Height != e.height {
+		return fmt.Errorf("xvid: cannot reset encoder to different dimensions %dx%d, expected %dx%d", init.Width, init.Height, e.width, e.height)
+	}
+	// check the configuration before destroying the current native encoder
+	if _, err := checkEncoderCreate(init); err != nil {
+		return err
+	}
+	C.xvid_encore(e.handle, C.XVID_ENC_DESTROY, nil, nil)
+	releaseThreads(e.threads)
+	e.freePlugins()
+	if err := e.create(init); err != nil {
+		e.closed = true
+		return err
+	}
+	return nil
 }
 
-var encoderMutex = sync.Mutex{} // TODO use global map and int to avoid C referencing go memory
-var encoder *Encoder
+// Flush drains one frame buffered by the encoder (e.g. a B-frame, when EncoderInit.MaxBFrames > 0) into output,
+// like Encode without an input frame, and returns the length of the encoded data and its stats. It returns io.EOF
+// when all the buffered frames have been drained.
+//
+// At the end of the input, call Flush in a loop after the last Encode call until it returns io.EOF, otherwise
+// the last frames of the stream are lost.
+func (e *Encoder) Flush(output *[]byte) (int, *EncoderStats, error) {
+	n, stats, err := e.Encode(EncoderFrame{
+		Input:  &Image{Colorspace: ColorSpaceNoOutput},
+		Output: output,
+	})
+	if endErr, ok := err.(*Error); ok && endErr.code == C.XVID_ERR_END {
+		return 0, nil, io.EOF
+	} else if err != nil {
+		return 0, nil, err
+	}
+	if stats == nil && n == 0 {
+		return 0, nil, io.EOF
+	}
+	return n, stats, nil
+}
 
-func internalImage(cImage C.xvid_image_t, width int, height int) (*Image, error) {
-	if int(cImage.csp) != ColorSpacePlanar.value {
-		return nil, fmt.Errorf("xvid: unexpected encoder internal image colorspace %d", int(cImage.csp))
+// EncodeFrame encodes a single Image like Encode, and writes the encoded data to EncoderInit.Output, which must be
+// set. The data is encoded to an internal buffer that is reused across calls.
+// If input is nil, the frames buffered by the encoder are flushed instead (see Flush) and written, and the returned
+// EncoderStats is nil: EncodeFrame(nil) must be called at the end of the input, otherwise the last frames of the
+// stream are lost.
+//
+// EncodeFrame returns the stats of the encoded frame (see Encode) and any encoding or write error.
+func (e *Encoder) EncodeFrame(input *Image) (*EncoderStats, error) {
+	if e.output == nil {
+		return nil, errors.New("xvid: Output Writer is nil, must be passed in EncoderInit")
 	}
-	colorspace := ColorSpacePlanar
-	image := Image{
-		Colorspace:   colorspace,
-		VerticalFlip: false,
-		Planes:       make([][]byte, colorspace.Planes),
-		Strides:      make([]int, colorspace.Planes),
+	if input == nil {
+		for {
+			n, _, err := e.Flush(&e.outputBuf)
+			if err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+			if err := writeAll(e.output, e.outputBuf[:n]); err != nil {
+				return nil, err
+			}
+		}
 	}
-	for i := range image.Planes {
-		l := width * height * colorspace.BitsPerPixelPlanes[i] / 8
-		sh := reflect.SliceHeader{
-			Data: uintptr(cImage.plane[i]),
-			Len:  l,
-			Cap:  l,
+	n, stats, err := e.Encode(EncoderFrame{
+		Input:  input,
+		Output: &e.outputBuf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeAll(e.output, e.outputBuf[:n]); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// writeAll writes data to w, retrying on short writes
+func writeAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
 		}
-		image.Planes[i] = *(*[]byte)(unsafe.Pointer(&sh))
-		image.Strides[i] = int(cImage.stride[i])
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
 	}
-	return &image, nil
+	return nil
 }
 
-//export pluginCallback
-func pluginCallback(handle unsafe.Pointer, option int, param1 unsafe.Pointer, param2 unsafe.Pointer) int {
-	switch option {
-	case C.XVID_PLG_INFO:
-		cInfo := (*C.xvid_plg_info_t)(param1)
-		for {
-			if _, ok := encoder.plugins[encoder.currentPlugin].(pluginInternal); ok {
-				encoder.currentPlugin++
-				continue
+// EncodeStream encodes the images received from frames, writing the encoded data to w, until frames is closed,
+// then flushes the frames buffered by the encoder (see Flush) to w, and returns nil. The images must not be nil,
+// and must not be modified until they are encoded, i.e. until the next image is received from frames.
+//
+// It stops at the first error, of the encoder or of w, and returns it. It also stops if ctx is done, and returns
+// ctx.Err(), without flushing the buffered frames: the written stream is then truncated.
+func (e *Encoder) EncodeStream(ctx context.Context, frames <-chan *Image, w io.Writer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case input, ok := <-frames:
+			if !ok {
+				return e.flushStream(ctx, w)
+			}
+			if input == nil {
+				return errors.New("xvid: invalid nil image received in EncodeStream")
+			}
+			n, _, err := e.Encode(EncoderFrame{
+				Input:  input,
+				Output: &e.outputBuf,
+			})
+			if err != nil {
+				return err
+			}
+			if err := writeAll(w, e.outputBuf[:n]); err != nil {
+				return err
 			}
-			break
-		}
-		cInfo.flags = C.int(encoder.plugins[encoder.currentPlugin].Info())
-		encoder.currentPlugin++
-		return 0
-	case C.XVID_PLG_DESTROY:
-		cDestroy := (*C.xvid_plg_destroy_t)(param1)
-		if cDestroy == nil {
-			// can happen if oom during encoding init, ignore
-			return 0
 		}
-		plugin := *(*Plugin)(handle)
-		plugin.Close(PluginClose{
-			NumFrames: int(cDestroy.num_frames),
-		})
-		return 0
-	case C.XVID_PLG_CREATE:
-		cCreate := (*C.xvid_plg_create_t)(param1)
-		pluginInit := PluginInit{
-			Zones:             encoder.zones,
-			Width:             int(cCreate.width),
-			Height:            int(cCreate.height),
-			WidthMacroBlocks:  int(cCreate.mb_width),
-			HeightMacroBlocks: int(cCreate.mb_height),
-			FrameRate:         Fraction{int(cCreate.fbase), int(cCreate.fincr)},
+	}
+}
+
+// flushStream drains the frames buffered by the encoder to w, stopping if ctx is done
+func (e *Encoder) flushStream(ctx context.Context, w io.Writer) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		plugin := (*Plugin)(cCreate.param)
-		*(**Plugin)(param2) = plugin
-		if !(*plugin).Init(pluginInit) {
-			return -1
+		n, _, err := e.Flush(&e.outputBuf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		return 0
-	case C.XVID_PLG_BEFORE:
-		cData := (*C.xvid_plg_data_t)(param1)
-		plugin := *(*Plugin)(handle)
-		if data := pluginReadData(cData); data != nil {
-			plugin.Before(data)
-			pluginWriteData(cData, data)
+		if err := writeAll(w, e.outputBuf[:n]); err != nil {
+			return err
 		}
-		return 0
-	case C.XVID_PLG_FRAME:
-		cData := (*C.xvid_plg_data_t)(param1)
-		plugin := *(*Plugin)(handle)
-		if data := pluginReadData(cData); data != nil {
-			plugin.Frame(data)
-			pluginWriteData(cData, data)
+	}
+}
+
+// Warmup encodes frames synthetic noise frames with a throwaway encoder created with the configuration of the
+// Encoder (without its Plugins and Output), and discards their output, so that the first frames of the actual
+// stream are less slowed down by one-time costs (e.g. for low-latency live encoding). It must be called before the
+// first Encode call.
+//
+// The Encoder itself is not used, so its own buffers are not primed: what remains warm is process-wide, i.e. the
+// code pages of xvidcore and its CPU-specific routines, the cgo call paths, and the memory released to the Go and
+// C allocators by the throwaway encoder. The encoded stream is the same as without warming up. The plugins of the
+// configuration (e.g. the rate control plugins, which can write to files) are not used by the throwaway encoder,
+// and do not see the synthetic frames.
+func (e *Encoder) Warmup(frames int) error {
+	if e.closed {
+		return fmt.Errorf("xvid: encoder is closed")
+	}
+	if e.frameNum != 0 {
+		return errors.New("xvid: Warmup must be called before the first Encode call")
+	}
+	if frames <= 0 {
+		return nil
+	}
+	init := e.init
+	init.Plugins = nil
+	init.Output = nil
+	warm, err := NewEncoder(&init)
+	if err != nil {
+		return err
+	}
+	defer warm.Close()
+	var output []byte
+	for i := 0; i < frames; i++ {
+		if _, _, err := warm.Encode(EncoderFrame{
+			Input:  TestPattern(e.width, e.height, PatternNoise, int64(i)),
+			Output: &output,
+		}); err != nil {
+			return err
 		}
-		return 0
-	case C.XVID_PLG_AFTER:
-		cData := (*C.xvid_plg_data_t)(param1)
-		plugin := *(*Plugin)(handle)
-		if data := pluginReadData(cData); data != nil {
-			plugin.After(data)
-			pluginWriteData(cData, data)
+	}
+	for {
+		if _, _, err := warm.Flush(&output); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
 		}
-		return 0
 	}
-	// should not happen, ignore
-	return 0
+	return nil
 }
 
-func pluginReadData(cData *C.xvid_plg_data_t) *PluginData {
-	var zone *EncoderZone = nil
-	if cData.zone != nil {
-		zone = &EncoderZone{
-			Frame: int(cData.zone.frame),
-			Mode:  ZoneType(cData.zone.mode),
-			Value: Fraction{int(cData.zone.increment), int(cData.zone.base)},
+// Encode encodes a single Image to an encoded Xvid stream.
+//
+// Encode returns an int, which is the length in bytes of the frame that was written.
+// The Encoder might write data and return a non-zero int even if no frame was written
+// (even if EncoderStats is nil). If EncoderInit.CoalesceFrames is set, this data is instead buffered
+// internally and returned at the start of the data of the next frame, so that the data is always frame-aligned.
+//
+// Encode returns an EncoderStats, which stores information about the encoded frame,
+// which can be either a VOL (metadata), an actual frame, or nil. nil means that no
+// frame was encoded, even though some data may be written (and int could be > 0) as
+// Xvid can sometimes buffer frame data internally or write part of a frame to the stream.
+// The frames buffered by Xvid (e.g. B-frames) are drained at the end of the stream with Flush.
+//
+// Encode returns an error, which if not nil can be due to invalid images, or internal
+// Xvid errors.
+//
+// In most cases, the Encode should not be used after an error occurs. The Encode must
+// still be closed with Close.
+func (e *Encoder) Encode(frame EncoderFrame) (int, *EncoderStats, error) {
+	if e.closed {
+		return 0, nil, fmt.Errorf("xvid: encoder is closed")
+	}
+	if frame.Input.Colorspace.value == ColorSpaceInternal.value {
+		return 0, nil, fmt.Errorf("xvid: unexpected colorspace ColorSpaceInternal, use only for output")
+	}
+	if err := frame.Input.Colorspace.checkDimensions(e.width, e.height); err != nil {
+		return 0, nil, err
+	}
+	if err := requireVOLFlags(frame.VOLFlags); err != nil {
+		return 0, nil, err
+	}
+	if frame.IntraDCPrecision != 0 && frame.IntraDCPrecision != 8 {
+		return 0, nil, fmt.Errorf("xvid: unsupported intra DC precision of %d bits, xvidcore only supports 8 bits", frame.IntraDCPrecision)
+	}
+	var quantIntraMatrix *C.uchar = nil
+	if frame.QuantizerIntraMatrix != nil {
+		if err := checkQuantizerMatrix("intra", frame.QuantizerIntraMatrix); err != nil {
+			return 0, nil, err
 		}
+		quantIntraMatrix = (*C.uchar)(unsafe.Pointer(&frame.QuantizerIntraMatrix[0]))
 	}
-	pluginData := PluginData{
-		Zone:                 zone,
-		Width:                int(cData.width),
-		Height:               int(cData.height),
-		WidthMacroBlocks:     int(cData.mb_width),
-		HeightMacroBlocks:    int(cData.mb_height),
-		FrameRate:            Fraction{int(cData.fbase), int(cData.fincr)},
-		QuantizerI:           QuantizerRange{int(cData.min_quant[0]), int(cData.max_quant[0])},
-		QuantizerP:           QuantizerRange{int(cData.min_quant[1]), int(cData.max_quant[1])},
-		QuantizerB:           QuantizerRange{int(cData.min_quant[2]), int(cData.max_quant[2])},
-		FrameNum:             int(cData.frame_num),
-		Type:                 FrameType(cData._type),
-		Quantizer:            int(cData.quant),
-		DiffQuantizersStride: int(cData.dquant_stride),
-		VOLFlags:             VOLFlag(cData.vol_flags),
-		VOPFlags:             VOPFlag(cData.vop_flags),
-		MotionFlags:          MotionFlag(cData.motion_flags),
-		BFrameQuantizer:      BFrameQuantizer{int(cData.bquant_ratio), int(cData.bquant_offset)},
-		Stats: EncoderStats{
-			FrameType:     FrameType(cData.stats._type),
-			KeyFrame:      FrameType(cData.stats._type) == FrameTypeI,
-			Quantizer:     int(cData.stats.quant),
-			VOLFlags:      VOLFlag(cData.stats.vol_flags),
-			VOPFlags:      VOPFlag(cData.stats.vop_flags),
-			Length:        int(cData.stats.length),
-			HeaderLength:  int(cData.stats.hlength),
-			IntraBlocks:   int(cData.stats.kblks),
-			InterBlocks:   int(cData.stats.mblks),
-			UncodedBlocks: int(cData.stats.ublks),
-			SSEY:          int(cData.stats.sse_y),
-			SSEU:          int(cData.stats.sse_u),
-			SSEV:          int(cData.stats.sse_v),
-		},
+	var quantInterMatrix *C.uchar = nil
+	if frame.QuantizerInterMatrix != nil {
+		if err := checkQuantizerMatrix("inter", frame.QuantizerInterMatrix); err != nil {
+			return 0, nil, err
+		}
+		quantInterMatrix = (*C.uchar)(unsafe.Pointer(&frame.QuantizerInterMatrix[0]))
 	}
-	referenceImage, err := internalImage(cData.reference, pluginData.Width, pluginData.Height)
-	if err != nil {
-		// TODO print to stderr?
-		return nil
+	if frame.Input.Colorspace.value == colorSpaceGray {
+		return 0, nil, errors.New("xvid: unexpected colorspace ColorSpaceGray, use only for decoding and conversion output")
 	}
-	pluginData.Reference = *referenceImage
-	currentImage, err := internalImage(cData.current, pluginData.Width, pluginData.Height)
+	cInput, err := frame.Input.nativeInput(e.width, e.height)
 	if err != nil {
-		// TODO print to stderr?
-		return nil
+		if w, h, ok := frame.Input.InferSize(); ok && (w < e.width || h < e.height) {
+			return 0, nil, fmt.Errorf("xvid: input image is %dx%d, encoder expects %dx%d", w, h, e.width, e.height)
+		}
+		return 0, nil, err
 	}
-	pluginData.Current = *currentImage
-	if cData.original.csp != 0 {
-		originalImage, err := internalImage(cData.original, pluginData.Width, pluginData.Height)
-		if err != nil {
-			// TODO print to stderr?
-			return nil
+	if frame.Input.Colorspace.value == ColorSpacePlanar422.value {
+		if err := e.downsampleChroma(frame.Input, frame.ChromaFilter); err != nil {
+			return 0, nil, err
+		}
+		if cInput, err = e.downsampled.nativeInput(e.width, e.height); err != nil {
+			return 0, nil, err
+		}
+	}
+	if l := BufferSize(e.width, e.height); len(*frame.Output) < l {
+		*frame.Output = make([]byte, l)
+	}
+	if frame.Quantizer == 0 {
+		frame.Quantizer = e.nextQuantizer
+	}
+	e.nextQuantizer = 0
+	forcedType := frame.Type
+	if t, ok := e.frameTypeSchedule[e.frameNum]; ok && forcedType == FrameTypeAuto {
+		forcedType = t
+	}
+	if e.gopPattern != "" && forcedType == FrameTypeAuto {
+		forcedType = e.gopPatternType(e.frameNum - e.gopPatternStart)
+	}
+	if e.intraOnly {
+		forcedType = FrameTypeI
+	}
+	if frame.Input.Colorspace.value != ColorSpaceNoOutput.value {
+		if e.forceKeyFrame {
+			forcedType = FrameTypeI
+			e.forceKeyFrame = false
+			// the GOP pattern restarts at the forced key frame
+			e.gopPatternStart = e.frameNum
+		}
+		e.timestamps = append(e.timestamps, frame.Timestamp)
+	}
+	if e.frameNum == 0 && forcedType != FrameTypeAuto {
+		// the stream must start with a VOL and an I frame
+		if forcedType != FrameTypeI {
+			warnFirstFrameType(forcedType)
+		}
+		forcedType = FrameTypeI
+	}
+	bitstream := unsafe.Pointer(&(*frame.Output)[0])
+	cEncoreFrame := C.xvid_enc_frame_t{
+		version:            C.XVID_VERSION,
+		vol_flags:          C.int(uint(frame.VOLFlags) | frame.RawVOLFlags),
+		quant_intra_matrix: quantIntraMatrix,
+		quant_inter_matrix: quantInterMatrix,
+		par:                C.int(frame.PixelAspectRatio.value),
+		par_width:          C.int(frame.PixelAspectRatio.Width),
+		par_height:         C.int(frame.PixelAspectRatio.Height),
+		fincr:              C.int(frame.FrameRateDenominator),
+		vop_flags:          C.int(uint(frame.VOPFlags) | frame.RawVOPFlags),
+		motion:             C.int(uint(frame.MotionFlags) | frame.RawMotionFlags),
+		input:              cInput,
+		_type:              C.int(forcedType),
+		quant:              C.int(frame.Quantizer),
+		bframe_threshold:   C.int(frame.BFrameThreshold),
+		bitstream:          bitstream,
+		length:             C.int(len(*frame.Output)),
+	}
+	cEncodeStats := C.xvid_enc_stats_t{
+		version: C.XVID_VERSION,
+	}
+	e.bindGoPlugins(true)
+	code := C.xvid_encore(e.handle, C.XVID_ENC_ENCODE, unsafe.Pointer(&cEncoreFrame), unsafe.Pointer(&cEncodeStats))
+	e.bindGoPlugins(false)
+	if code == C.XVID_ERR_END && len(e.pending) > 0 {
+		// end of stream: return the remaining data, the next flush will return the end error again
+		return e.takePending(frame.Output, 0), nil, nil
+	}
+	if code < 0 {
+		return 0, nil, xvidErr(code)
+	}
+	e.frameNum++
+	if frame.Input.Colorspace.value != ColorSpaceNoOutput.value {
+		e.inputFrames++
+	}
+	if forcedType == FrameTypeI {
+		e.forcedKeyFrames++
+	}
+	if len(e.userData) > 0 {
+		code = C.int(e.insertUserData(frame.Output, int(code)))
+	}
+	keyframe := cEncoreFrame.out_flags&C.XVID_KEYFRAME != 0
+	var stats *EncoderStats = nil
+	frameType := FrameType(cEncodeStats._type)
+	if frameType != C.XVID_TYPE_NOTHING {
+		stats = &EncoderStats{
+			FrameType:     frameType,
+			KeyFrame:      keyframe,
+			Quantizer:     int(cEncodeStats.quant),
+			VOLFlags:      VOLFlag(cEncodeStats.vol_flags),
+			VOPFlags:      VOPFlag(cEncodeStats.vop_flags),
+			Length:        int(cEncodeStats.length),
+			HeaderLength:  int(cEncodeStats.hlength),
+			IntraBlocks:   int(cEncodeStats.kblks),
+			InterBlocks:   int(cEncodeStats.mblks),
+			UncodedBlocks: int(cEncodeStats.ublks),
+			SSEY:          int(cEncodeStats.sse_y),
+			SSEU:          int(cEncodeStats.sse_u),
+			SSEV:          int(cEncodeStats.sse_v),
+		}
+		stats.UpperFieldFirst = stats.VOLFlags&VOLInterlacing != 0 && stats.VOPFlags&VOPUpperFieldFirst != 0
+		stats.width, stats.height = e.width, e.height
+		e.trackKeyFrame(stats)
+		e.setTimestamps(stats)
+		if e.frameDropRatio > 0 && frameType == FrameTypeP && stats.IntraBlocks == 0 && stats.InterBlocks == 0 {
+			// xvid encodes dropped frames as not-coded P frames, with all macroblocks skipped, which cannot be told
+			// apart from fully skipped static frames
+			stats.Dropped = true
+			e.droppedFrames++
 		}
-		pluginData.Original = *originalImage
+		e.addTotals(stats)
+		e.effectiveVOLFlags = stats.VOLFlags
+		e.effectiveVOPFlags = stats.VOPFlags
+		e.effectiveMotionFlags = MotionFlag(uint(frame.MotionFlags) | frame.RawMotionFlags)
 	}
-	if cData.dquant != nil {
-		l := pluginData.WidthMacroBlocks * pluginData.HeightMacroBlocks
-		if C.sizeof_int == unsafe.Sizeof(int(0)) { // avoid expensive copy if C.int == int
-			pluginData.DiffQuantizers = *(*[]int)(unsafe.Pointer(&reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(cData.dquant)),
-				Len:  l,
-				Cap:  l,
-			}))
-		} else {
-			pluginData.DiffQuantizers = make([]int, l)
-			cDiffQuantizers := *(*[]C.int)(unsafe.Pointer(&reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(cData.dquant)),
-				Len:  l,
-				Cap:  l,
-			}))
-			for i, v := range cDiffQuantizers {
-				pluginData.DiffQuantizers[i] = int(v)
+	if stats != nil && e.volHeaderInterval > 0 {
+		code = C.int(e.repeatVOLHeader(frame.Output, int(code)))
+	}
+	if e.coalesceFrames {
+		if stats == nil && frame.Input.Colorspace.value != ColorSpaceNoOutput.value {
+			e.pending = append(e.pending, (*frame.Output)[:code]...)
+			return 0, nil, nil
+		}
+		if len(e.pending) > 0 {
+			n := e.takePending(frame.Output, int(code))
+			if stats != nil {
+				stats.VOLHeaderLength = volHeaderLength((*frame.Output)[:n])
 			}
+			return n, stats, nil
 		}
 	}
-	if cData.lambda != nil {
-		n := 6 * pluginData.WidthMacroBlocks * pluginData.HeightMacroBlocks
-		pluginData.Lambda = *(*[]float32)(unsafe.Pointer(&reflect.SliceHeader{
-			Data: uintptr(unsafe.Pointer(cData.lambda)),
-			Len:  n,
-			Cap:  n,
-		}))
+	if stats != nil {
+		stats.VOLHeaderLength = volHeaderLength((*frame.Output)[:code])
 	}
-	return &pluginData
+	return int(code), stats, nil
 }
 
-func pluginWriteData(cData *C.xvid_plg_data_t, pluginData *PluginData) {
-	cData._type = C.int(pluginData.Type)
-	cData.quant = C.int(pluginData.Quantizer)
-	if pluginData.DiffQuantizers != nil {
-		if C.sizeof_int != unsafe.Sizeof(int(0)) { // only copy back if we had copied before
-			cDiffQuantizers := *(*[]C.int)(unsafe.Pointer(&reflect.SliceHeader{
-				Data: uintptr(unsafe.Pointer(cData.dquant)),
-				Len:  len(pluginData.DiffQuantizers),
-				Cap:  len(pluginData.DiffQuantizers),
-			}))
-			for i, v := range pluginData.DiffQuantizers {
-				cDiffQuantizers[i] = C.int(v)
+// volHeaderLength returns the length of the headers before the first GOV or VOP of encoded data, if they
+// contain a VOL header, and 0 otherwise
+func volHeaderLength(data []byte) int {
+	vol := false
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		switch c := data[i+3]; {
+		case c >= 0x20 && c <= 0x2f:
+			vol = true
+		case c == 0xb3 || c == 0xb6:
+			if vol {
+				return i
 			}
+			return 0
 		}
 	}
-	cData.vol_flags = C.int(pluginData.VOLFlags)
-	cData.vop_flags = C.int(pluginData.VOPFlags)
-	cData.motion_flags = C.int(pluginData.MotionFlags)
+	return 0
 }
 
-// BufferSize returns the minimal output buffer size for encoding a frame.
-// The Output buffer of an EncoderFrame will automatically be reallocated to
-// this size if it is smaller.
-func BufferSize(width int, height int) int {
-	// inspired by FFMPEG libxvid encoder
-	return 16384 + width*height*30*3/8 + 120 + 8
+// insertUserData inserts the user data after the VOL header in the first n bytes of output, if any, and returns
+// the new length of the data
+func (e *Encoder) insertUserData(output *[]byte, n int) int {
+	// insert before the GOV or VOP following the VOL header (and its user data)
+	i := volHeaderLength((*output)[:n])
+	if i == 0 {
+		return n
+	}
+	if len(*output) < n+len(e.userData) {
+		buf := make([]byte, n+len(e.userData))
+		copy(buf, (*output)[:n])
+		*output = buf
+	}
+	copy((*output)[i+len(e.userData):n+len(e.userData)], (*output)[i:n])
+	copy((*output)[i:], e.userData)
+	return n + len(e.userData)
 }
 
-// BFrameQuantizer stores parameters for choosing B-frames quantizers.
-// The actual formula used is:
-//   quantizer = (average(pastReferenceQuantizer, futureReferenceQuantizer) * Ratio + Offset) / 100
-type BFrameQuantizer struct {
-	// ratio in percent (see formula); default is 150
-	Ratio int
-	// offset in 0.01 units (see formula); default is 100
-	Offset int
+// repeatVOLHeader stores the headers of the first n bytes of output if they contain a VOL header, or prepends the
+// last stored headers if the VOL header interval is reached, and returns the new length of the data
+func (e *Encoder) repeatVOLHeader(output *[]byte, n int) int {
+	if l := volHeaderLength((*output)[:n]); l > 0 {
+		e.volHeader = append(e.volHeader[:0], (*output)[:l]...)
+		e.framesSinceVOLHeader = 0
+		return n
+	}
+	e.framesSinceVOLHeader++
+	if e.framesSinceVOLHeader < e.volHeaderInterval || len(e.volHeader) == 0 {
+		return n
+	}
+	e.framesSinceVOLHeader = 0
+	if len(*output) < n+len(e.volHeader) {
+		buf := make([]byte, n+len(e.volHeader))
+		copy(buf, (*output)[:n])
+		*output = buf
+	}
+	copy((*output)[len(e.volHeader):n+len(e.volHeader)], (*output)[:n])
+	copy(*output, e.volHeader)
+	return n + len(e.volHeader)
 }
 
-// Encoder is an initialized Xvid encoder.
-// To create a Encoder, use NewEncoder.
-// An Encoder must be closed after use, by calling its Close method.
-// To encode a frame, use the Encode method.
-type Encoder struct {
-	handle        unsafe.Pointer
-	width         int
-	height        int
-	zones         []EncoderZone
-	plugins       []Plugin
-	currentPlugin int
-	closed        bool
-	err           error
+// takePending returns the pending data followed by the first n bytes of output in output, and returns its length
+func (e *Encoder) takePending(output *[]byte, n int) int {
+	e.pending = append(e.pending, (*output)[:n]...)
+	if len(*output) < len(e.pending) {
+		*output = make([]byte, len(e.pending))
+	}
+	n = copy(*output, e.pending)
+	e.pending = e.pending[:0]
+	return n
 }
 
-// EncoderInit is information used to create an Encoder in NewEncoder.
-// To initialize an EncoderInit with default values, use NewEncoderInit.
-type EncoderInit struct {
-	// frame width in pixels
-	Width int
-	// frame height in pixels
-	Height int
+// EncoderConfig is a snapshot of the resolved configuration of an Encoder, returned by Encoder.Config.
+// Its fields are the EncoderInit fields, after applying the defaults and clamping done by Xvid.
+type EncoderConfig struct {
+	Width               int
+	Height              int
+	Profile             EncoderProfile
+	NumThreads          int
+	MaxBFrames          int
+	Flags               EncoderFlag
+	FrameRate           Fraction
+	MaxKeyFrameInterval int
+	FrameDropRatio      int
+	BFrameQuantizer     BFrameQuantizer
+	QuantizerI          QuantizerRange
+	QuantizerP          QuantizerRange
+	QuantizerB          QuantizerRange
+	StartFrameNumber    int
+	NumSlices           int
+	Zones               []EncoderZone
+	FrameTypeSchedule   map[int]FrameType
+	GOPPattern          string
+	CoalesceFrames      bool
+	IntraOnly           bool
+	FixedQuantizer      int
+	VOLHeaderInterval   int
+	UserData            []string
+	// names of the plugins, in execution order (see WithPriority): the name of the function that created it for Xvid plugins (e.g. "PluginRC1Pass"),
+	// the Go type for custom plugins (e.g. "*main.MyPlugin")
+	Plugins []string
+}
 
-	// optional encoder profile; default is EncoderAuto for automatic profile selection
-	Profile EncoderProfile
-	// optional encoder bitrate zones, that enforce a specific parameter for a range of frames; must be sorted in increasing frame start order
-	Zones []EncoderZone
-	// optional encoder plugins
-	Plugins []Plugin
-	// optional number of threads to use for encoding, 0 means single-threaded; default is GetGlobalInfo().NumThreads-1
-	NumThreads int
-	// optional maximum sequential B-frames, 0 means disabling B-frames; default is 2
-	MaxBFrames int
-	// optional global encoder flags; default is no flags
-	Flags EncoderFlag
+// resolveQuantizerRange returns a quantizer range with the Xvid defaults (2-31) applied, clamped to 1-31
+func resolveQuantizerRange(r QuantizerRange) QuantizerRange {
+	if r.Min <= 0 {
+		r.Min = 2
+	}
+	if r.Max <= 0 || r.Max > 31 {
+		r.Max = 31
+	}
+	if r.Min > r.Max {
+		r.Min = r.Max
+	}
+	return r
+}
 
-	// framerate; Numerator=0 means variable framerate; only the Denominator can be changed after initialization
-	FrameRate Fraction
+func newEncoderConfig(init *EncoderInit) EncoderConfig {
+	c := EncoderConfig{
+		Width:               init.Width,
+		Height:              init.Height,
+		Profile:             init.Profile,
+		NumThreads:          init.NumThreads,
+		MaxBFrames:          init.MaxBFrames,
+		Flags:               init.Flags,
+		FrameRate:           init.FrameRate,
+		MaxKeyFrameInterval: init.MaxKeyFrameInterval,
+		FrameDropRatio:      init.FrameDropRatio,
+		BFrameQuantizer:     init.BFrameQuantizer,
+		QuantizerI:          resolveQuantizerRange(init.QuantizerI),
+		QuantizerP:          resolveQuantizerRange(init.QuantizerP),
+		QuantizerB:          resolveQuantizerRange(init.QuantizerB),
+		StartFrameNumber:    init.StartFrameNumber,
+		NumSlices:           init.NumSlices,
+		Zones:               append([]EncoderZone(nil), init.Zones...),
+		GOPPattern:          init.GOPPattern,
+		CoalesceFrames:      init.CoalesceFrames,
+		IntraOnly:           init.IntraOnly,
+		FixedQuantizer:      init.FixedQuantizer,
+		VOLHeaderInterval:   init.VOLHeaderInterval,
+		UserData:            append([]string(nil), init.UserData...),
+	}
+	if c.NumThreads < 0 {
+		c.NumThreads = 0
+	}
+	if c.MaxBFrames < 0 {
+		c.MaxBFrames = 0
+	}
+	if c.MaxKeyFrameInterval <= 0 && c.FrameRate.Denominator != 0 {
+		// xvid default: 10 seconds
+		c.MaxKeyFrameInterval = 10 * c.FrameRate.Numerator / c.FrameRate.Denominator
+	}
+	if c.FrameDropRatio < 0 {
+		c.FrameDropRatio = 0
+	} else if c.FrameDropRatio > 100 {
+		c.FrameDropRatio = 100
+	}
+	if c.NumSlices <= 0 {
+		c.NumSlices = 1
+	}
+	if len(init.FrameTypeSchedule) > 0 {
+		c.FrameTypeSchedule = make(map[int]FrameType, len(init.FrameTypeSchedule))
+		for frame, frameType := range init.FrameTypeSchedule {
+			c.FrameTypeSchedule[frame] = frameType
+		}
+	}
+	for _, p := range orderPlugins(init.Plugins) {
+		if pi, ok := p.(pluginInternal); ok {
+			c.Plugins = append(c.Plugins, pi.name)
+		} else {
+			c.Plugins = append(c.Plugins, fmt.Sprintf("%T", p))
+		}
+	}
+	return c
+}
 
-	// optional maximum interval between key frames; default is 300
-	MaxKeyFrameInterval int
-	// optional frame dropping ratio in percent between 0 (drop none) to 100 (drop all); default is 0
-	FrameDropRatio int
+// Config returns a snapshot of the resolved configuration of the Encoder, e.g. to attach it to a bug report.
+// The internals of plugins are not included, only their names.
+func (e *Encoder) Config() EncoderConfig {
+	return e.config
+}
 
-	// optional B-frames quantizer multipier/offset; used to decide B-frames quantizer when automatic quantizer is used
-	BFrameQuantizer BFrameQuantizer
+// String returns a stable textual representation of the configuration, with one "key: value" line per field.
+func (c EncoderConfig) String() string {
+	var b strings.Builder
+	quantizers := func(r QuantizerRange) string {
+		return fmt.Sprintf("%d-%d", r.Min, r.Max)
+	}
+	fmt.Fprintf(&b, "Width: %d\n", c.Width)
+	fmt.Fprintf(&b, "Height: %d\n", c.Height)
+	fmt.Fprintf(&b, "Profile: 0x%x\n", uint(c.Profile))
+	fmt.Fprintf(&b, "NumThreads: %d\n", c.NumThreads)
+	fmt.Fprintf(&b, "MaxBFrames: %d\n", c.MaxBFrames)
+	fmt.Fprintf(&b, "Flags: 0x%x\n", uint(c.Flags))
+	fmt.Fprintf(&b, "FrameRate: %d/%d\n", c.FrameRate.Numerator, c.FrameRate.Denominator)
+	fmt.Fprintf(&b, "MaxKeyFrameInterval: %d\n", c.MaxKeyFrameInterval)
+	fmt.Fprintf(&b, "FrameDropRatio: %d\n", c.FrameDropRatio)
+	fmt.Fprintf(&b, "BFrameQuantizer: ratio %d offset %d\n", c.BFrameQuantizer.Ratio, c.BFrameQuantizer.Offset)
+	fmt.Fprintf(&b, "QuantizerI: %s\n", quantizers(c.QuantizerI))
+	fmt.Fprintf(&b, "QuantizerP: %s\n", quantizers(c.QuantizerP))
+	fmt.Fprintf(&b, "QuantizerB: %s\n", quantizers(c.QuantizerB))
+	fmt.Fprintf(&b, "StartFrameNumber: %d\n", c.StartFrameNumber)
+	fmt.Fprintf(&b, "NumSlices: %d\n", c.NumSlices)
+	zones := make([]string, len(c.Zones))
+	for i, z := range c.Zones {
+		zones[i] = fmt.Sprintf("%d:%d:%d/%d", z.Frame, z.Mode, z.Value.Numerator, z.Value.Denominator)
+	}
+	fmt.Fprintf(&b, "Zones: %s\n", strings.Join(zones, " "))
+	frames := make([]int, 0, len(c.FrameTypeSchedule))
+	for frame := range c.FrameTypeSchedule {
+		frames = append(frames, frame)
+	}
+	sort.Ints(frames)
+	schedule := make([]string, len(frames))
+	for i, frame := range frames {
+		schedule[i] = fmt.Sprintf("%d:%d", frame, c.FrameTypeSchedule[frame])
+	}
+	fmt.Fprintf(&b, "FrameTypeSchedule: %s\n", strings.Join(schedule, " "))
+	fmt.Fprintf(&b, "GOPPattern: %s\n", c.GOPPattern)
+	fmt.Fprintf(&b, "CoalesceFrames: %t\n", c.CoalesceFrames)
+	fmt.Fprintf(&b, "IntraOnly: %t\n", c.IntraOnly)
+	fmt.Fprintf(&b, "FixedQuantizer: %d\n", c.FixedQuantizer)
+	fmt.Fprintf(&b, "VOLHeaderInterval: %d\n", c.VOLHeaderInterval)
+	fmt.Fprintf(&b, "UserData: %q\n", c.UserData)
+	fmt.Fprintf(&b, "Plugins: %s\n", strings.Join(c.Plugins, " "))
+	return b.String()
+}
 
-	// optional quantizer range for I frames
-	QuantizerI QuantizerRange
-	// optional quantizer range for P frames
-	QuantizerP QuantizerRange
-	// optional quantizer range for B frames
-	QuantizerB QuantizerRange
+// SetNextQuantizer sets the quantizer (1-31) of the frame passed to the next Encode call, if its
+// EncoderFrame.Quantizer is 0, so that the quantizer can be controlled by the application (e.g. from a bandwidth
+// estimator) without a custom plugin. It only applies to the next Encode call.
+//
+// As with EncoderFrame.Quantizer, a rate-control plugin (e.g. PluginRC1Pass) may still override the quantizer.
+func (e *Encoder) SetNextQuantizer(q int) error {
+	if q < 1 || q > 31 {
+		return fmt.Errorf("xvid: invalid quantizer %d, must be between 1 and 31", q)
+	}
+	e.nextQuantizer = q
+	return nil
+}
 
-	// optional starting frame number, relative to the zones start frames; default is 0
-	StartFrameNumber int
-	// optional number of slices to encode for each frame; default is 0, meaning 1 slice
-	NumSlices int
+// ForceKeyFrame forces the next input frame passed to Encode to be encoded as a key frame (an I frame), e.g. when
+// a new client joins a live stream, regardless of the EncoderFrame.Type of the frame, EncoderInit.FrameTypeSchedule
+// and EncoderInit.GOPPattern; the resulting frame has EncoderStats.KeyFrame set. Calling it several times before the
+// next frame forces a single key frame. The following key frames are placed at most EncoderInit.MaxKeyFrameInterval
+// frames after it, as for any key frame; with EncoderInit.GOPPattern, the pattern restarts at the forced key frame.
+func (e *Encoder) ForceKeyFrame() {
+	e.forceKeyFrame = true
 }
 
-// EncoderZone is a bitrate enforcement zone used for encoding, which applies during
-// a range of frames, starting on its Frame (inclusive) and ending on the next EncoderZone frame
-// (exclusive).
-type EncoderZone struct {
-	// start frame (inclusive) of the zone
-	Frame int
-	// zone type
-	Mode ZoneType
-	// value, meaning depends on the ZoneType used
-	Value Fraction
+// DroppedFrameCount returns the number of frames reported as dropped by the Encoder because of
+// EncoderInit.FrameDropRatio (see EncoderStats.Dropped, which is a heuristic) since its creation (or reset).
+func (e *Encoder) DroppedFrameCount() int {
+	return e.droppedFrames
 }
 
-// EncoderFrame is information used when encoding a frame in Encoder.Encode.
-// Its only required fields are the Input Image and its Output buffer.
-type EncoderFrame struct {
-	// input image to encode
-	Input *Image
-	// buffer to store the encoded frame data into, if pointing to a nil or too small slice, will realloc it to the minimum buffer size as returned by BufferSize
-	Output *[]byte
+// EncoderTotals is cumulative statistics of the frames emitted by an Encoder, returned by Encoder.Stats.
+type EncoderTotals struct {
+	// number of emitted frames, of all types
+	Frames int
+	// number of emitted I frames (key frames)
+	IFrames int
+	// number of emitted P frames
+	PFrames int
+	// number of emitted B frames
+	BFrames int
+	// number of emitted S frames (GMC)
+	SFrames int
+	// total length in bytes of the emitted frames, the sum of their EncoderStats.Length
+	Length int64
+	// average length in bytes of the emitted frames; 0 if no frames were emitted
+	AverageLength float64
+	// average quantizer of the emitted frames; 0 if no frames were emitted
+	AverageQuantizer float64
+	// average bitrate in bits per second, computed from Length and the duration of Frames frames at the frame rate
+	// of EncoderInit; 0 if no frames were emitted or for a variable frame rate
+	Bitrate float64
+}
 
-	// optional flags for the next group of pictures; the encoder will not react to any changes until the next VOL (keyframe)
-	VOLFlags VOLFlag
-	// optional 8x8 row-major quantizer matrix for intraframe encoding
-	QuantizerIntraMatrix []uint8
-	// optional 8x8 row-major quantizer matrix for interframe encoding
-	QuantizerInterMatrix []uint8
-	// optional pixel aspect ratio, defaults to square pixel
-	PixelAspectRatio PixelAspectRatio
+// addTotals adds the stats of an emitted frame to the cumulative statistics
+func (e *Encoder) addTotals(stats *EncoderStats) {
+	e.totals.Frames++
+	switch stats.FrameType {
+	case FrameTypeI:
+		e.totals.IFrames++
+	case FrameTypeP:
+		e.totals.PFrames++
+	case FrameTypeB:
+		e.totals.BFrames++
+	case FrameTypeS:
+		e.totals.SFrames++
+	}
+	e.totals.Length += int64(stats.Length)
+	e.quantizerSum += int64(stats.Quantizer)
+}
 
-	// optional; sets the frame rate by changing the Denominator of the frame rate fraction defined in Init; default means unchanged frame rate
-	FrameRateDenominator int
-	// optional encoding flags for this frame
-	VOPFlags VOPFlag
-	// optional motion estimation flags for this frame
-	MotionFlags MotionFlag
+// Stats returns cumulative statistics of the frames emitted by the Encoder since its creation (or reset), e.g.
+// to log the effective bitrate of an encode or to decide whether a second pass is needed.
+func (e *Encoder) Stats() EncoderTotals {
+	totals := e.totals
+	if totals.Frames == 0 {
+		return totals
+	}
+	totals.AverageLength = float64(totals.Length) / float64(totals.Frames)
+	totals.AverageQuantizer = float64(e.quantizerSum) / float64(totals.Frames)
+	if e.frameRate.Numerator > 0 && e.frameRate.Denominator > 0 {
+		seconds := float64(totals.Frames) * float64(e.frameRate.Denominator) / float64(e.frameRate.Numerator)
+		totals.Bitrate = float64(totals.Length) * 8 / seconds
+	}
+	return totals
+}
 
-	// optional forced type for this frame, defaults to FrameTypeAuto
-	Type FrameType
-	// optional quantizer for this frame, 0 defaults to automatic rate-controlled quantizer, recommended range is 2-31
-	Quantizer int
-	// optional adjustment for choosing between encoding a P-frame or a B-frame; > 0 means more B-frames, <0 means less B-frames
-	BFrameThreshold int
+// EffectiveFlags returns the flags actually used by Xvid to encode the last emitted frame, which can differ from
+// the requested flags: VOL flags (e.g. VOLQuarterPixel or VOLGMC) only change on key frames, and Xvid ignores
+// or adjusts some flags depending on the frame type and other flags. All flags are 0 until the first frame
+// is emitted by Encode.
+//
+// xvidcore does not report the motion estimation flags it used, so the returned MotionFlag is the flags requested
+// in the EncoderFrame of the last Encode call that emitted a frame.
+func (e *Encoder) EffectiveFlags() (VOLFlag, VOPFlag, MotionFlag) {
+	return e.effectiveVOLFlags, e.effectiveVOPFlags, e.effectiveMotionFlags
 }
 
-// EncoderStats is information about an encoded frame, returned by Encoder.Encode.
-type EncoderStats struct {
-	// frame type of the encoded frame
-	FrameType FrameType
-	// whether this frame was encoded as an I frame
+// Packet is a packet of encoded data produced by a Packetizer, e.g. the payload of an RTP packet.
+type Packet struct {
+	// packet data, aliasing the encoded frame data
+	Data []byte
+	// whether the packet is the first packet of a frame
+	FrameStart bool
+	// whether the packet is the last packet of a frame (e.g. for the RTP marker bit)
+	FrameEnd bool
+	// whether the packet is part of a key frame
 	KeyFrame bool
-	// quantizer used for the frame
-	Quantizer int
-	// actual VOL flags used for the frame
-	VOLFlags VOLFlag
-	// actual VOP flags used for the frame
-	VOPFlags VOPFlag
-	// length of frame in bytes
-	Length int
-	// length of frame header in bytes
-	HeaderLength int
-	// number of blocks coded as intra
-	IntraBlocks int
-	// number of blocks coded as inter
-	InterBlocks int
-	// number of blocks not coded
-	UncodedBlocks int
+}
 
-	// only present if VOLExtraStats is set; Y plane SSE
-	SSEY int
-	// only present if VOLExtraStats is set; U plane SSE
-	SSEU int
-	// only present if VOLExtraStats is set; V plane SSE
-	SSEV int
+// Packetizer splits encoded frames into packets of at most a maximum size (MTU), e.g. for RTP transport, splitting
+// at slice (video packet) boundaries where possible, so that each packet can be decoded independently.
+// To create a Packetizer, use NewPacketizer.
+type Packetizer struct {
+	mtu int
 }
 
-// NewEncoderInit returns an EncoderInit initialized with the default encoding parameters.
+// NewPacketizer returns a Packetizer producing packets of at most mtu bytes.
+func NewPacketizer(mtu int) (*Packetizer, error) {
+	if mtu <= 0 {
+		return nil, fmt.Errorf("xvid: invalid packetizer MTU %d, must be positive", mtu)
+	}
+	return &Packetizer{mtu: mtu}, nil
+}
+
+// Packetize splits the data of an encoded frame, as returned by Encoder.Encode, into packets of at most the
+// Packetizer MTU. boundaries are the offsets in frame at which the frame can be split, in increasing order; if nil,
+// SliceBoundaries(frame) is used. Each packet is cut at the last boundary that fits in the MTU; a slice larger
+// than the MTU is split at the MTU, in which case its packets cannot be decoded independently.
 //
-// In Xvid rate-control is done with plugins: either 1-pass with PluginRC1Pass, or 2-pass
-// with PluginRC2Pass1 (on the first pass) and PluginRC2Pass2 (on the second pass).
-func NewEncoderInit(width int, height int, frameRate Fraction, plugins []Plugin) *EncoderInit {
-	nThreads := 1
-	if info, err := GetGlobalInfo(); err == nil && info.NumThreads > 2 {
-		nThreads = info.NumThreads - 1
+// To encode frames in several slices, set EncoderInit.NumSlices.
+func (p *Packetizer) Packetize(frame []byte, keyFrame bool, boundaries []int) []Packet {
+	if boundaries == nil {
+		boundaries = SliceBoundaries(frame)
 	}
-	return &EncoderInit{
-		Width:  width,
-		Height: height,
+	var packets []Packet
+	start := 0
+	b := 0
+	for start < len(frame) {
+		end := start + p.mtu
+		if end >= len(frame) {
+			end = len(frame)
+		} else {
+			// cut at the last boundary that fits, if any
+			for b < len(boundaries) && boundaries[b] <= start {
+				b++
+			}
+			if b < len(boundaries) && boundaries[b] <= end {
+				for b+1 < len(boundaries) && boundaries[b+1] <= end {
+					b++
+				}
+				end = boundaries[b]
+			}
+		}
+		packets = append(packets, Packet{
+			Data:       frame[start:end],
+			FrameStart: start == 0,
+			KeyFrame:   keyFrame,
+		})
+		start = end
+	}
+	if len(packets) > 0 {
+		packets[len(packets)-1].FrameEnd = true
+	}
+	return packets
+}
 
-		Profile:    EncoderProfileAuto,
-		Zones:      nil,
-		Plugins:    plugins,
-		NumThreads: nThreads,
-		MaxBFrames: 2,
-		Flags:      0,
+// SliceBoundaries returns the offsets of the byte-aligned start codes (e.g. of VOL and VOP headers) and resync
+// markers (starting the video packets of the slices of a frame, see EncoderInit.NumSlices) in encoded data, except
+// at offset 0, in increasing order. Resync markers are detected heuristically, as 16 zero bits followed by a one
+// bit within the next 7 bits.
+func SliceBoundaries(data []byte) []int {
+	var boundaries []int
+	for i := 1; i+2 < len(data); i++ {
+		if data[i-1] != 0 && data[i] == 0 && data[i+1] == 0 && data[i+2] != 0 {
+			boundaries = append(boundaries, i)
+		}
+	}
+	return boundaries
+}
 
-		FrameRate: Fraction{frameRate.Numerator, frameRate.Denominator},
+// EncoderWriter encodes frames with an Encoder and writes the encoded stream to an io.Writer, maintaining a running
+// hash of all the written bytes.
+// To create an EncoderWriter, use NewEncoderWriter.
+// An EncoderWriter should be closed after use, by calling its Close method.
+type EncoderWriter struct {
+	encoder *Encoder
+	w       io.Writer
+	hash    hash.Hash
+	buf     []byte
+	digest  []byte
+	closed  bool
+}
 
-		MaxKeyFrameInterval: 300,
-		FrameDropRatio:      0,
+// NewEncoderWriter returns an EncoderWriter that encodes frames with an Encoder and writes the encoded stream to w,
+// hashing all the written bytes with h; if h is nil, SHA-256 is used.
+// The Encoder and w are not closed automatically and must be closed by the caller after the EncoderWriter is closed.
+func NewEncoderWriter(encoder *Encoder, w io.Writer, h hash.Hash) *EncoderWriter {
+	if h == nil {
+		h = sha256.New()
+	}
+	return &EncoderWriter{
+		encoder: encoder,
+		w:       io.MultiWriter(w, h),
+		hash:    h,
+	}
+}
+
+// Encode encodes a single frame with Encoder.Encode and writes the encoded data.
+// The frame Output is ignored and replaced by an internal buffer.
+// It returns the stats of the encoded frame (see Encoder.Encode) and any encoding or write error.
+func (w *EncoderWriter) Encode(frame EncoderFrame) (*EncoderStats, error) {
+	if w.closed {
+		return nil, errors.New("xvid: encoder writer is closed")
+	}
+	frame.Output = &w.buf
+	n, stats, err := w.encoder.Encode(frame)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.w.Write(w.buf[:n]); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Close drains the frames buffered by the encoder (e.g. B-frames, see Encoder.Flush) and writes them, so that the
+// written stream and its Digest are complete, then closes the EncoderWriter, which must not be used afterwards
+// except for Digest. It returns any encoding or write error of the buffered frames.
+// It does not close the Encoder or the underlying io.Writer.
+func (w *EncoderWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	err := w.flush()
+	w.closed = true
+	w.digest = w.hash.Sum(nil)
+	return err
+}
+
+// Digest returns the hash of all the bytes written by the EncoderWriter. It should be called after Close,
+// otherwise it returns the hash of the bytes written so far.
+func (w *EncoderWriter) Digest() []byte {
+	if w.closed {
+		return w.digest
+	}
+	return w.hash.Sum(nil)
+}
 
-		BFrameQuantizer: BFrameQuantizer{150, 100},
+// flush encodes and writes the frames buffered by the encoder
+func (w *EncoderWriter) flush() error {
+	if w.closed {
+		return errors.New("xvid: encoder writer is closed")
+	}
+	for {
+		n, _, err := w.encoder.Flush(&w.buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := w.w.Write(w.buf[:n]); err != nil {
+			return err
+		}
+	}
+}
 
-		QuantizerI: QuantizerRange{},
-		QuantizerP: QuantizerRange{},
-		QuantizerB: QuantizerRange{},
+// Transcode decodes the raw Xvid stream read from in frame by frame, and re-encodes it to out with an Encoder
+// created from encInit. It streams the data: only the frames buffered by Xvid are kept in memory.
+//
+// If encInit.Width or encInit.Height is 0, the dimensions of the source stream (from its first VOL) are used,
+// rounded up to an even value as required for encoding. Frames are never scaled: if the source and encoding
+// dimensions differ, the frames are cropped or padded with black on their right and bottom sides.
+// The B-frames buffered by the decoder and the encoder are flushed at the end of the stream.
+// If encInit.UserData is nil, the user_data of the source stream before its first frame is preserved, except the
+// Xvid and DivX5 tags (see DecoderStats.UserData).
+//
+// encInit is not modified. Init (or InitWithFlags) must be called once before calling this function.
+// Transcode returns the first decoding, encoding, or i/o error; in and out are not closed.
+// See Transcoder for more decoding options and cancellation.
+func Transcode(in io.Reader, out io.Writer, encInit *EncoderInit) error {
+	t, err := NewTranscoder(DecoderInit{
+		Input: in,
+	}, encInit, out)
+	if err != nil {
+		return err
+	}
+	return t.Run(context.Background())
+}
 
-		StartFrameNumber: 0,
-		NumSlices:        1,
+// Transcoder re-encodes a raw Xvid stream like Transcode, from a Decoder and an Encoder created from a DecoderInit
+// and an EncoderInit, e.g. to change the bitrate or quality settings of a stream. The frames are decoded to the
+// internal decoder buffers (see ColorSpaceInternal) and encoded from them, without color space conversion; they
+// are only copied if the source and encoding dimensions differ (see Transcode). To create a Transcoder, use
+// NewTranscoder.
+type Transcoder struct {
+	decoderInit DecoderInit
+	encoderInit EncoderInit
+	output      io.Writer
+	done        bool
+}
+
+// NewTranscoder returns a Transcoder of the stream read from decoderInit.Input to output, with the Decoder options
+// of decoderInit and an Encoder created from encoderInit, with the behavior described in Transcode (e.g. for
+// encoderInit dimensions of 0). The Decoder and Encoder are only created when calling Run.
+// encoderInit is not modified.
+func NewTranscoder(decoderInit DecoderInit, encoderInit *EncoderInit, output io.Writer) (*Transcoder, error) {
+	if encoderInit == nil {
+		return nil, errors.New("xvid: EncoderInit must not be nil")
 	}
+	if decoderInit.Input == nil {
+		return nil, errors.New("xvid: DecoderInit Input must not be nil")
+	}
+	if output == nil {
+		return nil, errors.New("xvid: output Writer must not be nil")
+	}
+	return &Transcoder{
+		decoderInit: decoderInit,
+		encoderInit: *encoderInit,
+		output:      output,
+	}, nil
 }
 
-// NewEncoder creates a new Encoder based on a EncoderInit configuration. Init (or InitWithFlags) must be called once before calling this function.
-// Once created and finished using, an Encoder must be freed by calling Encoder.Close().
-// The Encoder is non-nil if and only if the returned error is nil.
-// An internal error can be returned by Xvid, in which case the Encoder won't be created.
-func NewEncoder(init *EncoderInit) (*Encoder, error) {
-	if init == nil {
-		return nil, errors.New("EncoderInit must not be nil")
+// Run transcodes the whole stream, flushing the frames buffered by the decoder and the encoder at its end, and
+// returns the first decoding, encoding, or i/o error. It also stops if ctx is done, and returns ctx.Err(), with
+// the output truncated. The Decoder and Encoder are closed before Run returns; the input Reader and output Writer
+// are not closed. Run can only be called once, as it consumes the input.
+// Init (or InitWithFlags) must be called once before calling this function.
+func (t *Transcoder) Run(ctx context.Context) error {
+	if t.done {
+		return errors.New("xvid: Transcoder Run can only be called once")
 	}
-	e := Encoder{
-		width:  init.Width,
-		height: init.Height,
+	t.done = true
+	decoder, err := NewDecoder(t.decoderInit)
+	if err != nil {
+		return err
 	}
-	var cZonesPtr *C.xvid_enc_zone_t = nil
-	if len(init.Zones) > 0 {
-		cZones := make([]C.xvid_enc_zone_t, len(init.Zones))
-		for i, z := range init.Zones {
-			cZones[i] = C.xvid_enc_zone_t{
-				frame:     C.int(z.Frame),
-				mode:      C.int(z.Mode),
-				increment: C.int(z.Value.Numerator),
-				base:      C.int(z.Value.Denominator),
+	defer decoder.Close()
+
+	var encoder *Encoder
+	var writer *EncoderWriter
+	defer func() {
+		if encoder != nil {
+			encoder.Close()
+		}
+	}()
+
+	// the frames are decoded to the internal decoder buffers, which are valid until the next Decode call,
+	// and encoded before it
+	decoded := Image{Colorspace: ColorSpaceInternal}
+	var fitted Image
+	var userData []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, stats, err := decoder.Decode(DecoderFrame{
+			Output: &decoded,
+		})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if encoder == nil {
+			for _, u := range stats.UserData {
+				// the encoder writes its own tag, and the DivX5 tag describes the source bitstream
+				if !strings.HasPrefix(u, "XviD") && !strings.HasPrefix(u, "DivX") {
+					userData = append(userData, u)
+				}
 			}
 		}
-		cZonesPtr = &cZones[0]
+		if stats.StatsVOL != nil {
+			continue
+		}
+		if encoder == nil {
+			init := t.encoderInit
+			if init.Width == 0 || init.Height == 0 {
+				init.Width = decoder.Width + decoder.Width%2
+				init.Height = decoder.Height + decoder.Height%2
+			}
+			if init.UserData == nil {
+				init.UserData = userData
+			}
+			encoder, err = NewEncoder(&init)
+			if err != nil {
+				return err
+			}
+			writer = NewEncoderWriter(encoder, t.output, nil)
+		}
+		input := &Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     decoded.Planes,
+			Strides:    decoded.Strides,
+		}
+		if decoder.Width != encoder.width || decoder.Height != encoder.height {
+			fitPlanar(input, decoder.Width, decoder.Height, &fitted, encoder.width, encoder.height)
+			input = &fitted
+		}
+		if _, err := writer.Encode(EncoderFrame{
+			Input: input,
+		}); err != nil {
+			return err
+		}
 	}
-	var cPluginsPtr *C.xvid_enc_plugin_t = nil
-	if len(init.Plugins) > 0 {
-		cPlugins := make([]C.xvid_enc_plugin_t, len(init.Plugins))
-		cPluginsPtr = &cPlugins[0]
-		e.plugins = make([]Plugin, len(init.Plugins))
-		copy(e.plugins, init.Plugins)
-		for i, v := range init.Plugins {
-			if pi, ok := v.(pluginInternal); ok {
-				cPlugins[i] = pi.cPlugin
-			} else {
-				cPlugins[i] = C.xvid_enc_plugin_t{
-					_func: (*C.xvid_plugin_func)(unsafe.Pointer(C.pluginCallback_cgo)),
-					param: unsafe.Pointer(&e.plugins[i]),
+	if encoder == nil { // empty stream
+		return nil
+	}
+
+	return writer.Close()
+}
+
+// fitPlanar copies a ColorSpacePlanar image into a ColorSpacePlanar image of different dimensions, cropping or
+// padding with black on the right and bottom sides; dst is allocated if needed
+func fitPlanar(src *Image, srcWidth int, srcHeight int, dst *Image, width int, height int) {
+	if dst.Planes == nil {
+		*dst = Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     make([][]byte, 3),
+			Strides:    []int{width, (width + 1) / 2},
+		}
+		for j := range dst.Planes {
+			w, h := ColorSpacePlanar.planeSize(j, width, height)
+			dst.Planes[j] = make([]byte, w*h)
+		}
+	}
+	for j := range dst.Planes {
+		w, h := ColorSpacePlanar.planeSize(j, width, height)
+		sw, sh := ColorSpacePlanar.planeSize(j, srcWidth, srcHeight)
+		srcStride := src.Strides[0]
+		if j > 0 {
+			srcStride = src.Strides[1]
+		}
+		black := byte(16)
+		if j > 0 {
+			black = 128
+		}
+		for y := 0; y < h; y++ {
+			row := dst.Planes[j][y*w : (y+1)*w]
+			n := 0
+			if y < sh {
+				if sw < w {
+					n = copy(row[:sw], src.Planes[j][y*srcStride:])
+				} else {
+					n = copy(row, src.Planes[j][y*srcStride:])
 				}
 			}
+			for x := n; x < w; x++ {
+				row[x] = black
+			}
 		}
 	}
+}
 
-	cEncoreCreate := C.xvid_enc_create_t{
-		version:          C.XVID_VERSION,
-		profile:          C.int(init.Profile),
-		width:            C.int(init.Width),
-		height:           C.int(init.Height),
-		num_zones:        C.int(len(init.Zones)),
-		zones:            cZonesPtr,
-		num_plugins:      C.int(len(init.Plugins)),
-		plugins:          cPluginsPtr,
-		num_threads:      C.int(init.NumThreads),
-		max_bframes:      C.int(init.MaxBFrames),
-		global:           C.int(init.Flags),
-		fincr:            C.int(init.FrameRate.Denominator),
-		fbase:            C.int(init.FrameRate.Numerator),
-		max_key_interval: C.int(init.MaxKeyFrameInterval),
-		frame_drop_ratio: C.int(init.FrameDropRatio),
-		bquant_ratio:     C.int(init.BFrameQuantizer.Ratio),
-		bquant_offset:    C.int(init.BFrameQuantizer.Offset),
-		min_quant:        [3]C.int{C.int(init.QuantizerI.Min), C.int(init.QuantizerB.Min), C.int(init.QuantizerP.Min)},
-		max_quant:        [3]C.int{C.int(init.QuantizerI.Max), C.int(init.QuantizerB.Max), C.int(init.QuantizerP.Max)},
-		start_frame_num:  C.int(init.StartFrameNumber),
-		num_slices:       C.int(init.NumSlices),
+// AlphaEncoder encodes RGBA frames with transparency as two raw Xvid streams, as MPEG-4 Part 2 does not support
+// transparency: a color stream, with the (alpha-premultiplied) color of the frames, and an alpha stream, a greyscale
+// stream whose luma is the alpha of the frames. The streams have the same frames in the same order: frame i of the
+// alpha stream is the alpha of frame i of the color stream. They are typically stored as two separate files or
+// container tracks, and can be decoded with an AlphaDecoder.
+// To create an AlphaEncoder, use NewAlphaEncoder.
+// An AlphaEncoder must be closed after use, by calling its Close method.
+type AlphaEncoder struct {
+	color *Encoder
+	alpha *Encoder
+	// writers of the color and alpha streams
+	colorWriter *EncoderWriter
+	alphaWriter *EncoderWriter
+	// alpha image, the chroma is neutral
+	alphaImage Image
+	closed     bool
+}
+
+// NewAlphaEncoder creates a new AlphaEncoder writing the color stream to colorOut, encoded with an Encoder created
+// from colorInit, and the alpha stream to alphaOut, encoded with an Encoder created from alphaInit.
+// Both inits must have the same dimensions, and their FrameDropRatio must be 0 so that the frames of the streams
+// match. The alpha stream is encoded with VOPGreyscale. Init (or InitWithFlags) must be called once before calling
+// this function.
+// The writers are not closed automatically and must be closed by the caller after the AlphaEncoder is closed.
+func NewAlphaEncoder(colorInit *EncoderInit, alphaInit *EncoderInit, colorOut io.Writer, alphaOut io.Writer) (*AlphaEncoder, error) {
+	if colorInit == nil || alphaInit == nil {
+		return nil, errors.New("xvid: EncoderInit must not be nil")
 	}
-	encoderMutex.Lock()
-	encoder = &e
-	code := C.xvid_encore(nil, C.XVID_ENC_CREATE, unsafe.Pointer(&cEncoreCreate), nil)
-	encoder = nil
-	encoderMutex.Unlock()
-	for _, v := range init.Plugins {
-		if pi, ok := v.(pluginInternal); ok && pi.free != nil {
-			pi.free()
-		}
+	if colorInit.Width != alphaInit.Width || colorInit.Height != alphaInit.Height {
+		return nil, fmt.Errorf("xvid: color and alpha dimensions mismatch, %dx%d and %dx%d", colorInit.Width, colorInit.Height, alphaInit.Width, alphaInit.Height)
+	}
+	if colorInit.FrameDropRatio != 0 || alphaInit.FrameDropRatio != 0 {
+		return nil, errors.New("xvid: frame dropping must be disabled for alpha encoding")
 	}
+	color, err := NewEncoder(colorInit)
+	if err != nil {
+		return nil, err
+	}
+	alpha, err := NewEncoder(alphaInit)
+	if err != nil {
+		color.Close()
+		return nil, err
+	}
+	width, height := alphaInit.Width, alphaInit.Height
+	cw, ch := ColorSpacePlanar.planeSize(1, width, height)
+	chroma := make([]byte, cw*ch)
+	for i := range chroma {
+		chroma[i] = 128
+	}
+	return &AlphaEncoder{
+		color:       color,
+		alpha:       alpha,
+		colorWriter: NewEncoderWriter(color, colorOut, nil),
+		alphaWriter: NewEncoderWriter(alpha, alphaOut, nil),
+		alphaImage: Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     [][]byte{make([]byte, width*height), chroma, chroma},
+			Strides:    []int{width, cw},
+		},
+	}, nil
+}
 
-	if code != 0 {
-		return nil, xvidErr(code)
+// EncodeWithAlpha encodes a single RGBA frame, writing its color to the color stream and its alpha to the alpha
+// stream. The frame bounds must match the encoder dimensions.
+func (e *AlphaEncoder) EncodeWithAlpha(rgba *image.RGBA) error {
+	if e.closed {
+		return errors.New("xvid: alpha encoder is closed")
 	}
-	e.handle = cEncoreCreate.handle
-	return &e, nil
+	width, height := e.alpha.width, e.alpha.height
+	if rgba.Rect.Dx() != width || rgba.Rect.Dy() != height {
+		return fmt.Errorf("xvid: unexpected frame dimensions %dx%d, expected %dx%d", rgba.Rect.Dx(), rgba.Rect.Dy(), width, height)
+	}
+	pix := rgba.Pix[rgba.PixOffset(rgba.Rect.Min.X, rgba.Rect.Min.Y):]
+	alpha := e.alphaImage.Planes[0]
+	for y := 0; y < height; y++ {
+		row := pix[y*rgba.Stride:]
+		for x := 0; x < width; x++ {
+			alpha[y*width+x] = row[x*4+3]
+		}
+	}
+	if _, err := e.colorWriter.Encode(EncoderFrame{
+		Input: &Image{
+			Colorspace: ColorSpaceRGBA,
+			Planes:     [][]byte{pix},
+			Strides:    []int{rgba.Stride},
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := e.alphaWriter.Encode(EncoderFrame{
+		Input:    &e.alphaImage,
+		VOPFlags: VOPGreyscale,
+	}); err != nil {
+		return err
+	}
+	return nil
 }
 
-// Encode encodes a single Image to an encoded Xvid stream.
-//
-// Encode returns an int, which is the length in bytes of the frame that was written.
-// The Encoder might write data and return a non-zero int even if no frame was written
-// (even if EncoderStats is nil).
-//
-// Encode returns an EncoderStats, which stores information about the encoded frame,
-// which can be either a VOL (metadata), an actual frame, or nil. nil means that no
-// frame was encoded, even though some data may be written (and int could be > 0) as
-// Xvid can sometimes buffer frame data internally or write part of a frame to the stream.
-//
-// Encode returns an error, which if not nil can be due to invalid images, or internal
-// Xvid errors.
-//
-// In most cases, the Encode should not be used after an error occurs. The Encode must
-// still be closed with Close.
-func (e *Encoder) Encode(frame EncoderFrame) (int, *EncoderStats, error) {
+// Close flushes the frames buffered by the encoders, and closes the encoders. It must be called exactly once per
+// AlphaEncoder, which must not be used afterwards. It does not close the underlying writers.
+func (e *AlphaEncoder) Close() error {
 	if e.closed {
-		return 0, nil, fmt.Errorf("xvid: encoder is closed")
+		return nil
 	}
-	if frame.Input.Colorspace.value == ColorSpaceInternal.value {
-		return 0, nil, fmt.Errorf("xvid: unexpected colorspace ColorSpaceInternal, use only for output")
+	e.closed = true
+	defer e.color.Close()
+	defer e.alpha.Close()
+	if err := e.colorWriter.flush(); err != nil {
+		return err
 	}
-	var quantIntraMatrix *C.uchar = nil
-	if frame.QuantizerIntraMatrix != nil {
-		if len(frame.QuantizerIntraMatrix) != 64 {
-			return 0, nil, fmt.Errorf("xvid: expected quantization intra table of 64 coefficients, got %d", len(frame.QuantizerIntraMatrix))
+	if err := e.alphaWriter.flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AlphaDecoder decodes RGBA frames with transparency from a color stream and an alpha stream, as encoded by
+// an AlphaEncoder.
+// To create an AlphaDecoder, use NewAlphaDecoder.
+// An AlphaDecoder must be closed after use, by calling its Close method.
+type AlphaDecoder struct {
+	color      *Decoder
+	alpha      *Decoder
+	colorImage Image
+	alphaImage Image
+}
+
+// NewAlphaDecoder creates a new AlphaDecoder reading the color stream from color and the alpha stream from alpha.
+// Init (or InitWithFlags) must be called once before calling this function.
+// The readers are not closed automatically and must be closed by the caller after the AlphaDecoder is closed.
+func NewAlphaDecoder(color io.Reader, alpha io.Reader) (*AlphaDecoder, error) {
+	colorDecoder, err := NewDecoder(DecoderInit{Input: color})
+	if err != nil {
+		return nil, err
+	}
+	alphaDecoder, err := NewDecoder(DecoderInit{Input: alpha})
+	if err != nil {
+		colorDecoder.Close()
+		return nil, err
+	}
+	return &AlphaDecoder{
+		color:      colorDecoder,
+		alpha:      alphaDecoder,
+		colorImage: Image{Colorspace: ColorSpaceRGBA},
+		alphaImage: Image{Colorspace: ColorSpacePlanar},
+	}, nil
+}
+
+// decodeFrame decodes the next actual frame of a decoder, skipping metadata (VOL) frames
+func decodeFrame(d *Decoder, output *Image) error {
+	for {
+		_, stats, err := d.Decode(DecoderFrame{Output: output})
+		if err != nil {
+			return err
 		}
-		quantIntraMatrix = (*C.uchar)(unsafe.Pointer(&frame.QuantizerIntraMatrix[0]))
+		if stats.StatsVOL != nil {
+			// the dimensions may have changed, let the decoder reallocate its output
+			*output = Image{Colorspace: output.Colorspace}
+			continue
+		}
+		return nil
 	}
-	var quantInterMatrix *C.uchar = nil
-	if frame.QuantizerInterMatrix != nil {
-		if len(frame.QuantizerInterMatrix) != 64 {
-			return 0, nil, fmt.Errorf("xvid: expected quantization inter table of 64 coefficients, got %d", len(frame.QuantizerIntraMatrix))
+}
+
+// DecodeWithAlpha decodes the next frame of the color and alpha streams, and recombines them in a newly allocated
+// RGBA frame. The color is clamped to the alpha, so that the frame is a valid alpha-premultiplied RGBA image
+// despite the compression loss.
+// It returns io.EOF at the end of the streams, and an error if the streams do not match.
+func (d *AlphaDecoder) DecodeWithAlpha() (*image.RGBA, error) {
+	colorErr := decodeFrame(d.color, &d.colorImage)
+	alphaErr := decodeFrame(d.alpha, &d.alphaImage)
+	if colorErr == io.EOF && alphaErr == io.EOF {
+		return nil, io.EOF
+	} else if colorErr == io.EOF || alphaErr == io.EOF {
+		return nil, errors.New("xvid: color and alpha streams have a different number of frames")
+	} else if colorErr != nil {
+		return nil, colorErr
+	} else if alphaErr != nil {
+		return nil, alphaErr
+	}
+	width, height := d.color.Width, d.color.Height
+	if d.alpha.Width != width || d.alpha.Height != height {
+		return nil, fmt.Errorf("xvid: color and alpha dimensions mismatch, %dx%d and %dx%d", width, height, d.alpha.Width, d.alpha.Height)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		src := d.colorImage.Planes[0][y*d.colorImage.Strides[0]:]
+		alpha := d.alphaImage.Planes[0][y*d.alphaImage.Strides[0]:]
+		dst := rgba.Pix[y*rgba.Stride:]
+		for x := 0; x < width; x++ {
+			a := alpha[x]
+			for c := 0; c < 3; c++ {
+				v := src[x*4+c]
+				if v > a {
+					v = a
+				}
+				dst[x*4+c] = v
+			}
+			dst[x*4+3] = a
 		}
-		quantInterMatrix = (*C.uchar)(unsafe.Pointer(&frame.QuantizerInterMatrix[0]))
 	}
-	cInput, err := frame.Input.nativeInput(e.width, e.height)
-	if err != nil {
-		return 0, nil, err
+	return rgba, nil
+}
+
+// Close closes the decoders. It must be called exactly once per AlphaDecoder, which must not be used afterwards.
+func (d *AlphaDecoder) Close() {
+	d.color.Close()
+	d.alpha.Close()
+}
+
+// downsampleChroma downsamples a ColorSpacePlanar422 image to the encoder ColorSpacePlanar image
+func (e *Encoder) downsampleChroma(input *Image, filter ChromaFilter) error {
+	switch filter {
+	case ChromaFilterAverage, ChromaFilterDrop, ChromaFilterSmooth:
+	default:
+		return fmt.Errorf("xvid: invalid chroma filter %d", filter)
 	}
-	if l := BufferSize(e.width, e.height); len(*frame.Output) < l {
-		*frame.Output = make([]byte, l)
+	cw, ch := ColorSpacePlanar.planeSize(1, e.width, e.height)
+	if e.downsampled.Planes == nil {
+		e.downsampled = Image{
+			Colorspace: ColorSpacePlanar,
+			Planes:     [][]byte{nil, make([]byte, cw*ch), make([]byte, cw*ch)},
+			Strides:    []int{0, cw},
+		}
 	}
-	bitstream := unsafe.Pointer(&(*frame.Output)[0])
-	cEncoreFrame := C.xvid_enc_frame_t{
-		version:            C.XVID_VERSION,
-		vol_flags:          C.int(frame.VOLFlags),
-		quant_intra_matrix: quantIntraMatrix,
-		quant_inter_matrix: quantInterMatrix,
-		par:                C.int(frame.PixelAspectRatio.value),
-		par_width:          C.int(frame.PixelAspectRatio.Width),
-		par_height:         C.int(frame.PixelAspectRatio.Height),
-		fincr:              C.int(frame.FrameRateDenominator),
-		vop_flags:          C.int(frame.VOPFlags),
-		motion:             C.int(frame.MotionFlags),
-		input:              *cInput,
-		_type:              C.int(frame.Type),
-		quant:              C.int(frame.Quantizer),
-		bframe_threshold:   C.int(frame.BFrameThreshold),
-		bitstream:          bitstream,
-		length:             C.int(len(*frame.Output)),
+	// the luma is not copied
+	e.downsampled.Planes[0] = input.Planes[0]
+	e.downsampled.Strides[0] = input.Strides[0]
+	if e.downsampled.Strides[0] == 0 {
+		e.downsampled.Strides[0] = e.width
 	}
-	cEncodeStats := C.xvid_enc_stats_t{
-		version: C.XVID_VERSION,
+	stride := input.Strides[1]
+	if stride == 0 {
+		stride = cw
 	}
-	code := C.xvid_encore(e.handle, C.XVID_ENC_ENCODE, unsafe.Pointer(&cEncoreFrame), unsafe.Pointer(&cEncodeStats))
-	if code < 0 {
-		return 0, nil, xvidErr(code)
+	for j := 1; j < 3; j++ {
+		src := input.Planes[j]
+		dst := e.downsampled.Planes[j]
+		// row y of the source, clamped to the image
+		row := func(y int) []byte {
+			if y < 0 {
+				y = 0
+			} else if y >= e.height {
+				y = e.height - 1
+			}
+			return src[y*stride : y*stride+cw]
+		}
+		for y := 0; y < ch; y++ {
+			out := dst[y*cw : (y+1)*cw]
+			switch filter {
+			case ChromaFilterDrop:
+				copy(out, row(2*y))
+			case ChromaFilterAverage:
+				r0, r1 := row(2*y), row(2*y+1)
+				for x := range out {
+					out[x] = byte((int(r0[x]) + int(r1[x]) + 1) / 2)
+				}
+			case ChromaFilterSmooth:
+				r0, r1, r2, r3 := row(2*y-1), row(2*y), row(2*y+1), row(2*y+2)
+				for x := range out {
+					out[x] = byte((int(r0[x]) + 3*int(r1[x]) + 3*int(r2[x]) + int(r3[x]) + 4) / 8)
+				}
+			}
+		}
 	}
-	keyframe := cEncoreFrame.out_flags&C.XVID_KEYFRAME != 0
-	var stats *EncoderStats = nil
-	frameType := FrameType(cEncodeStats._type)
-	if frameType != C.XVID_TYPE_NOTHING {
-		stats = &EncoderStats{
-			FrameType:     frameType,
-			KeyFrame:      keyframe,
-			Quantizer:     int(cEncodeStats.quant),
-			VOLFlags:      VOLFlag(cEncodeStats.vol_flags),
-			VOPFlags:      VOPFlag(cEncodeStats.vop_flags),
-			Length:        int(cEncodeStats.length),
-			HeaderLength:  int(cEncodeStats.hlength),
-			IntraBlocks:   int(cEncodeStats.kblks),
-			InterBlocks:   int(cEncodeStats.mblks),
-			UncodedBlocks: int(cEncodeStats.ublks),
-			SSEY:          int(cEncodeStats.sse_y),
-			SSEU:          int(cEncodeStats.sse_u),
-			SSEV:          int(cEncodeStats.sse_v),
+	return nil
+}
+
+// setTimestamps sets the PTS and DTS stats of an emitted frame
+func (e *Encoder) setTimestamps(stats *EncoderStats) {
+	frameNum := e.codedFrames
+	if e.lastFrameNum != nil {
+		if e.firstFrameNum < 0 {
+			e.firstFrameNum = *e.lastFrameNum
 		}
+		frameNum = *e.lastFrameNum - e.firstFrameNum
 	}
-	return int(code), stats, nil
+	timestamp := func(i int) time.Duration {
+		if i < e.timestampsBase || i-e.timestampsBase >= len(e.timestamps) {
+			return 0
+		}
+		return e.timestamps[i-e.timestampsBase]
+	}
+	stats.PTS = timestamp(frameNum)
+	stats.DTS = timestamp(e.codedFrames) - time.Duration(e.reorderDelay)*e.frameDuration
+	e.codedFrames++
+	// frames before the coding index minus 1 are not needed anymore: B-frames are at most one frame before
+	if n := e.codedFrames - 1 - e.timestampsBase; n > 0 && n <= len(e.timestamps) {
+		e.timestamps = append(e.timestamps[:0], e.timestamps[n:]...)
+		e.timestampsBase += n
+	}
+}
+
+// ReorderDelay returns the number of frames by which the decoding timestamps of the emitted frames precede their
+// presentation timestamps (see EncoderStats.DTS): 1 if B-frames are enabled (EncoderInit.MaxBFrames > 0), 0
+// otherwise. A delay of 1 is enough for any number of consecutive B-frames, since the coding index of each frame is
+// at most one more than its display index: the reference frame following B-frames is coded before them, which
+// shifts each B-frame by one frame. This is not the encoder latency, which is up to EncoderInit.MaxBFrames frames,
+// see PendingFrames.
+func (e *Encoder) ReorderDelay() int {
+	return e.reorderDelay
+}
+
+// PendingFrames returns the number of input frames accepted by Encode but not emitted yet, i.e. the frames held
+// by the encoder (e.g. before B-frames, when EncoderInit.MaxBFrames > 0), for latency budgeting; it is 0 after all
+// the frames have been drained with Flush.
+func (e *Encoder) PendingFrames() int {
+	if n := e.inputFrames - e.codedFrames; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// frameNumRecorder is a plugin recording the input frame number of the frames emitted by an Encoder
+// it does not reference the Encoder, so that the Encoder can be finalized
+type frameNumRecorder struct {
+	lastFrameNum *int
+}
+
+func (p frameNumRecorder) Info() PluginFlag            { return 0 }
+func (p frameNumRecorder) Init(create PluginInit) bool { return true }
+func (p frameNumRecorder) Close(close PluginClose)     {}
+func (p frameNumRecorder) Before(data *PluginData)     {}
+func (p frameNumRecorder) Frame(data *PluginData)      {}
+func (p frameNumRecorder) After(data *PluginData) {
+	*p.lastFrameNum = data.FrameNum
+}
+
+// trackKeyFrame updates the keyframe interval tracking with an emitted frame and sets its SceneChange stat
+func (e *Encoder) trackKeyFrame(stats *EncoderStats) {
+	if !stats.KeyFrame {
+		if e.framesSinceKeyFrame >= 0 {
+			e.framesSinceKeyFrame++
+		}
+		return
+	}
+	switch {
+	case e.forcedKeyFrames > 0:
+		e.forcedKeyFrames--
+	case e.framesSinceKeyFrame < 0:
+		// first keyframe of the stream
+	case e.framesSinceKeyFrame+1 < e.maxKeyFrameInterval:
+		stats.SceneChange = true
+	}
+	e.framesSinceKeyFrame = 0
 }
 
 // Close closes any internal resources specific to the Encoder.
@@ -2031,10 +7563,12 @@ func (e *Encoder) Close() {
 		return
 	}
 	e.closed = true
+	runtime.SetFinalizer(e, nil)
 	C.xvid_encore(e.handle, C.XVID_ENC_DESTROY, nil, nil)
-	for _, plugin := range e.plugins {
-		if pi, ok := plugin.(pluginInternal); ok && pi.destroyFree != nil {
-			pi.destroyFree()
-		}
+	releaseThreads(e.threads)
+	e.freePlugins()
+	if pluginGuard {
+		e.lastPluginGuard.check()
+		e.lastPluginGuard = nil
 	}
 }
@@ -0,0 +1,2371 @@
+package xvid
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// initXvid initializes Xvid, skipping the test if xvidcore is not usable
+func initXvid(t testing.TB) {
+	if err := Init(); err != nil {
+		t.Skipf("xvidcore not available: %v", err)
+	}
+}
+
+// testEncoderInit returns a configuration encoding small frames with a fixed quantizer and B-frames
+func testEncoderInit(width int, height int) *EncoderInit {
+	init := NewEncoderInit(width, height, Fraction{25, 1}, nil)
+	init.MaxBFrames = 2
+	init.FixedQuantizer = 4
+	return init
+}
+
+// encodeTestStream encodes frames noise test pattern frames with init and returns the encoded stream
+func encodeTestStream(t testing.TB, init *EncoderInit, frames int) []byte {
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return writeTestStream(t, encoder, init.Width, init.Height, frames)
+}
+
+// writeTestStream encodes frames noise test pattern frames with encoder, flushes it and returns the encoded stream
+func writeTestStream(t testing.TB, encoder *Encoder, width int, height int, frames int) []byte {
+	var buf bytes.Buffer
+	w := NewEncoderWriter(encoder, &buf, nil)
+	for i := 0; i < frames; i++ {
+		if _, err := w.Encode(EncoderFrame{
+			Input: TestPattern(width, height, PatternNoise, int64(i)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeTestStream decodes all the frames of data to colorspace, and returns the stats of the actual frames
+func decodeTestStream(t testing.TB, data []byte, colorspace ColorSpace) []DecoderStats {
+	decoder, err := NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	var frames []DecoderStats
+	for {
+		output := Image{Colorspace: colorspace}
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &output})
+		if err == io.EOF {
+			return frames
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if stats.StatsFrame != nil {
+			frames = append(frames, stats)
+		}
+	}
+}
+
+func TestEncoderWriterDigest(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var buf bytes.Buffer
+	w := NewEncoderWriter(encoder, &buf, nil)
+	const frames = 10
+	for i := 0; i < frames; i++ {
+		if _, err := w.Encode(EncoderFrame{
+			Input: TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(buf.Bytes()); !bytes.Equal(w.Digest(), sum[:]) {
+		t.Errorf("digest %x does not match the written stream hash %x", w.Digest(), sum)
+	}
+	if n := len(decodeTestStream(t, buf.Bytes(), ColorSpaceNoOutput)); n != frames {
+		t.Errorf("decoded %d frames, expected %d: the buffered B-frames were not written", n, frames)
+	}
+}
+
+func TestEncoderDroppedFrames(t *testing.T) {
+	initXvid(t)
+	for _, ratio := range []int{0, 100} {
+		init := testEncoderInit(64, 48)
+		init.MaxBFrames = 0
+		init.FrameDropRatio = ratio
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		var output []byte
+		dropped := 0
+		const frames = 10
+		for i := 0; i < frames; i++ {
+			// the first frame is a key frame, and all the macroblocks of the following frames can be dropped
+			kind := PatternBars
+			if i > 0 {
+				kind = PatternNoise
+			}
+			n, stats, err := encoder.Encode(EncoderFrame{
+				Input:  TestPattern(init.Width, init.Height, kind, int64(i)),
+				Output: &output,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, output[:n]...)
+			if stats != nil && stats.Dropped {
+				if stats.FrameType != FrameTypeP {
+					t.Errorf("ratio %d: frame %d of type %v reported as dropped", ratio, i, stats.FrameType)
+				}
+				dropped++
+			}
+		}
+		if encoder.DroppedFrameCount() != dropped {
+			t.Errorf("ratio %d: DroppedFrameCount %d, expected %d", ratio, encoder.DroppedFrameCount(), dropped)
+		}
+		encoder.Close()
+		switch {
+		case ratio == 0 && dropped != 0:
+			t.Errorf("ratio 0: %d frames reported as dropped, expected none", dropped)
+		case ratio == 100 && dropped != frames-1:
+			t.Errorf("ratio 100: %d frames reported as dropped, expected %d", dropped, frames-1)
+		}
+		// the dropped frames are still decoded, repeating the previous frame
+		if n := len(decodeTestStream(t, data, ColorSpaceNoOutput)); n != frames {
+			t.Errorf("ratio %d: decoded %d frames, expected %d", ratio, n, frames)
+		}
+	}
+}
+
+func TestThumbnailBFrames(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxKeyFrameInterval = 6
+	const frames = 15
+	data := encodeTestStream(t, init, frames)
+
+	decoder, err := NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decoder.DecodeAll(ColorSpaceRGBA)
+	decoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != frames {
+		t.Fatalf("decoded %d frames, expected %d", len(decoded), frames)
+	}
+	for i, frame := range decoded {
+		thumbnail, err := Thumbnail(bytes.NewReader(data), time.Duration(i)*time.Second/25, Fraction{25, 1})
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		rgba := thumbnail.(*image.RGBA)
+		for y := 0; y < init.Height; y++ {
+			row := frame.Image.Planes[0][y*frame.Image.Strides[0]:][:init.Width*4]
+			if !bytes.Equal(rgba.Pix[y*rgba.Stride:][:init.Width*4], row) {
+				t.Errorf("frame %d (%v): thumbnail differs from the decoded frame", i, frame.Stats.FrameType)
+				break
+			}
+		}
+	}
+	if _, err := Thumbnail(bytes.NewReader(data), frames*time.Second/25, Fraction{25, 1}); err == nil {
+		t.Error("expected an error for a time past the end of the stream")
+	}
+}
+
+func TestEncoderTimestamps(t *testing.T) {
+	initXvid(t)
+	for _, bFrames := range []int{0, 2} {
+		init := testEncoderInit(64, 48)
+		init.MaxBFrames = bFrames
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		const frames = 12
+		var stats []*EncoderStats
+		var output []byte
+		for i := 0; i < frames; i++ {
+			_, s, err := encoder.Encode(EncoderFrame{
+				Input:     TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+				Output:    &output,
+				Timestamp: time.Duration(i) * 40 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != nil {
+				stats = append(stats, s)
+			}
+		}
+		for {
+			_, s, err := encoder.Flush(&output)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if s != nil {
+				stats = append(stats, s)
+			}
+		}
+		encoder.Close()
+		if len(stats) != frames {
+			t.Fatalf("max B-frames %d: %d frames emitted, expected %d", bFrames, len(stats), frames)
+		}
+		seen := make(map[time.Duration]bool)
+		for i, s := range stats {
+			if s.PTS%(40*time.Millisecond) != 0 || s.PTS >= frames*40*time.Millisecond || seen[s.PTS] {
+				t.Errorf("max B-frames %d: frame %d: unexpected PTS %v", bFrames, i, s.PTS)
+			}
+			seen[s.PTS] = true
+			if s.DTS > s.PTS {
+				t.Errorf("max B-frames %d: frame %d: DTS %v after PTS %v", bFrames, i, s.DTS, s.PTS)
+			}
+			if i > 0 && s.DTS <= stats[i-1].DTS {
+				t.Errorf("max B-frames %d: frame %d: DTS %v not increasing", bFrames, i, s.DTS)
+			}
+			if bFrames == 0 && s.PTS != time.Duration(i)*40*time.Millisecond {
+				t.Errorf("max B-frames 0: frame %d: PTS %v, expected frames in input order", i, s.PTS)
+			}
+		}
+	}
+}
+
+// benchmarkImages returns NRGBA images, which are converted through the intermediate RGBA and planar buffers
+func benchmarkImages(n int) []image.Image {
+	images := make([]image.Image, n)
+	for i := range images {
+		img := image.NewNRGBA(image.Rect(0, 0, 320, 240))
+		for j := range img.Pix {
+			img.Pix[j] = byte(i + j)
+		}
+		images[i] = img
+	}
+	return images
+}
+
+func BenchmarkBatchConvert(b *testing.B) {
+	initXvid(b)
+	images := benchmarkImages(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := BatchConvert(images, ColorSpaceYUY2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConvertPerImage(b *testing.B) {
+	initXvid(b)
+	images := benchmarkImages(64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// sequential conversions, allocating the intermediate buffers for each image
+		for _, img := range images {
+			if _, err := convertImage(img, ColorSpaceYUY2, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestVOLHeaderLength(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	init.MaxKeyFrameInterval = 4
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var output []byte
+	for i := 0; i < 8; i++ {
+		n, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := output[:n]
+		switch {
+		case !stats.KeyFrame:
+			if stats.VOLHeaderLength != 0 {
+				t.Errorf("frame %d: VOLHeaderLength %d on a non-key frame", i, stats.VOLHeaderLength)
+			}
+		case i == 0 && stats.VOLHeaderLength == 0:
+			t.Errorf("frame %d: no VOL header on the first frame", i)
+		}
+		if stats.VOLHeaderLength == 0 {
+			continue
+		}
+		if stats.VOLHeaderLength >= len(data) {
+			t.Fatalf("frame %d: VOLHeaderLength %d, frame length %d", i, stats.VOLHeaderLength, len(data))
+		}
+		header, frame := data[:stats.VOLHeaderLength], data[stats.VOLHeaderLength:]
+		if !bytes.HasPrefix(header, []byte{0, 0, 1}) || !bytes.Contains(header, []byte{0, 0, 1, 0x20}) {
+			t.Errorf("frame %d: headers % x do not contain a VOL", i, header)
+		}
+		if !bytes.HasPrefix(frame, []byte{0, 0, 1, 0xb6}) && !bytes.HasPrefix(frame, []byte{0, 0, 1, 0xb3}) {
+			t.Errorf("frame %d: data after the headers does not start with a VOP or GOV: % x", i, frame[:4])
+		}
+		if bytes.Contains(frame, []byte{0, 0, 1, 0x20}) {
+			t.Errorf("frame %d: VOL found after the headers", i)
+		}
+	}
+}
+
+func TestEncoderWarmup(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	expected := encodeTestStream(t, init, 10)
+
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	if err := encoder.Warmup(5); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewEncoderWriter(encoder, &buf, nil)
+	for i := 0; i < 10; i++ {
+		if _, err := w.Encode(EncoderFrame{
+			Input: TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Error("the stream encoded after Warmup differs from the stream encoded without it")
+	}
+}
+
+func TestOpaqueAlpha(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	data := encodeTestStream(t, testEncoderInit(width, height), 4)
+	checkAlpha := func(name string, img Image) {
+		_, _, _, a, _, _ := rgbLayout(img.Colorspace)
+		for y := 0; y < height; y++ {
+			row := img.Planes[0][y*img.Strides[0]:]
+			for x := 0; x < width; x++ {
+				if row[x*4+a] != 255 {
+					t.Fatalf("%s: alpha %d at (%d, %d), expected 255", name, row[x*4+a], x, y)
+				}
+			}
+		}
+	}
+	for _, cs := range []ColorSpace{ColorSpaceRGBA, ColorSpaceBGRA, ColorSpaceARGB, ColorSpaceABGR} {
+		if _, _, _, a, size, ok := rgbLayout(cs); !ok || a < 0 || size != 4 {
+			t.Fatalf("color space %d: unexpected layout", cs.value)
+		}
+		decoder, err := NewDecoderBytes(data, DecoderInit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, err := decoder.DecodeAll(cs)
+		decoder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, frame := range frames {
+			checkAlpha(fmt.Sprintf("color space %d: decoded frame %d", cs.value, i), frame.Image)
+		}
+
+		for _, flip := range []bool{false, true} {
+			output := Image{
+				Colorspace:   cs,
+				VerticalFlip: flip,
+				Strides:      []int{width*4 + 16},
+			}
+			if err := Convert(*TestPattern(width, height, PatternGradient, 0), &output, width, height, false); err != nil {
+				t.Fatal(err)
+			}
+			checkAlpha(fmt.Sprintf("color space %d: converted (flip %v)", cs.value, flip), output)
+		}
+	}
+}
+
+func TestNewDecoderBytesTail(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	const frames = 6
+	data := encodeTestStream(t, init, frames)
+	// the last frame ends in a partial 8-byte chunk, at the end of the allocation
+	for len(data)%8 == 0 {
+		data = append(data, 0)
+	}
+	data = append([]byte(nil), data...)[:len(data):len(data)]
+
+	decoder, err := NewDecoder(DecoderInit{Input: bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := decoder.DecodeAll(ColorSpacePlanar)
+	decoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err = NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decoder.DecodeAll(ColorSpacePlanar)
+	decoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != frames || len(expected) != frames {
+		t.Fatalf("decoded %d frames from bytes and %d from a reader, expected %d", len(decoded), len(expected), frames)
+	}
+	for i := range decoded {
+		for j := range decoded[i].Image.Planes {
+			if !bytes.Equal(decoded[i].Image.Planes[j], expected[i].Image.Planes[j]) {
+				t.Errorf("frame %d: plane %d differs from the frame decoded from a reader", i, j)
+			}
+		}
+	}
+}
+
+func TestDecodeFrameBytes(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const frames = 8
+	var payloads [][]byte
+	var output []byte
+	// the payloads are copied without any capacity past their end
+	for i := 0; i < frames; i++ {
+		n, _, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, append([]byte(nil), output[:n]...)[:n:n])
+	}
+	for {
+		n, _, err := encoder.Flush(&output)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, append([]byte(nil), output[:n]...)[:n:n])
+	}
+	encoder.Close()
+
+	decoder, err := NewDecoder(DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	decoded := 0
+	for i, payload := range payloads {
+		for len(payload) > 0 {
+			output := Image{Colorspace: ColorSpacePlanar}
+			n, stats, err := decoder.DecodeFrameBytes(DecoderFrame{Output: &output}, payload)
+			if err != nil {
+				t.Fatalf("payload %d: %v", i, err)
+			}
+			if n == 0 {
+				t.Fatalf("payload %d: no data consumed from %d bytes", i, len(payload))
+			}
+			if stats.StatsFrame != nil {
+				decoded++
+			}
+			payload = payload[n:]
+		}
+	}
+	for {
+		output := Image{Colorspace: ColorSpacePlanar}
+		_, stats, err := decoder.DecodeFrameBytes(DecoderFrame{Output: &output}, nil)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if stats.StatsFrame != nil {
+			decoded++
+		}
+	}
+	if decoded != frames {
+		t.Errorf("decoded %d frames, expected %d", decoded, frames)
+	}
+}
+
+func TestConvertSemiPlanarFlip(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	planar := *TestPattern(width, height, PatternGradient, 0)
+	for _, flip := range []bool{false, true} {
+		// the same image as NV12, with the chroma planes interleaved
+		nv12 := Image{Colorspace: ColorSpaceNV12}
+		if err := Convert(planar, &nv12, width, height, false); err != nil {
+			t.Fatal(err)
+		}
+		planar.VerticalFlip = flip
+		nv12.VerticalFlip = flip
+		expected := Image{Colorspace: ColorSpaceRGBA}
+		if err := Convert(planar, &expected, width, height, false); err != nil {
+			t.Fatal(err)
+		}
+		output := Image{Colorspace: ColorSpaceRGBA}
+		if err := Convert(nv12, &output, width, height, false); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Planes[0], expected.Planes[0]) {
+			t.Errorf("flip %v: NV12 input converted differently from the planar input", flip)
+		}
+		planar.VerticalFlip = false
+	}
+}
+
+func TestConvertImageParity(t *testing.T) {
+	initXvid(t)
+	// the same source pixels, with even and odd dimensions
+	src := image.NewNRGBA(image.Rect(0, 0, 65, 49))
+	for i := range src.Pix {
+		src.Pix[i] = byte(i * 7)
+	}
+	for _, flip := range []bool{false, true} {
+		odd, err := ConvertImage(src, ColorSpaceRGBA, flip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		even, err := ConvertImage(src.SubImage(image.Rect(0, 0, 64, 48)), ColorSpaceRGBA, flip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oddRGBA, evenRGBA := odd.(*image.RGBA), even.(*image.RGBA)
+		for y := 0; y < 48; y++ {
+			// with a flip, the rows of the even image are offset by the extra row of the odd image
+			oddY := y
+			if flip {
+				oddY++
+			}
+			if !bytes.Equal(evenRGBA.Pix[y*evenRGBA.Stride:][:64*4], oddRGBA.Pix[oddY*oddRGBA.Stride:][:64*4]) {
+				t.Errorf("flip %v: row %d converted differently for even and odd dimensions", flip, y)
+				break
+			}
+		}
+	}
+}
+
+// encodeFrameTypes encodes frames noise test pattern frames with init, forcing a key frame before the frames of
+// forced, and returns the types of the encoded frames in input order
+func encodeFrameTypes(t testing.TB, init *EncoderInit, frames int, forced map[int]bool) []FrameType {
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	const duration = 40 * time.Millisecond
+	types := make([]FrameType, frames)
+	record := func(stats *EncoderStats) {
+		if stats == nil || stats.FrameType == FrameTypeVOL {
+			return
+		}
+		if i := int(stats.PTS / duration); i >= 0 && i < frames {
+			types[i] = stats.FrameType
+		}
+	}
+	var output []byte
+	for i := 0; i < frames; i++ {
+		if forced[i] {
+			encoder.ForceKeyFrame()
+		}
+		_, stats, err := encoder.Encode(EncoderFrame{
+			Input:     TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output:    &output,
+			Timestamp: time.Duration(i) * duration,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		record(stats)
+	}
+	for {
+		_, stats, err := encoder.Flush(&output)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		record(stats)
+	}
+	return types
+}
+
+// frameTypes parses a string of frame types such as "IBBP"
+func frameTypes(s string) []FrameType {
+	types := make([]FrameType, len(s))
+	for i, c := range s {
+		switch c {
+		case 'I':
+			types[i] = FrameTypeI
+		case 'P':
+			types[i] = FrameTypeP
+		case 'B':
+			types[i] = FrameTypeB
+		}
+	}
+	return types
+}
+
+func TestGOPPatternForceKeyFrame(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.GOPPattern = "IBBP"
+	init.MaxKeyFrameInterval = 100
+	types := encodeFrameTypes(t, init, 12, map[int]bool{5: true})
+	expected := frameTypes("IBBPB" + "IBBPBBP")
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Errorf("frame %d: type %v, expected %v (types %v)", i, types[i], expected[i], types)
+		}
+	}
+}
+
+func TestCopyPlanes(t *testing.T) {
+	const width, height = 8, 4
+	// edged planes, with the layout of the internal images (one stride per plane) and of ColorSpacePlanar
+	y := make([]byte, 12*height)
+	u := make([]byte, 6*height/2)
+	v := make([]byte, 6*height/2)
+	for i := range y {
+		y[i] = byte(i)
+	}
+	for i := range u {
+		u[i] = byte(100 + i)
+		v[i] = byte(200 + i)
+	}
+	for _, strides := range [][]int{{12, 6, 6}, {12, 6}} {
+		input := Image{Colorspace: ColorSpacePlanar, Planes: [][]byte{y, u, v}, Strides: strides}
+		output := copyPlanes(&input, width, height)
+		if len(output.Strides) != ColorSpacePlanar.Strides || output.Strides[0] != width || output.Strides[1] != width/2 {
+			t.Errorf("input strides %v: unexpected output strides %v", strides, output.Strides)
+		}
+		if err := output.Validate(width, height, false); err != nil {
+			t.Errorf("input strides %v: invalid output: %v", strides, err)
+		}
+		if output.Planes[0][width] != y[12] || output.Planes[1][width/2] != u[6] || output.Planes[2][width/2] != v[6] {
+			t.Errorf("input strides %v: rows not copied with the input strides", strides)
+		}
+	}
+}
+
+func TestCheckEncoderInitQuantizerRange(t *testing.T) {
+	for _, c := range []struct {
+		r        QuantizerRange
+		expected string
+	}{
+		{QuantizerRange{Min: 10, Max: 5}, "xvid: invalid QuantizerP range 10-5, Min must not be greater than Max"},
+		{QuantizerRange{Min: 0, Max: 1}, "xvid: invalid QuantizerP range 0-1 (with the default Min of 2), Min must not be greater than Max"},
+		{QuantizerRange{Min: 3, Max: 0}, ""},
+	} {
+		init := NewEncoderInit(64, 48, Fraction{25, 1}, nil)
+		init.QuantizerP = c.r
+		err := checkEncoderInit(init)
+		if c.expected == "" && err != nil {
+			t.Errorf("range %v: unexpected error: %v", c.r, err)
+		} else if c.expected != "" && (err == nil || err.Error() != c.expected) {
+			t.Errorf("range %v: error %v, expected %q", c.r, err, c.expected)
+		}
+	}
+}
+
+func TestGOPPatternSchedule(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.GOPPattern = "IBBP"
+	init.MaxKeyFrameInterval = 8
+	// the schedule takes precedence over the pattern
+	init.FrameTypeSchedule = map[int]FrameType{4: FrameTypeP}
+	types := encodeFrameTypes(t, init, 15, nil)
+	expected := frameTypes("IBBPPBPB" + "IBBPBBP")
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Errorf("frame %d: type %v, expected %v (types %v)", i, types[i], expected[i], types)
+		}
+	}
+}
+
+func TestKeyFramesOnly(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxKeyFrameInterval = 4
+	data := encodeTestStream(t, init, 10)
+
+	decoder, err := NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := decoder.DecodeAll(ColorSpaceRGBA)
+	decoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err = NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	output := Image{Colorspace: ColorSpaceRGBA}
+	var keyFrame []byte
+	i := 0
+	for {
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &output, KeyFramesOnly: true})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if stats.StatsFrame == nil {
+			continue
+		}
+		if i >= len(full) {
+			t.Fatalf("more frames decoded than the %d frames of the full decode", len(full))
+		}
+		if stats.FrameType != full[i].Stats.FrameType {
+			t.Errorf("frame %d: type %v, expected %v", i, stats.FrameType, full[i].Stats.FrameType)
+		}
+		if stats.FrameType == FrameTypeI {
+			keyFrame = full[i].Image.Planes[0]
+		}
+		// the output holds the last key frame
+		if keyFrame != nil && !bytes.Equal(output.Planes[0], keyFrame) {
+			t.Errorf("frame %d (%v): output differs from the last key frame of the full decode", i, stats.FrameType)
+		}
+		i++
+	}
+	if i != len(full) {
+		t.Errorf("decoded %d frames, expected %d", i, len(full))
+	}
+}
+
+func TestPendingFrames(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 2
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	if n := encoder.PendingFrames(); n != 0 {
+		t.Errorf("%d pending frames before encoding, expected 0", n)
+	}
+	var output []byte
+	maxPending := 0
+	for i := 0; i < 10; i++ {
+		if _, _, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		n := encoder.PendingFrames()
+		if n < 0 || n > init.MaxBFrames+1 {
+			t.Errorf("frame %d: %d pending frames, expected at most %d", i, n, init.MaxBFrames+1)
+		}
+		if n > maxPending {
+			maxPending = n
+		}
+	}
+	if maxPending == 0 {
+		t.Error("no pending frames with B-frames enabled")
+	}
+	for {
+		if _, _, err := encoder.Flush(&output); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := encoder.PendingFrames(); n != 0 {
+		t.Errorf("%d pending frames after Flush, expected 0", n)
+	}
+}
+
+func TestProbeStreamPixelAspectRatio(t *testing.T) {
+	initXvid(t)
+	for _, par := range []PixelAspectRatio{PixelAspectRatio169PAL, newPixelAspectRatio(3, 2)} {
+		init := testEncoderInit(64, 48)
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		var output []byte
+		for i := 0; i < 3; i++ {
+			n, _, err := encoder.Encode(EncoderFrame{
+				Input:            TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+				Output:           &output,
+				PixelAspectRatio: par,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, output[:n]...)
+		}
+		encoder.Close()
+		vol, err := ProbeStream(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vol.Width != init.Width || vol.Height != init.Height {
+			t.Errorf("PAR %v: dimensions %dx%d, expected %dx%d", par, vol.Width, vol.Height, init.Width, init.Height)
+		}
+		if vol.PixelAspectRatio != par {
+			t.Errorf("PAR %v: probed PAR %v", par, vol.PixelAspectRatio)
+		}
+	}
+}
+
+func TestCheckFourCC(t *testing.T) {
+	// bits past the 32 bits of a FourCC, lost if int is 32-bit
+	shift := uint(32)
+	high := int(FourCCXVID) | 1<<shift
+	for _, c := range []struct {
+		fourCC int
+		valid  bool
+	}{
+		{0, true},
+		{FourCCXVID, true},
+		{FourCCDX50, true},
+		{'D' | 'I'<<8 | 'V'<<16 | '3'<<24, false},
+		{'m' | 'p'<<8 | '4'<<16 | '3'<<24, false},
+		{'X' | 'V'<<8 | 'I'<<16 | 0x01<<24, false},
+		{high, high == FourCCXVID},
+	} {
+		if err := checkFourCC(c.fourCC); (err == nil) != c.valid {
+			t.Errorf("FourCC %#x: error %v, expected valid %v", c.fourCC, err, c.valid)
+		}
+	}
+}
+
+func TestDecodeFourCC(t *testing.T) {
+	initXvid(t)
+	const frames = 4
+	data := encodeTestStream(t, testEncoderInit(64, 48), frames)
+	for _, fourCC := range []int{FourCCXVID, FourCCDIVX, FourCCDX50, FourCC3IVX} {
+		decoder, err := NewDecoderBytes(data, DecoderInit{FourCC: fourCC})
+		if err != nil {
+			t.Fatalf("FourCC %#x: %v", fourCC, err)
+		}
+		decoded, err := decoder.DecodeAll(ColorSpacePlanar)
+		decoder.Close()
+		if err != nil {
+			t.Fatalf("FourCC %#x: %v", fourCC, err)
+		}
+		if len(decoded) != frames {
+			t.Errorf("FourCC %#x: decoded %d frames, expected %d", fourCC, len(decoded), frames)
+		}
+	}
+}
+
+func TestConverterAllocs(t *testing.T) {
+	initXvid(t)
+	input := *TestPattern(320, 240, PatternBars, 0)
+	for _, cs := range []ColorSpace{ColorSpaceRGBA, ColorSpaceYUY2, ColorSpaceI420} {
+		converter := NewConverter(cs, 320, 240, false)
+		if _, err := converter.Convert(input); err != nil {
+			t.Fatal(err)
+		}
+		allocs := testing.AllocsPerRun(10, func() {
+			if _, err := converter.Convert(input); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("color space %d: %v allocations per conversion, expected 0", cs.value, allocs)
+		}
+	}
+}
+
+func BenchmarkConverter(b *testing.B) {
+	initXvid(b)
+	input := *TestPattern(320, 240, PatternBars, 0)
+	converter := NewConverter(ColorSpaceRGBA, 320, 240, false)
+	// allocates the output planes
+	if _, err := converter.Convert(input); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := converter.Convert(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFieldsRoundTrip(t *testing.T) {
+	const width, height = 16, 12
+	// 4:2:0 image with padded rows
+	frame := Image{
+		Colorspace: ColorSpacePlanar,
+		Planes:     [][]byte{make([]byte, 20*height), make([]byte, 12*height/2), make([]byte, 12*height/2)},
+		Strides:    []int{20, 12},
+	}
+	for j, plane := range frame.Planes {
+		for k := range plane {
+			plane[k] = byte(j*100 + k)
+		}
+	}
+	// the chroma planes share the second stride
+	stride := func(j int) int {
+		if j == 0 {
+			return frame.Strides[0]
+		}
+		return frame.Strides[1]
+	}
+	top, bottom, err := frame.SeparateFields(width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := range frame.Planes {
+		w, rows := ColorSpacePlanar.planeSize(j, width, height)
+		for y := 0; y < rows; y++ {
+			field := top.Planes[j]
+			if y%2 == 1 {
+				field = bottom.Planes[j]
+			}
+			if !bytes.Equal(field[y/2*w:y/2*w+w], frame.Planes[j][y*stride(j):y*stride(j)+w]) {
+				t.Errorf("plane %d: row %d not in its field", j, y)
+			}
+		}
+	}
+	merged, err := MergeFields(top, bottom, width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Strides[0] != width || merged.Strides[1] != width/2 {
+		t.Errorf("merged strides %v, expected compact strides", merged.Strides)
+	}
+	for j := range frame.Planes {
+		w, rows := ColorSpacePlanar.planeSize(j, width, height)
+		for y := 0; y < rows; y++ {
+			if !bytes.Equal(merged.Planes[j][y*w:y*w+w], frame.Planes[j][y*stride(j):y*stride(j)+w]) {
+				t.Errorf("plane %d: row %d differs after merging the fields", j, y)
+			}
+		}
+	}
+	if _, _, err := frame.SeparateFields(width, height-2); err == nil {
+		t.Error("expected an error for a 4:2:0 height that is not a multiple of 4")
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	initXvid(t)
+	const frames = 10
+	source := encodeTestStream(t, testEncoderInit(64, 48), frames)
+
+	init := testEncoderInit(0, 0)
+	// a coarser quantizer lowers the bitrate
+	init.FixedQuantizer = 20
+	var out bytes.Buffer
+	if err := Transcode(bytes.NewReader(source), &out, init); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() >= len(source) {
+		t.Errorf("transcoded stream of %d bytes, expected less than the %d bytes of the source", out.Len(), len(source))
+	}
+	decoded := decodeTestStream(t, out.Bytes(), ColorSpacePlanar)
+	if len(decoded) != frames {
+		t.Fatalf("decoded %d frames, expected %d", len(decoded), frames)
+	}
+	for i, stats := range decoded {
+		if w, h := stats.Dimensions(); w != 64 || h != 48 {
+			t.Errorf("frame %d: dimensions %dx%d, expected 64x48", i, w, h)
+		}
+		for _, q := range stats.StatsFrame.Quantizers {
+			if q != 20 && stats.FrameType != FrameTypeB {
+				t.Errorf("frame %d: quantizer %d, expected 20", i, q)
+				break
+			}
+		}
+	}
+}
+
+// testPlugin is a custom plugin calling its functions, if set, on each frame callback
+type testPlugin struct {
+	flags  PluginFlag
+	before func(data *PluginData)
+	frame  func(data *PluginData)
+	after  func(data *PluginData)
+}
+
+func (p *testPlugin) Info() PluginFlag {
+	return p.flags
+}
+
+func (p *testPlugin) Init(create PluginInit) bool {
+	return true
+}
+
+func (p *testPlugin) Close(close PluginClose) {
+}
+
+func (p *testPlugin) Before(data *PluginData) {
+	if p.before != nil {
+		p.before(data)
+	}
+}
+
+func (p *testPlugin) Frame(data *PluginData) {
+	if p.frame != nil {
+		p.frame(data)
+	}
+}
+
+func (p *testPlugin) After(data *PluginData) {
+	if p.after != nil {
+		p.after(data)
+	}
+}
+
+func TestConcurrentEncoderPlugins(t *testing.T) {
+	initXvid(t)
+	const encoders = 4
+	const frames = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, encoders)
+	for i := 0; i < encoders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// each encoder has its own dimensions, so that its plugin can tell its frames from the others'
+			width := 16 * (i + 2)
+			var widths []int
+			var frameNums []int
+			init := testEncoderInit(width, 32)
+			init.MaxBFrames = 0
+			init.Plugins = []Plugin{&testPlugin{after: func(data *PluginData) {
+				widths = append(widths, data.Width)
+				frameNums = append(frameNums, data.FrameNum)
+			}}}
+			encoder, err := NewEncoder(init)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var output []byte
+			for j := 0; j < frames; j++ {
+				if _, _, err := encoder.Encode(EncoderFrame{
+					Input:  TestPattern(width, 32, PatternNoise, int64(j)),
+					Output: &output,
+				}); err != nil {
+					encoder.Close()
+					errs <- err
+					return
+				}
+			}
+			encoder.Close()
+			if len(widths) != frames {
+				errs <- fmt.Errorf("encoder %d: plugin called for %d frames, expected %d", i, len(widths), frames)
+				return
+			}
+			for j := range widths {
+				if widths[j] != width {
+					errs <- fmt.Errorf("encoder %d: plugin saw a frame of width %d, expected %d", i, widths[j], width)
+					return
+				}
+				if j > 0 && frameNums[j] != frameNums[j-1]+1 {
+					errs <- fmt.Errorf("encoder %d: plugin saw frame %d after frame %d", i, frameNums[j], frameNums[j-1])
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestThreadLimit(t *testing.T) {
+	SetMaxConcurrentThreads(4)
+	defer SetMaxConcurrentThreads(0)
+	if n := acquireThreads(3); n != 3 {
+		t.Fatalf("granted %d threads, expected 3", n)
+	}
+	// requests above the limit are capped to it
+	acquired := make(chan int)
+	go func() {
+		acquired <- acquireThreads(8)
+	}()
+	select {
+	case n := <-acquired:
+		t.Fatalf("granted %d threads while 3 of 4 threads are used", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	releaseThreads(3)
+	if n := <-acquired; n != 4 {
+		t.Fatalf("granted %d threads, expected 4", n)
+	}
+	// single-threaded instances never block
+	if n := acquireThreads(0); n != 0 {
+		t.Fatalf("granted %d threads, expected 0", n)
+	}
+	releaseThreads(4)
+
+	const workers = 8
+	var maxUsed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			n := acquireThreads(1 + i%3)
+			threadLimit.Lock()
+			used := threadLimit.used
+			threadLimit.Unlock()
+			mu.Lock()
+			if used > maxUsed {
+				maxUsed = used
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			releaseThreads(n)
+		}(i)
+	}
+	wg.Wait()
+	if maxUsed > 4 {
+		t.Errorf("%d threads used concurrently, expected at most 4", maxUsed)
+	}
+	if threadLimit.used != 0 {
+		t.Errorf("%d threads still used after releasing all of them", threadLimit.used)
+	}
+}
+
+func TestThreadLimitEncoders(t *testing.T) {
+	initXvid(t)
+	SetMaxConcurrentThreads(2)
+	defer SetMaxConcurrentThreads(0)
+	init := testEncoderInit(64, 48)
+	init.NumThreads = 2
+	first, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := first.Config().NumThreads; n != 2 {
+		t.Errorf("first encoder: config reports %d threads, expected 2", n)
+	}
+	created := make(chan *Encoder)
+	errs := make(chan error, 1)
+	go func() {
+		second, err := NewEncoder(init)
+		if err != nil {
+			errs <- err
+			return
+		}
+		created <- second
+	}()
+	select {
+	case second := <-created:
+		second.Close()
+		t.Fatal("second encoder created past the thread limit")
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case second := <-created:
+		if n := second.Config().NumThreads; n != 2 {
+			t.Errorf("second encoder: config reports %d threads, expected 2", n)
+		}
+		second.Close()
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("second encoder not created after the first encoder was closed")
+	}
+	if threadLimit.used != 0 {
+		t.Errorf("%d threads still used after closing the encoders", threadLimit.used)
+	}
+}
+
+func TestGetCapabilitiesRetry(t *testing.T) {
+	if _, err := GetCapabilities(); err != nil && capabilitiesDone {
+		t.Fatalf("failed capabilities probe cached: %v", err)
+	}
+	initXvid(t)
+	c, err := GetCapabilities()
+	if err != nil {
+		t.Fatalf("capabilities probe failed after Init: %v", err)
+	}
+	if !capabilitiesDone {
+		t.Fatal("successful capabilities probe not cached")
+	}
+	if cached, err := GetCapabilities(); err != nil || cached != c {
+		t.Errorf("cached capabilities %+v (error %v), expected %+v", cached, err, c)
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	const frames = 8
+	first := writeTestStream(t, encoder, init.Width, init.Height, frames)
+
+	// invalid configurations are rejected without destroying the current native encoder
+	for _, invalid := range []func(init *EncoderInit){
+		func(init *EncoderInit) { init.Width = 32 },
+		func(init *EncoderInit) { init.FixedQuantizer = 40 },
+		func(init *EncoderInit) { init.GOPPattern = "P" },
+		func(init *EncoderInit) { init.VOLHeaderInterval = -1 },
+	} {
+		resetInit := *init
+		invalid(&resetInit)
+		if err := encoder.Reset(&resetInit); err == nil {
+			t.Fatalf("expected an error resetting the encoder with %+v", resetInit)
+		}
+		if encoder.closed {
+			t.Fatal("encoder closed after an invalid Reset")
+		}
+	}
+
+	if err := encoder.Reset(nil); err != nil {
+		t.Fatal(err)
+	}
+	second := writeTestStream(t, encoder, init.Width, init.Height, frames)
+	for i, stream := range [][]byte{first, second} {
+		decoded := decodeTestStream(t, stream, ColorSpaceNoOutput)
+		if len(decoded) != frames {
+			t.Errorf("stream %d: decoded %d frames, expected %d", i, len(decoded), frames)
+			continue
+		}
+		if decoded[0].FrameType != FrameTypeI {
+			t.Errorf("stream %d: first frame of type %v, expected an I frame", i, decoded[0].FrameType)
+		}
+	}
+}
+
+func TestQuantizerGrid(t *testing.T) {
+	initXvid(t)
+	// dimensions that are not multiples of the macroblock size
+	const width = 72
+	const height = 40
+	data := encodeTestStream(t, testEncoderInit(width, height), 3)
+	for i, stats := range decodeTestStream(t, data, ColorSpacePlanar) {
+		grid := stats.StatsFrame.QuantizerGrid()
+		if len(grid) != (height+15)/16 {
+			t.Fatalf("frame %d: %d macroblock rows, expected %d", i, len(grid), (height+15)/16)
+		}
+		for y, row := range grid {
+			if len(row) != (width+15)/16 {
+				t.Fatalf("frame %d: row %d has %d macroblocks, expected %d", i, y, len(row), (width+15)/16)
+			}
+			for x, q := range row {
+				if at, ok := stats.StatsFrame.QuantizerAt(x, y); !ok || at != q {
+					t.Errorf("frame %d: QuantizerAt(%d, %d) is %d, expected %d", i, x, y, at, q)
+				}
+			}
+		}
+	}
+}
+
+func TestEncoderSceneChange(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	// a static scene, then a hard cut to a different content
+	const cut = 10
+	var output []byte
+	for i := 0; i < cut+3; i++ {
+		kind := PatternBars
+		if i >= cut {
+			kind = PatternNoise
+		}
+		_, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, kind, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats == nil {
+			t.Fatalf("frame %d: no frame emitted without B-frames", i)
+		}
+		score := stats.SceneChangeScore()
+		switch {
+		case i < cut && stats.SceneChange:
+			t.Errorf("frame %d: scene change reported before the cut", i)
+		case i > 0 && i < cut && score >= 0.5:
+			t.Errorf("frame %d: scene change score %.2f before the cut, expected a low score", i, score)
+		case i == cut && !stats.SceneChange && score < 0.5:
+			t.Errorf("frame %d (%v): no scene change reported at the cut, score %.2f", i, stats.FrameType, score)
+		}
+	}
+}
+
+func TestEncoderSceneChangeKeyFrames(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	init.MaxKeyFrameInterval = 5
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	// the key frames of a static scene are either forced or placed at the key frame interval
+	var output []byte
+	keyFrames := 0
+	for i := 0; i < 20; i++ {
+		if i == 7 {
+			encoder.ForceKeyFrame()
+		}
+		_, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternBars, 0),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats == nil {
+			t.Fatalf("frame %d: no frame emitted without B-frames", i)
+		}
+		if stats.KeyFrame {
+			keyFrames++
+		}
+		if stats.SceneChange {
+			t.Errorf("frame %d: scene change reported for a static scene", i)
+		}
+	}
+	if keyFrames < 4 {
+		t.Errorf("%d key frames, expected at least 4 with the forced key frame and the key frame interval", keyFrames)
+	}
+}
+
+func TestEncoderFirstFrameType(t *testing.T) {
+	initXvid(t)
+	for _, forced := range []FrameType{FrameTypeP, FrameTypeS} {
+		init := testEncoderInit(64, 48)
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		w := NewEncoderWriter(encoder, &buf, nil)
+		for i := 0; i < 5; i++ {
+			frame := EncoderFrame{
+				Input: TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			}
+			if i == 0 {
+				frame.Type = forced
+			}
+			if _, err := w.Encode(frame); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encoder.Close()
+		data := buf.Bytes()
+
+		// the VOL start code (00 00 01 2x) is before the first VOP start code (00 00 01 B6)
+		vop := bytes.Index(data, []byte{0, 0, 1, 0xb6})
+		vol := -1
+		for i := 0; i+3 < len(data); i++ {
+			if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && data[i+3]&0xf0 == 0x20 {
+				vol = i
+				break
+			}
+		}
+		if vol < 0 || vop < 0 || vol > vop {
+			t.Errorf("forced type %d: stream does not start with a VOL (VOL at %d, first VOP at %d)", forced, vol, vop)
+		}
+
+		decoder, err := NewDecoderBytes(data, DecoderInit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var types []FrameType
+		for {
+			_, stats, err := decoder.Decode(DecoderFrame{Output: &Image{Colorspace: ColorSpaceNoOutput}})
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("forced type %d: %v", forced, err)
+			}
+			if stats.FrameType == FrameTypeVOL || stats.StatsFrame != nil {
+				types = append(types, stats.FrameType)
+			}
+		}
+		decoder.Close()
+		if len(types) < 2 || types[0] != FrameTypeVOL || types[1] != FrameTypeI {
+			t.Errorf("forced type %d: decoded frame types %v, expected a VOL then an I frame", forced, types)
+		}
+		if n := len(types) - 1; n != 5 {
+			t.Errorf("forced type %d: decoded %d frames, expected 5", forced, n)
+		}
+	}
+}
+
+// goPluginsCount returns the number of registered custom plugins of live native encoders
+func goPluginsCount() int {
+	goPluginsMutex.RLock()
+	defer goPluginsMutex.RUnlock()
+	return len(goPlugins)
+}
+
+func TestEncoderFinalizer(t *testing.T) {
+	initXvid(t)
+	before := goPluginsCount()
+	func() {
+		init := testEncoderInit(64, 48)
+		init.Plugins = []Plugin{&testPlugin{}}
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output []byte
+		if _, _, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, 0),
+			Output: &output,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// the encoder is not closed
+	}()
+	if n := goPluginsCount(); n != before+1 {
+		t.Fatalf("%d registered plugins, expected %d", n, before+1)
+	}
+	// the finalizers run in their own goroutine after the garbage collection
+	for i := 0; i < 50 && goPluginsCount() != before; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := goPluginsCount(); n != before {
+		t.Errorf("%d registered plugins after the garbage collection, expected %d: the encoder was not finalized", n, before)
+	}
+}
+
+func TestDecoderQuantizerBuffer(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	const runs = 10
+	// each AllocsPerRun call decodes runs+1 frames
+	data := encodeTestStream(t, init, 2*(runs+1))
+	decoder, err := NewDecoderBytes(data, DecoderInit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	output := Image{Colorspace: ColorSpaceNoOutput}
+	// decode the VOL and the first frame
+	for {
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &output})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.StatsFrame != nil {
+			break
+		}
+	}
+	var buffer []int32
+	var failed error
+	decode := func(reuse bool) {
+		frame := DecoderFrame{Output: &output}
+		if reuse {
+			frame.QuantizerBuffer = buffer
+		}
+		_, stats, err := decoder.Decode(frame)
+		if err != nil {
+			failed = err
+			return
+		}
+		if stats.StatsFrame == nil || len(stats.StatsFrame.Quantizers) == 0 {
+			failed = fmt.Errorf("frame of type %v decoded without quantizers", stats.FrameType)
+			return
+		}
+		if reuse && buffer != nil && &stats.StatsFrame.Quantizers[0] != &buffer[0] {
+			failed = errors.New("quantizers not stored in the reused buffer")
+		}
+		buffer = stats.StatsFrame.Quantizers
+	}
+	allocated := testing.AllocsPerRun(runs, func() { decode(false) })
+	reused := testing.AllocsPerRun(runs, func() { decode(true) })
+	if failed != nil {
+		t.Fatal(failed)
+	}
+	// the only difference is the quantizers table, which is not allocated anymore
+	if allocated-reused != 1 {
+		t.Errorf("%v allocations per frame with a reused quantizer buffer, expected one less than the %v allocations without it", reused, allocated)
+	}
+}
+
+func TestDecoderLongStreamMemory(t *testing.T) {
+	initXvid(t)
+	// a long stream made of repeated copies of a short stream, each starting with a VOL; without B-frames, so that
+	// no frame is left buffered at the end of a copy
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	clip := encodeTestStream(t, init, 100)
+	const copies = 20
+	data := bytes.Repeat(clip, copies)
+	decoder, err := NewDecoder(DecoderInit{Input: bytes.NewReader(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	heapAlloc := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	output := Image{Colorspace: ColorSpacePlanar}
+	var start uint64
+	frames := 0
+	for {
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &output})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoder.timeCodes.pending) > maxPendingTimeCodes {
+			t.Fatalf("%d pending time codes, expected at most %d", len(decoder.timeCodes.pending), maxPendingTimeCodes)
+		}
+		if stats.StatsFrame == nil {
+			continue
+		}
+		frames++
+		if frames == 100 {
+			start = heapAlloc()
+		}
+	}
+	if frames != 100*copies {
+		t.Fatalf("decoded %d frames, expected %d", frames, 100*copies)
+	}
+	if end := heapAlloc(); end > start+256*1024 {
+		t.Errorf("heap grew from %d to %d bytes while decoding, expected flat memory", start, end)
+	}
+}
+
+func TestConvertSemiPlanarRoundTrip(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	const cw, ch = width / 2, height / 2
+	source := Image{Colorspace: ColorSpaceNV12}
+	if err := Convert(*TestPattern(width, height, PatternBars, 0), &source, width, height, false); err != nil {
+		t.Fatal(err)
+	}
+	rgba := Image{Colorspace: ColorSpaceRGBA}
+	if err := Convert(source, &rgba, width, height, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, flip := range []bool{false, true} {
+		expected := Image{Colorspace: ColorSpacePlanar, VerticalFlip: flip}
+		if err := Convert(rgba, &expected, width, height, false); err != nil {
+			t.Fatal(err)
+		}
+		for name, colorspace := range map[string]ColorSpace{"NV12": ColorSpaceNV12, "NV21": ColorSpaceNV21} {
+			output := Image{Colorspace: colorspace, VerticalFlip: flip}
+			if err := Convert(rgba, &output, width, height, false); err != nil {
+				t.Fatal(err)
+			}
+			u, v := expected.Planes[1], expected.Planes[2]
+			if colorspace.value == colorSpaceNV21 {
+				u, v = v, u
+			}
+			for y := 0; y < height; y++ {
+				if !bytes.Equal(output.Planes[0][y*output.Strides[0]:][:width], expected.Planes[0][y*expected.Strides[0]:][:width]) {
+					t.Fatalf("flip %v: %s: luma row %d differs from the planar conversion", flip, name, y)
+				}
+			}
+			for y := 0; y < ch; y++ {
+				row := output.Planes[1][y*output.Strides[1]:]
+				for x := 0; x < cw; x++ {
+					if row[2*x] != u[y*expected.Strides[1]+x] || row[2*x+1] != v[y*expected.Strides[1]+x] {
+						t.Fatalf("flip %v: %s: chroma at %d,%d differs from the planar conversion", flip, name, x, y)
+					}
+				}
+			}
+			if flip || colorspace.value != colorSpaceNV12 {
+				continue
+			}
+			// the color conversions are lossy, but the round trip is close to the source
+			for j := range source.Planes {
+				for i, b := range output.Planes[j] {
+					if d := int(b) - int(source.Planes[j][i]); d < -4 || d > 4 {
+						t.Fatalf("plane %d: byte %d is %d after the round trip, expected about %d", j, i, b, source.Planes[j][i])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPluginRetainedCopy(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	var copies []Image
+	init.Plugins = []Plugin{&testPlugin{before: func(data *PluginData) {
+		// the current frame is the input frame before encoding
+		copies = append(copies, data.CopyCurrent())
+	}}}
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	const frames = 6
+	var inputs []*Image
+	var output []byte
+	for i := 0; i < frames; i++ {
+		input := TestPattern(init.Width, init.Height, PatternNoise, int64(i))
+		inputs = append(inputs, input)
+		if _, _, err := encoder.Encode(EncoderFrame{Input: input, Output: &output}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(copies) != frames {
+		t.Fatalf("%d copies retained, expected %d", len(copies), frames)
+	}
+	// the copies retained across the Encode calls are still the input frames; both have packed rows
+	for i, c := range copies {
+		for j := range inputs[i].Planes {
+			if !bytes.Equal(c.Planes[j], inputs[i].Planes[j]) {
+				t.Fatalf("frame %d: plane %d of the retained copy differs from the input", i, j)
+			}
+		}
+	}
+}
+
+func TestEncoderCoalesceFrames(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.CoalesceFrames = true
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	const frames = 12
+	var data []byte
+	var output []byte
+	chunks := 0
+	check := func(n int, stats *EncoderStats) {
+		if n == 0 {
+			return
+		}
+		chunks++
+		chunk := output[:n]
+		if stats == nil {
+			t.Errorf("chunk %d of %d bytes returned without stats", chunks, n)
+		}
+		if c := bytes.Count(chunk, []byte{0, 0, 1, 0xb6}); c != 1 {
+			t.Errorf("chunk %d has %d VOP start codes, expected exactly 1", chunks, c)
+		}
+		data = append(data, chunk...)
+	}
+	for i := 0; i < frames; i++ {
+		n, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(n, stats)
+	}
+	for {
+		n, stats, err := encoder.Flush(&output)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		check(n, stats)
+	}
+	if chunks != frames {
+		t.Errorf("%d chunks returned, expected one per frame (%d)", chunks, frames)
+	}
+	if n := len(decodeTestStream(t, data, ColorSpaceNoOutput)); n != frames {
+		t.Errorf("decoded %d frames, expected %d", n, frames)
+	}
+}
+
+func TestEncoderIntraOnly(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.IntraOnly = true
+	const frames = 10
+	data := encodeTestStream(t, init, frames)
+	decoded := decodeTestStream(t, data, ColorSpaceNoOutput)
+	if len(decoded) != frames {
+		t.Fatalf("decoded %d frames, expected %d", len(decoded), frames)
+	}
+	for i, stats := range decoded {
+		if stats.FrameType != FrameTypeI {
+			t.Errorf("frame %d: type %v, expected an I frame", i, stats.FrameType)
+		}
+	}
+}
+
+// countVOLHeaders returns the number of VOL start codes (00 00 01 2x) in data
+func countVOLHeaders(data []byte) int {
+	n := 0
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 && data[i+3]&0xf0 == 0x20 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEncoderVOLHeaderInterval(t *testing.T) {
+	initXvid(t)
+	for _, interval := range []int{0, 5} {
+		init := testEncoderInit(64, 48)
+		init.MaxBFrames = 0
+		init.VOLHeaderInterval = interval
+		const frames = 21
+		data := encodeTestStream(t, init, frames)
+		// without an interval, only the first frame (the only key frame) carries the headers
+		expected := 1
+		if interval > 0 {
+			expected = (frames + interval - 1) / interval
+		}
+		if n := countVOLHeaders(data); n != expected {
+			t.Errorf("interval %d: %d VOL headers, expected %d", interval, n, expected)
+		}
+		if n := len(decodeTestStream(t, data, ColorSpaceNoOutput)); n != frames {
+			t.Errorf("interval %d: decoded %d frames, expected %d", interval, n, frames)
+		}
+	}
+}
+
+func TestAlphaRoundTrip(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	colorInit := testEncoderInit(width, height)
+	colorInit.FixedQuantizer = 2
+	alphaInit := testEncoderInit(width, height)
+	alphaInit.FixedQuantizer = 2
+	var color, alpha bytes.Buffer
+	encoder, err := NewAlphaEncoder(colorInit, alphaInit, &color, &alpha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const frames = 5
+	var inputs []*image.RGBA
+	for i := 0; i < frames; i++ {
+		// an opaque grey left half, and a transparent right half moving with the frames
+		rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if x < width/2+2*i {
+					copy(rgba.Pix[y*rgba.Stride+x*4:], []byte{128, 128, 128, 255})
+				}
+			}
+		}
+		inputs = append(inputs, rgba)
+		if err := encoder.EncodeWithAlpha(rgba); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := NewAlphaDecoder(&color, &alpha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	for i, input := range inputs {
+		rgba, err := decoder.DecodeWithAlpha()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		for j := 0; j < len(rgba.Pix); j += 4 {
+			a := rgba.Pix[j+3]
+			if d := int(a) - int(input.Pix[j+3]); d < -32 || d > 32 {
+				t.Fatalf("frame %d: pixel %d: alpha %d, expected about %d", i, j/4, a, input.Pix[j+3])
+			}
+			for c := 0; c < 3; c++ {
+				if rgba.Pix[j+c] > a {
+					t.Fatalf("frame %d: pixel %d: color %d above alpha %d", i, j/4, rgba.Pix[j+c], a)
+				}
+			}
+		}
+	}
+	if _, err := decoder.DecodeWithAlpha(); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestPluginPriorityOrder(t *testing.T) {
+	initXvid(t)
+	var calls []string
+	record := func(name string) Plugin {
+		return &testPlugin{before: func(data *PluginData) {
+			calls = append(calls, name)
+		}}
+	}
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	init.FixedQuantizer = 0
+	// custom plugins with mixed priorities, around an internal rate control plugin
+	init.Plugins = []Plugin{
+		WithPriority(record("late"), 10),
+		record("first default"),
+		PluginRC1Pass(PluginRC1PassInit{}),
+		WithPriority(record("early"), -5),
+		record("second default"),
+		WithPriority(record("rate control"), PluginPriorityRateControl),
+	}
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	expected := []string{"early", "first default", "second default", "rate control", "late"}
+	names := encoder.Config().Plugins
+	if len(names) != len(init.Plugins) || names[2] != "PluginRC1Pass" {
+		t.Errorf("configured plugins %v, expected the rate control plugin between the default priority plugins", names)
+	}
+	var output []byte
+	for i := 0; i < 3; i++ {
+		calls = calls[:0]
+		if _, _, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(calls) != fmt.Sprint(expected) {
+			t.Errorf("frame %d: plugins called in order %v, expected %v", i, calls, expected)
+		}
+	}
+}
+
+// errorReader reads from r, then returns err instead of io.EOF
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestDecoderReadError(t *testing.T) {
+	initXvid(t)
+	// noise frames are large, so that the stream is several times larger than the smallest buffer
+	data := encodeTestStream(t, testEncoderInit(320, 240), 10)
+	errRead := errors.New("connection reset")
+	for _, n := range []int{0, 100, len(data) / 2} {
+		for _, bufferSize := range []int{0, minDecoderBufferSize} {
+			decoder, err := NewDecoder(DecoderInit{
+				Input:      &errorReader{r: bytes.NewReader(data[:n]), err: errRead},
+				BufferSize: bufferSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames := 0
+			for {
+				var stats DecoderStats
+				_, stats, err = decoder.Decode(DecoderFrame{Output: &Image{Colorspace: ColorSpaceNoOutput}})
+				if err != nil {
+					break
+				}
+				if stats.StatsFrame != nil {
+					frames++
+				}
+			}
+			decoder.Close()
+			if err != errRead {
+				t.Errorf("error after %d bytes, buffer size %d: Decode returned %v, expected the read error", n, bufferSize, err)
+			}
+			// with the small buffer, the error happens when refilling it, after decoding the first frames
+			if n == len(data)/2 && bufferSize != 0 && frames == 0 {
+				t.Errorf("error after %d bytes, buffer size %d: no frame decoded before the read error", n, bufferSize)
+			}
+		}
+	}
+}
+
+func TestDecoderBufferGrowth(t *testing.T) {
+	initXvid(t)
+	// noise frames at the finest quantizer are larger than the smallest buffer
+	init := testEncoderInit(640, 480)
+	init.FixedQuantizer = 2
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	var output []byte
+	largest := 0
+	const frames = 4
+	add := func(n int) {
+		if n > largest {
+			largest = n
+		}
+		data = append(data, output[:n]...)
+	}
+	for i := 0; i < frames; i++ {
+		n, _, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(n)
+	}
+	for {
+		n, _, err := encoder.Flush(&output)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		add(n)
+	}
+	encoder.Close()
+	if largest <= minDecoderBufferSize {
+		t.Fatalf("largest frame of %d bytes, expected a frame larger than the %d bytes buffer", largest, minDecoderBufferSize)
+	}
+
+	expected := decodeTestStream(t, data, ColorSpacePlanar)
+	decoder, err := NewDecoder(DecoderInit{Input: bytes.NewReader(data), BufferSize: minDecoderBufferSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	decoded := 0
+	for {
+		output := Image{Colorspace: ColorSpacePlanar}
+		_, stats, err := decoder.Decode(DecoderFrame{Output: &output})
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if stats.StatsFrame == nil {
+			continue
+		}
+		if decoded < len(expected) && stats.FrameType != expected[decoded].FrameType {
+			t.Errorf("frame %d: type %v, expected %v", decoded, stats.FrameType, expected[decoded].FrameType)
+		}
+		decoded++
+	}
+	if decoded != frames || len(expected) != frames {
+		t.Errorf("decoded %d frames with the small buffer and %d with the default buffer, expected %d", decoded, len(expected), frames)
+	}
+	if len(decoder.buf) <= minDecoderBufferSize {
+		t.Errorf("buffer of %d bytes, expected it to grow to fit the largest frame", len(decoder.buf))
+	}
+}
+
+func TestEncodeStream(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	const frames = 12
+	images := make(chan *Image)
+	go func() {
+		for i := 0; i < frames; i++ {
+			images <- TestPattern(init.Width, init.Height, PatternNoise, int64(i))
+		}
+		close(images)
+	}()
+	var buf bytes.Buffer
+	if err := encoder.EncodeStream(context.Background(), images, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(decodeTestStream(t, buf.Bytes(), ColorSpaceNoOutput)); n != frames {
+		t.Errorf("decoded %d frames, expected %d", n, frames)
+	}
+
+	// a canceled stream stops waiting for frames
+	if err := encoder.Reset(nil); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- encoder.EncodeStream(ctx, make(chan *Image), &buf)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("canceled stream returned %v, expected context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled stream did not return")
+	}
+}
+
+func TestEncoderTotals(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxKeyFrameInterval = 5
+	init.FixedQuantizer = 0
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var expected EncoderTotals
+	quantizers := 0
+	add := func(stats *EncoderStats) {
+		if stats == nil {
+			return
+		}
+		expected.Frames++
+		switch stats.FrameType {
+		case FrameTypeI:
+			expected.IFrames++
+		case FrameTypeP:
+			expected.PFrames++
+		case FrameTypeB:
+			expected.BFrames++
+		case FrameTypeS:
+			expected.SFrames++
+		}
+		expected.Length += int64(stats.Length)
+		quantizers += stats.Quantizer
+	}
+	var output []byte
+	const frames = 12
+	for i := 0; i < frames; i++ {
+		_, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(stats)
+	}
+	for {
+		_, stats, err := encoder.Flush(&output)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		add(stats)
+	}
+	if expected.Frames != frames {
+		t.Fatalf("%d frames emitted, expected %d", expected.Frames, frames)
+	}
+	expected.AverageLength = float64(expected.Length) / frames
+	expected.AverageQuantizer = float64(quantizers) / frames
+	// 25 frames per second
+	expected.Bitrate = float64(expected.Length) * 8 / (frames / 25.0)
+	totals := encoder.Stats()
+	if math.Abs(totals.Bitrate-expected.Bitrate) > 1e-6*expected.Bitrate {
+		t.Errorf("bitrate %v, expected %v", totals.Bitrate, expected.Bitrate)
+	}
+	totals.Bitrate = expected.Bitrate
+	if totals != expected {
+		t.Errorf("totals %+v, expected %+v", totals, expected)
+	}
+	if expected.IFrames < 2 || expected.BFrames == 0 {
+		t.Errorf("totals %+v, expected several I frames and some B frames", expected)
+	}
+}
+
+func TestPacketizeSlices(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 64)
+	init.MaxBFrames = 0
+	// one slice per macroblock row
+	init.NumSlices = 4
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var output []byte
+	for i := 0; i < 3; i++ {
+		n, stats, err := encoder.Encode(EncoderFrame{
+			Input:  TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output: &output,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := output[:n]
+		boundaries := SliceBoundaries(frame)
+		if len(boundaries) < init.NumSlices-1 {
+			t.Fatalf("frame %d: %d boundaries found, expected at least one per additional slice (%d)", i, len(boundaries), init.NumSlices-1)
+		}
+		// the MTU fits the largest slice, but not the whole frame
+		mtu := 0
+		for j, start := range append([]int{0}, boundaries...) {
+			end := len(frame)
+			if j < len(boundaries) {
+				end = boundaries[j]
+			}
+			if end-start > mtu {
+				mtu = end - start
+			}
+		}
+		if mtu >= len(frame) {
+			t.Fatalf("frame %d: largest slice of %d bytes, expected it smaller than the frame", i, mtu)
+		}
+		for _, size := range []int{mtu, mtu / 3} {
+			p, err := NewPacketizer(size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packets := p.Packetize(frame, stats.KeyFrame, nil)
+			if len(packets) < 2 {
+				t.Fatalf("frame %d: MTU %d: %d packets, expected the frame to be split", i, size, len(packets))
+			}
+			isBoundary := make(map[int]bool)
+			for _, b := range boundaries {
+				isBoundary[b] = true
+			}
+			var joined []byte
+			for j, packet := range packets {
+				if len(packet.Data) > size {
+					t.Errorf("frame %d: MTU %d: packet %d of %d bytes", i, size, j, len(packet.Data))
+				}
+				// with an MTU fitting the slices, the packets start at slice boundaries
+				if size == mtu && j > 0 && !isBoundary[len(joined)] {
+					t.Errorf("frame %d: MTU %d: packet %d starts at %d, not at a slice boundary", i, size, j, len(joined))
+				}
+				if packet.FrameStart != (j == 0) || packet.FrameEnd != (j == len(packets)-1) || packet.KeyFrame != stats.KeyFrame {
+					t.Errorf("frame %d: MTU %d: packet %d: unexpected flags start %v, end %v, key frame %v", i, size, j, packet.FrameStart, packet.FrameEnd, packet.KeyFrame)
+				}
+				joined = append(joined, packet.Data...)
+			}
+			if !bytes.Equal(joined, frame) {
+				t.Errorf("frame %d: MTU %d: packets differ from the frame", i, size)
+			}
+		}
+	}
+}
+
+func TestPluginPSNRCallback(t *testing.T) {
+	initXvid(t)
+	init := testEncoderInit(64, 48)
+	init.MaxBFrames = 0
+	type psnr struct{ y, u, v float64 }
+	var callbacks []psnr
+	init.Plugins = []Plugin{PluginPSNRCallback(func(frameNum int, psnrY float64, psnrU float64, psnrV float64) {
+		callbacks = append(callbacks, psnr{psnrY, psnrU, psnrV})
+	})}
+	encoder, err := NewEncoder(init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var output []byte
+	const frames = 5
+	for i := 0; i < frames; i++ {
+		_, stats, err := encoder.Encode(EncoderFrame{
+			Input:    TestPattern(init.Width, init.Height, PatternNoise, int64(i)),
+			Output:   &output,
+			VOLFlags: VOLExtraStats,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats == nil || len(callbacks) != i+1 {
+			t.Fatalf("frame %d: %d PSNR callbacks, expected one per emitted frame", i, len(callbacks))
+		}
+		// both are computed from the same SSE
+		y, u, v, _ := stats.PSNR()
+		if c := callbacks[i]; c != (psnr{y, u, v}) {
+			t.Errorf("frame %d: callback PSNR %+v, expected the EncoderStats PSNR %+v", i, c, psnr{y, u, v})
+		}
+		if math.IsNaN(y) || math.IsInf(y, 1) || y < 20 {
+			t.Errorf("frame %d: unexpected Y PSNR %v at a fine quantizer", i, y)
+		}
+	}
+}
+
+func TestDecodeColorSpaceGray(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	data := encodeTestStream(t, testEncoderInit(width, height), 5)
+	decode := func(colorspace ColorSpace) []Image {
+		decoder, err := NewDecoderBytes(data, DecoderInit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+		images, _, err := decoder.DecodeN(5, Image{Colorspace: colorspace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return images
+	}
+	planar := decode(ColorSpacePlanar)
+	gray := decode(ColorSpaceGray)
+	if len(gray) != len(planar) || len(gray) != 5 {
+		t.Fatalf("decoded %d greyscale and %d planar frames, expected 5", len(gray), len(planar))
+	}
+	for i := range gray {
+		if len(gray[i].Planes) != 1 {
+			t.Fatalf("frame %d: %d greyscale planes, expected 1", i, len(gray[i].Planes))
+		}
+		img, err := gray[i].ToGoImage(width, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ok := img.(*image.Gray)
+		if !ok {
+			t.Fatalf("frame %d: greyscale image converted to %T, expected *image.Gray", i, img)
+		}
+		for y := 0; y < height; y++ {
+			if !bytes.Equal(g.Pix[y*g.Stride:][:width], planar[i].Planes[0][y*planar[i].Strides[0]:][:width]) {
+				t.Errorf("frame %d: row %d differs from the luma of the planar frame", i, y)
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeGrayRoundTrip(t *testing.T) {
+	initXvid(t)
+	const width, height = 64, 48
+	for _, greyscale := range []bool{true, false} {
+		init := testEncoderInit(width, height)
+		init.FixedQuantizer = 2
+		encoder, err := NewEncoder(init)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var flags VOPFlag
+		if greyscale {
+			flags = VOPGreyscale
+		}
+		var buf bytes.Buffer
+		w := NewEncoderWriter(encoder, &buf, nil)
+		// the bars have chroma, which is dropped when encoding in greyscale
+		input := TestPattern(width, height, PatternBars, 0)
+		const frames = 3
+		for i := 0; i < frames; i++ {
+			if _, err := w.Encode(EncoderFrame{Input: input, VOPFlags: flags}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		encoder.Close()
+
+		decoder, err := NewDecoderBytes(buf.Bytes(), DecoderInit{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := 0
+		for {
+			_, _, img, err := decoder.DecodeGray(DecoderFrame{})
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if img == nil {
+				continue
+			}
+			decoded++
+			var luma []byte
+			var stride int
+			switch img := img.(type) {
+			case *image.Gray:
+				if !greyscale {
+					t.Fatalf("frame %d: color frame decoded as %T", decoded, img)
+				}
+				luma, stride = img.Pix, img.Stride
+			case *image.YCbCr:
+				if greyscale {
+					t.Fatalf("frame %d: greyscale frame decoded as %T", decoded, img)
+				}
+				luma, stride = img.Y, img.YStride
+			default:
+				t.Fatalf("frame %d: unexpected image type %T", decoded, img)
+			}
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					if d := int(luma[y*stride+x]) - int(input.Planes[0][y*width+x]); d < -12 || d > 12 {
+						t.Fatalf("greyscale %v: frame %d: luma %d at %d,%d, expected about %d", greyscale, decoded, luma[y*stride+x], x, y, input.Planes[0][y*width+x])
+					}
+				}
+			}
+		}
+		decoder.Close()
+		if decoded != frames {
+			t.Errorf("greyscale %v: decoded %d frames, expected %d", greyscale, decoded, frames)
+		}
+	}
+}